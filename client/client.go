@@ -3,7 +3,7 @@
  *
  * API for managing next-gen webspaces. 
  *
- * API version: 1.2.0
+ * API version: 1.19.0
  * Generated by: OpenAPI Generator (https://openapi-generator.tech)
  */
 
@@ -40,7 +40,7 @@ var (
 	xmlCheck  = regexp.MustCompile(`(?i:(?:application|text)/xml)`)
 )
 
-// APIClient manages communication with the Netsoc webspaced API v1.2.0
+// APIClient manages communication with the Netsoc webspaced API v1.19.0
 // In most cases there should be only one, shared, APIClient.
 type APIClient struct {
 	cfg    *Configuration
@@ -48,6 +48,8 @@ type APIClient struct {
 
 	// API Services
 
+	AdminApi *AdminApiService
+
 	ConfigApi *ConfigApiService
 
 	ConsoleApi *ConsoleApiService
@@ -58,6 +60,8 @@ type APIClient struct {
 
 	PortsApi *PortsApiService
 
+	SnapshotsApi *SnapshotsApiService
+
 	StateApi *StateApiService
 }
 
@@ -77,11 +81,13 @@ func NewAPIClient(cfg *Configuration) *APIClient {
 	c.common.client = c
 
 	// API Services
+	c.AdminApi = (*AdminApiService)(&c.common)
 	c.ConfigApi = (*ConfigApiService)(&c.common)
 	c.ConsoleApi = (*ConsoleApiService)(&c.common)
 	c.DomainsApi = (*DomainsApiService)(&c.common)
 	c.ImagesApi = (*ImagesApiService)(&c.common)
 	c.PortsApi = (*PortsApiService)(&c.common)
+	c.SnapshotsApi = (*SnapshotsApiService)(&c.common)
 	c.StateApi = (*StateApiService)(&c.common)
 
 	return c
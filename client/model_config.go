@@ -3,7 +3,7 @@
  *
  * API for managing next-gen webspaces. 
  *
- * API version: 1.2.0
+ * API version: 1.19.0
  * Generated by: OpenAPI Generator (https://openapi-generator.tech)
  */
 
@@ -16,4 +16,8 @@ type Config struct {
 	HttpPort int32 `json:"httpPort,omitempty"`
 	// If true, SSL termination will be disabled and HTTPS connections will forwarded directly 
 	SniPassthrough bool `json:"sniPassthrough,omitempty"`
+	// How many seconds the webspace can be idle (no incoming traffic or port forward connections) before it is shut down. 0 uses the server's default. 
+	IdleTimeout float64 `json:"idleTimeout,omitempty"`
+	// If true, the webspace will be excluded from scheduled automatic snapshots 
+	DisableAutoSnapshots bool `json:"disableAutoSnapshots,omitempty"`
 }
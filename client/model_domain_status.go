@@ -0,0 +1,20 @@
+/*
+ * Netsoc webspaced
+ *
+ * API for managing next-gen webspaces. 
+ *
+ * API version: 1.19.0
+ * Generated by: OpenAPI Generator (https://openapi-generator.tech)
+ */
+
+package webspaced
+// DomainStatus State of a webspace domain's DNS verification, routing and TLS certificate
+type DomainStatus struct {
+	// Custom domain
+	Domain string `json:"domain"`
+	// Whether or not this is the webspace's default domain (which doesn't need verification)
+	Default bool `json:"default"`
+	Verification DomainStatusVerification `json:"verification"`
+	Routing DomainStatusRouting `json:"routing"`
+	Certificate DomainStatusCertificate `json:"certificate"`
+}
@@ -0,0 +1,24 @@
+/*
+ * Netsoc webspaced
+ *
+ * API for managing next-gen webspaces. 
+ *
+ * API version: 1.19.0
+ * Generated by: OpenAPI Generator (https://openapi-generator.tech)
+ */
+
+package webspaced
+import (
+	"time"
+)
+// DomainStatusCertificate struct for DomainStatusCertificate
+type DomainStatusCertificate struct {
+	// Where the domain's certificate comes from. `default` is the server's wildcard certificate, `passthrough` means TLS is handled by the webspace and `provider` means the reverse proxy obtains certificates on its own. 
+	Source string `json:"source"`
+	// Certificate state (`unknown` if webspaced can't tell)
+	Status string `json:"status"`
+	// Certificate expiry
+	NotAfter time.Time `json:"notAfter,omitempty"`
+	// Error from the last failed attempt to issue the certificate
+	Error string `json:"error,omitempty"`
+}
@@ -0,0 +1,19 @@
+/*
+ * Netsoc webspaced
+ *
+ * API for managing next-gen webspaces. 
+ *
+ * API version: 1.19.0
+ * Generated by: OpenAPI Generator (https://openapi-generator.tech)
+ */
+
+package webspaced
+// DomainStatusRouting struct for DomainStatusRouting
+type DomainStatusRouting struct {
+	// Whether or not the reverse proxy has been configured for the domain
+	Configured bool `json:"configured"`
+	// Whether or not requests are being routed directly to the running webspace (as opposed to booting it on demand) 
+	Running bool `json:"running"`
+	// Error from the last failed attempt to configure the reverse proxy
+	Error string `json:"error,omitempty"`
+}
@@ -0,0 +1,26 @@
+/*
+ * Netsoc webspaced
+ *
+ * API for managing next-gen webspaces. 
+ *
+ * API version: 1.19.0
+ * Generated by: OpenAPI Generator (https://openapi-generator.tech)
+ */
+
+package webspaced
+import (
+	"time"
+)
+// DomainStatusVerification struct for DomainStatusVerification
+type DomainStatusVerification struct {
+	// Whether or not the domain's `TXT` record currently points at the webspace
+	Verified bool `json:"verified"`
+	// Whether or not the domain is waiting to be verified in the background
+	Pending bool `json:"pending"`
+	// Time after which a pending domain will be dropped if it still can't be verified
+	Deadline time.Time `json:"deadline,omitempty"`
+	// Time of a pending domain's next verification attempt
+	NextCheck time.Time `json:"nextCheck,omitempty"`
+	// Reason verification failed
+	Error string `json:"error,omitempty"`
+}
@@ -0,0 +1,26 @@
+/*
+ * Netsoc webspaced
+ *
+ * API for managing next-gen webspaces. 
+ *
+ * API version: 1.19.0
+ * Generated by: OpenAPI Generator (https://openapi-generator.tech)
+ */
+
+package webspaced
+import (
+	"time"
+)
+// PendingDomain Custom domain which couldn't be verified when it was added
+type PendingDomain struct {
+	// Time the domain was added
+	Added time.Time `json:"added"`
+	// Time after which the domain will be dropped if it still can't be verified
+	Deadline time.Time `json:"deadline"`
+	// Time of the next verification attempt
+	NextCheck time.Time `json:"nextCheck"`
+	// Number of background verification attempts so far
+	Attempts int32 `json:"attempts"`
+	// Reason the most recent verification attempt failed
+	LastError string `json:"lastError"`
+}
@@ -0,0 +1,21 @@
+/*
+ * Netsoc webspaced
+ *
+ * API for managing next-gen webspaces. 
+ *
+ * API version: 1.19.0
+ * Generated by: OpenAPI Generator (https://openapi-generator.tech)
+ */
+
+package webspaced
+// PortLimits Connection limits for a port forward. A value of 0 means the server's limit (if any) applies. Limits cannot exceed the server's. 
+type PortLimits struct {
+	// Maximum number of concurrent connections (or UDP sessions)
+	MaxConnections int32 `json:"maxConnections,omitempty"`
+	// Maximum number of concurrent connections (or UDP sessions) from a single address
+	MaxConnectionsPerIP int32 `json:"maxConnectionsPerIP,omitempty"`
+	// Number of new connections (or UDP sessions) allowed per second
+	ConnectionRate float64 `json:"connectionRate,omitempty"`
+	// Number of new connections which can be made at once, exceeding the rate
+	ConnectionBurst int32 `json:"connectionBurst,omitempty"`
+}
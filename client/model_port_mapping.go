@@ -0,0 +1,22 @@
+/*
+ * Netsoc webspaced
+ *
+ * API for managing next-gen webspaces. 
+ *
+ * API version: 1.19.0
+ * Generated by: OpenAPI Generator (https://openapi-generator.tech)
+ */
+
+package webspaced
+// PortMapping Internal side of a port forward
+type PortMapping struct {
+	// Network port
+	Port int32 `json:"port,omitempty"`
+	Protocol Protocol `json:"protocol,omitempty"`
+	ProxyProtocol ProxyProtocol `json:"proxyProtocol,omitempty"`
+	// CIDRs (or IP addresses) which can connect. If empty, any address which isn't denied can connect. 
+	Allow []string `json:"allow,omitempty"`
+	// CIDRs (or IP addresses) which cannot connect (takes precedence over `allow`)
+	Deny []string `json:"deny,omitempty"`
+	Limits PortLimits `json:"limits,omitempty"`
+}
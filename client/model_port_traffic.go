@@ -0,0 +1,19 @@
+/*
+ * Netsoc webspaced
+ *
+ * API for managing next-gen webspaces. 
+ *
+ * API version: 1.19.0
+ * Generated by: OpenAPI Generator (https://openapi-generator.tech)
+ */
+
+package webspaced
+// PortTraffic struct for PortTraffic
+type PortTraffic struct {
+	// Number of connections forwarded
+	Connections int64 `json:"connections"`
+	// Bytes forwarded to the webspace
+	BytesIn int64 `json:"bytesIn"`
+	// Bytes forwarded from the webspace
+	BytesOut int64 `json:"bytesOut"`
+}
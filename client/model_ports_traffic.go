@@ -0,0 +1,20 @@
+/*
+ * Netsoc webspaced
+ *
+ * API for managing next-gen webspaces. 
+ *
+ * API version: 1.19.0
+ * Generated by: OpenAPI Generator (https://openapi-generator.tech)
+ */
+
+package webspaced
+// PortsTraffic Port forwarding traffic for the current month
+type PortsTraffic struct {
+	// Month the counters apply to (UTC)
+	Month string `json:"month"`
+	// Total number of bytes (in both directions) which can be forwarded this month. New connections are refused once it has been used up. A value of 0 means there is no quota. 
+	Quota int64 `json:"quota"`
+	Total PortTraffic `json:"total"`
+	// Traffic by external port
+	Ports map[string]PortTraffic `json:"ports"`
+}
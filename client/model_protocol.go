@@ -0,0 +1,18 @@
+/*
+ * Netsoc webspaced
+ *
+ * API for managing next-gen webspaces. 
+ *
+ * API version: 1.19.0
+ * Generated by: OpenAPI Generator (https://openapi-generator.tech)
+ */
+
+package webspaced
+// Protocol Port forward protocol
+type Protocol string
+
+// List of Protocol
+const (
+	TCP Protocol = "tcp"
+	UDP Protocol = "udp"
+)
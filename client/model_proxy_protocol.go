@@ -0,0 +1,19 @@
+/*
+ * Netsoc webspaced
+ *
+ * API for managing next-gen webspaces. 
+ *
+ * API version: 1.19.0
+ * Generated by: OpenAPI Generator (https://openapi-generator.tech)
+ */
+
+package webspaced
+// ProxyProtocol PROXY protocol version to use when connecting to the webspace, passing on the client's address (TCP only). 0 disables the PROXY protocol. 
+type ProxyProtocol int32
+
+// List of ProxyProtocol
+const (
+	_0 ProxyProtocol = 0
+	_1 ProxyProtocol = 1
+	_2 ProxyProtocol = 2
+)
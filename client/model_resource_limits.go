@@ -0,0 +1,23 @@
+/*
+ * Netsoc webspaced
+ *
+ * API for managing next-gen webspaces. 
+ *
+ * API version: 1.19.0
+ * Generated by: OpenAPI Generator (https://openapi-generator.tech)
+ */
+
+package webspaced
+// ResourceLimits Resource limits for a webspace. A value of 0 means the server's default (or no limit) applies. 
+type ResourceLimits struct {
+	// Number of CPUs
+	Cpu int32 `json:"cpu,omitempty"`
+	// Memory limit (bytes)
+	Memory int64 `json:"memory,omitempty"`
+	// Root disk size (bytes)
+	Disk int64 `json:"disk,omitempty"`
+	// Maximum number of processes
+	Processes int32 `json:"processes,omitempty"`
+	// Monthly port forwarding traffic quota (bytes)
+	Traffic int64 `json:"traffic,omitempty"`
+}
@@ -0,0 +1,20 @@
+/*
+ * Netsoc webspaced
+ *
+ * API for managing next-gen webspaces. 
+ *
+ * API version: 1.19.0
+ * Generated by: OpenAPI Generator (https://openapi-generator.tech)
+ */
+
+package webspaced
+import (
+	"time"
+)
+// Snapshot Webspace snapshot
+type Snapshot struct {
+	// Snapshot name
+	Name string `json:"name"`
+	// Time the snapshot was taken
+	CreatedAt time.Time `json:"createdAt"`
+}
@@ -3,7 +3,7 @@
  *
  * API for managing next-gen webspaces. 
  *
- * API version: 1.2.0
+ * API version: 1.19.0
  * Generated by: OpenAPI Generator (https://openapi-generator.tech)
  */
 
@@ -14,5 +14,6 @@ type State struct {
 	// Length of time for which container has been running (seconds)
 	Uptime float64 `json:"uptime"`
 	Usage Usage `json:"usage"`
+	Limits ResourceLimits `json:"limits"`
 	NetworkInterfaces map[string]NetworkInterface `json:"networkInterfaces"`
 }
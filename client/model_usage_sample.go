@@ -0,0 +1,29 @@
+/*
+ * Netsoc webspaced
+ *
+ * API for managing next-gen webspaces. 
+ *
+ * API version: 1.19.0
+ * Generated by: OpenAPI Generator (https://openapi-generator.tech)
+ */
+
+package webspaced
+import (
+	"time"
+)
+// UsageSample Webspace resource usage at a point in time
+type UsageSample struct {
+	// CPU time (nanoseconds)
+	Cpu int64 `json:"cpu"`
+	Disks map[string]int64 `json:"disks"`
+	// Memory usage in bytes
+	Memory int64 `json:"memory"`
+	// Number of processes
+	Processes int64 `json:"processes"`
+	// Time the sample was taken
+	Time time.Time `json:"time"`
+	// Total bytes received across all network interfaces
+	BytesReceived int64 `json:"bytesReceived"`
+	// Total bytes sent across all network interfaces
+	BytesSent int64 `json:"bytesSent"`
+}
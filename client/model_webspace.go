@@ -3,7 +3,7 @@
  *
  * API for managing next-gen webspaces. 
  *
- * API version: 1.2.0
+ * API version: 1.19.0
  * Generated by: OpenAPI Generator (https://openapi-generator.tech)
  */
 
@@ -13,8 +13,13 @@ type Webspace struct {
 	// Unique database identifier, not modifiable.
 	User int32 `json:"user,omitempty"`
 	Config Config `json:"config,omitempty"`
+	Limits ResourceLimits `json:"limits,omitempty"`
 	// List of webspace custom domains
 	Domains []string `json:"domains,omitempty"`
+	// Custom domains which are waiting for their `TXT` record to appear (by domain)
+	PendingDomains map[string]PendingDomain `json:"pendingDomains,omitempty"`
 	// Mapping of external ports to internal container ports (port forwarding)
 	Ports map[string]int32 `json:"ports,omitempty"`
+	// Port forward settings (protocol, PROXY protocol and access control) by external port
+	PortMappings map[string]PortMapping `json:"portMappings,omitempty"`
 }
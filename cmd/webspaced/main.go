@@ -12,6 +12,7 @@ import (
 	"github.com/fsnotify/fsnotify"
 	"github.com/netsoc/webspaced/internal/config"
 	"github.com/netsoc/webspaced/internal/server"
+	"github.com/netsoc/webspaced/internal/webspace"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
@@ -50,28 +51,89 @@ func init() {
 	viper.SetDefault("webspaces.config_defaults.startup_delay", 3)
 	viper.SetDefault("webspaces.config_defaults.http_port", 80)
 	viper.SetDefault("webspaces.config_defaults.sni_passthrough", false)
+	viper.SetDefault("webspaces.config_defaults.idle_timeout", 0)
+	viper.SetDefault("webspaces.config_defaults.disable_auto_snapshots", false)
 	viper.SetDefault("webspaces.max_startup_delay", 60)
 	viper.SetDefault("webspaces.ip_timeout", 15*time.Second)
+	viper.SetDefault("webspaces.max_import_size", "16GiB")
+	viper.SetDefault("webspaces.idle_timeout", 0)
+	viper.SetDefault("webspaces.max_idle_timeout", 0)
+	viper.SetDefault("webspaces.idle_check_interval", 1*time.Minute)
+	viper.SetDefault("webspaces.resync_interval", 5*time.Minute)
+	viper.SetDefault("webspaces.full_resync_interval", 1*time.Hour)
+	viper.SetDefault("webspaces.domain_verification.timeout", 48*time.Hour)
+	viper.SetDefault("webspaces.domain_verification.check_interval", time.Minute)
+	viper.SetDefault("webspaces.domain_verification.max_interval", time.Hour)
+	viper.SetDefault("webspaces.domain_verification.max_pending", 5)
+	viper.SetDefault("webspaces.idle_traffic_threshold", 65536)
 	viper.SetDefault("webspaces.ports.start", 49152)
 	viper.SetDefault("webspaces.ports.end", 65535)
 	viper.SetDefault("webspaces.ports.max", 64)
 	viper.SetDefault("webspaces.ports.kubernetes_service", "")
+	viper.SetDefault("webspaces.ports.traffic_flush_interval", 5*time.Minute)
+	viper.SetDefault("webspaces.ports.udp_session_timeout", 3*time.Minute)
+	viper.SetDefault("webspaces.ports.drain_timeout", 10*time.Second)
+	viper.SetDefault("webspaces.ports.max_connections", 512)
+	viper.SetDefault("webspaces.ports.max_connections_per_ip", 0)
+	viper.SetDefault("webspaces.ports.connection_rate", 0)
+	viper.SetDefault("webspaces.ports.connection_burst", 0)
+	viper.SetDefault("webspaces.limits.defaults.cpu", 0)
+	viper.SetDefault("webspaces.limits.defaults.memory", 0)
+	viper.SetDefault("webspaces.limits.defaults.disk", 0)
+	viper.SetDefault("webspaces.limits.defaults.processes", 0)
+	viper.SetDefault("webspaces.limits.defaults.traffic", 0)
+	viper.SetDefault("webspaces.limits.max.cpu", 0)
+	viper.SetDefault("webspaces.limits.max.memory", 0)
+	viper.SetDefault("webspaces.limits.max.disk", 0)
+	viper.SetDefault("webspaces.limits.max.processes", 0)
+	viper.SetDefault("webspaces.limits.max.traffic", 0)
+	viper.SetDefault("webspaces.usage_history.interval", 1*time.Minute)
+	viper.SetDefault("webspaces.usage_history.samples", 1440)
+	viper.SetDefault("webspaces.snapshots.max", 5)
+	viper.SetDefault("webspaces.snapshots.check_interval", 1*time.Hour)
+	viper.SetDefault("webspaces.snapshots.daily.enabled", false)
+	viper.SetDefault("webspaces.snapshots.daily.keep", 7)
+	viper.SetDefault("webspaces.snapshots.daily.max_age", 0)
+	viper.SetDefault("webspaces.snapshots.weekly.enabled", false)
+	viper.SetDefault("webspaces.snapshots.weekly.keep", 4)
+	viper.SetDefault("webspaces.snapshots.weekly.max_age", 0)
 
 	viper.SetDefault("http.listen_address", ":80")
+	viper.SetDefault("http.metrics_address", "127.0.0.1:9091")
 	viper.SetDefault("http.cors.allowed_origins", []string{"*"})
 
-	viper.SetDefault("traefik.provider", "redis")
-	viper.SetDefault("traefik.redis.addr", "127.0.0.1:6379")
-	viper.SetDefault("traefik.redis.db", 0)
-	viper.SetDefault("traefik.redis.cert_resolver", "")
-	viper.SetDefault("traefik.kubernetes.namespace", "webspace-ng")
-	viper.SetDefault("traefik.kubernetes.default_secret", "")
-	viper.SetDefault("traefik.kubernetes.cluster_issuer", "")
-	viper.SetDefault("traefik.https_entrypoint", "https")
-	viper.SetDefault("traefik.default_sans", []string{})
-	viper.SetDefault("traefik.webspaced_url", "http://localhost:8080")
-	viper.SetDefault("traefik.iam_token", "")
-	viper.SetDefault("traefik.iam_token_file", "")
+	viper.SetDefault("routing.provider", "redis")
+	viper.SetDefault("routing.redis.addr", "127.0.0.1:6379")
+	viper.SetDefault("routing.redis.db", 0)
+	viper.SetDefault("routing.redis.cert_resolver", "")
+	viper.SetDefault("routing.kubernetes.namespace", "webspace-ng")
+	viper.SetDefault("routing.kubernetes.default_secret", "")
+	viper.SetDefault("routing.kubernetes.cluster_issuer", "")
+	viper.SetDefault("routing.file.directory", "/etc/traefik/webspaces")
+	viper.SetDefault("routing.file.format", "yaml")
+	viper.SetDefault("routing.file.cert_resolver", "")
+	viper.SetDefault("routing.caddy.admin_url", "http://localhost:2019")
+	viper.SetDefault("routing.caddy.server", "srv0")
+	viper.SetDefault("routing.builtin.http_address", ":8000")
+	viper.SetDefault("routing.builtin.https_address", "")
+	viper.SetDefault("routing.builtin.cert_file", "")
+	viper.SetDefault("routing.builtin.key_file", "")
+	viper.SetDefault("routing.builtin.redirect_https", false)
+	viper.SetDefault("routing.builtin.read_header_timeout", 10*time.Second)
+	viper.SetDefault("routing.builtin.read_timeout", 5*time.Minute)
+	viper.SetDefault("routing.builtin.idle_timeout", 2*time.Minute)
+	viper.SetDefault("routing.acme.directory_url", "")
+	viper.SetDefault("routing.acme.email", "")
+	viper.SetDefault("routing.acme.storage_dir", "/var/lib/webspaced/acme")
+	viper.SetDefault("routing.acme.renew_before", 30*24*time.Hour)
+	viper.SetDefault("routing.acme.check_interval", time.Hour)
+	viper.SetDefault("routing.acme.retry_backoff", 15*time.Minute)
+	viper.SetDefault("routing.http_entrypoint", "http")
+	viper.SetDefault("routing.https_entrypoint", "https")
+	viper.SetDefault("routing.default_sans", []string{})
+	viper.SetDefault("routing.webspaced_url", "http://localhost:8080")
+	viper.SetDefault("routing.iam_token", "")
+	viper.SetDefault("routing.iam_token_file", "")
 
 	// Config file loading
 	viper.SetConfigType("yaml")
@@ -83,6 +145,17 @@ func init() {
 	viper.SetEnvPrefix("WSD")
 	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
 	viper.AutomaticEnv()
+	// The routing section used to be called traefik, so accept the old variables (e.g. WSD_TRAEFIK_PROVIDER) too
+	for _, k := range viper.AllKeys() {
+		if !strings.HasPrefix(k, "routing.") {
+			continue
+		}
+
+		env := strings.ToUpper(strings.ReplaceAll(strings.TrimPrefix(k, "routing."), ".", "_"))
+		if err := viper.BindEnv(k, "WSD_ROUTING_"+env, "WSD_TRAEFIK_"+env); err != nil {
+			log.WithError(err).Fatal("Failed to bind routing environment variables")
+		}
+	}
 
 	// Config from flags
 	pflag.StringP("log_level", "l", "info", "log level")
@@ -98,8 +171,18 @@ func init() {
 }
 
 func reload() {
+	var handoff *webspace.Handoff
 	if srv != nil {
-		stop()
+		log.Info("Stopping server for reload")
+
+		ctx, cancel := context.WithTimeout(context.Background(), srv.Config.Timeouts.Shutdown)
+		var err error
+		handoff, err = srv.Handoff(ctx)
+		cancel()
+		if err != nil {
+			log.WithError(err).Fatal("Failed to stop server")
+		}
+
 		srv = nil
 	}
 
@@ -107,6 +190,18 @@ func reload() {
 	if err := viper.Unmarshal(&cfg, config.DecoderOptions); err != nil {
 		log.WithField("err", err).Fatal("Failed to parse configuration")
 	}
+	for _, e := range os.Environ() {
+		if strings.HasPrefix(e, "WSD_TRAEFIK_") {
+			log.Warn("WSD_TRAEFIK_* environment variables have been renamed to WSD_ROUTING_*")
+			break
+		}
+	}
+	if viper.InConfig("traefik") {
+		log.Warn("The traefik config section has been renamed to routing")
+		if err := viper.UnmarshalKey("traefik", &cfg.Routing, config.DecoderOptions); err != nil {
+			log.WithField("err", err).Fatal("Failed to parse configuration")
+		}
+	}
 
 	if err := cfg.ReadSecrets(); err != nil {
 		log.WithError(err).Fatal("Failed to read config secrets from files")
@@ -120,6 +215,8 @@ func reload() {
 	log.WithField("config", string(cJSON)).Debug("Got config")
 
 	srv = server.NewServer(cfg)
+	// Keep port forward listeners (and their connections) open and usage history across the reload
+	srv.Adopt(handoff)
 
 	log.Info("Starting server")
 	go func() {
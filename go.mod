@@ -3,11 +3,13 @@ module github.com/netsoc/webspaced
 go 1.16
 
 require (
+	github.com/BurntSushi/toml v0.3.1
 	github.com/cenkalti/backoff/v4 v4.1.1
 	github.com/dgrijalva/jwt-go/v4 v4.0.0-preview1
 	github.com/flosch/pongo2 v0.0.0-20200913210552-0d938eb266f3 // indirect
 	github.com/fsnotify/fsnotify v1.4.9
 	github.com/githubnemo/CompileDaemon v1.3.0
+	github.com/go-acme/lego/v4 v4.4.0
 	github.com/go-bindata/go-bindata/v3 v3.1.3
 	github.com/go-openapi/runtime v0.19.29
 	github.com/go-openapi/spec v0.20.3 // indirect
@@ -21,13 +23,16 @@ require (
 	github.com/lxc/lxd v0.0.0-20210721222701-a124a46b7614
 	github.com/mitchellh/mapstructure v1.4.1
 	github.com/netsoc/iam/client v1.0.11
+	github.com/prometheus/client_golang v1.9.0
 	github.com/rs/cors v1.8.0
 	github.com/sirupsen/logrus v1.8.1
 	github.com/spf13/pflag v1.0.5
 	github.com/spf13/viper v1.8.1
 	github.com/traefik/traefik/v2 v2.5.0-rc2
 	golang.org/x/net v0.0.0-20210716203947-853a461950ff // indirect
+	golang.org/x/time v0.0.0-20210220033141-f8bda1e9f3ba
 	golang.org/x/tools v0.1.5 // indirect
+	gopkg.in/yaml.v2 v2.4.0
 	gopkg.in/httprequest.v1 v1.2.1 // indirect
 	gopkg.in/macaroon-bakery.v2 v2.3.0 // indirect
 	gopkg.in/robfig/cron.v2 v2.0.0-20150107220207-be2e0b0deed5 // indirect
@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/mitchellh/mapstructure"
+	"github.com/netsoc/webspaced/pkg/util"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -36,6 +37,18 @@ func StringToTemplateHookFunc() mapstructure.DecodeHookFunc {
 	}
 }
 
+// StringToByteSizeHookFunc returns a mapstructure.DecodeHookFunc which parses a ByteSize from a string
+func StringToByteSizeHookFunc() mapstructure.DecodeHookFunc {
+	return func(f reflect.Type, t reflect.Type, data interface{}) (interface{}, error) {
+		if f.Kind() != reflect.String || t != reflect.TypeOf(ByteSize(0)) {
+			return data, nil
+		}
+
+		size, err := util.ParseByteSize(data.(string))
+		return ByteSize(size), err
+	}
+}
+
 // DecoderOptions enables necessary mapstructure decode hook functions
 func DecoderOptions(config *mapstructure.DecoderConfig) {
 	config.ErrorUnused = true
@@ -44,6 +57,7 @@ func DecoderOptions(config *mapstructure.DecoderConfig) {
 		mapstructure.StringToTimeDurationHookFunc(),
 		StringToLogLevelHookFunc(),
 		StringToTemplateHookFunc(),
+		StringToByteSizeHookFunc(),
 	)
 }
 
@@ -52,6 +66,33 @@ type WebspaceConfig struct {
 	StartupDelay   float64 `json:"startupDelay" mapstructure:"startup_delay"`
 	HTTPPort       uint16  `json:"httpPort" mapstructure:"http_port"`
 	SNIPassthrough bool    `json:"sniPassthrough" mapstructure:"sni_passthrough"`
+	// IdleTimeout overrides the global idle timeout (in seconds), 0 means use the global value
+	IdleTimeout float64 `json:"idleTimeout" mapstructure:"idle_timeout"`
+	// DisableAutoSnapshots opts the webspace out of scheduled automatic snapshots
+	DisableAutoSnapshots bool `json:"disableAutoSnapshots" mapstructure:"disable_auto_snapshots"`
+}
+
+// ByteSize is a size in bytes (which can be specified with a unit in config files)
+type ByteSize int64
+
+// ResourceLimits describes the resources a webspace can use (0 means no limit / use the profile's value)
+type ResourceLimits struct {
+	// CPU is the number of CPUs the webspace can use
+	CPU       uint16   `json:"cpu" mapstructure:"cpu"`
+	Memory    ByteSize `json:"memory" mapstructure:"memory"`
+	Disk      ByteSize `json:"disk" mapstructure:"disk"`
+	Processes uint32   `json:"processes" mapstructure:"processes"`
+	// Traffic is the number of bytes which can be forwarded through port forwards each month
+	Traffic ByteSize `json:"traffic" mapstructure:"traffic"`
+}
+
+// SnapshotPolicy describes a schedule for automatic snapshots and how long they should be kept
+type SnapshotPolicy struct {
+	Enabled bool
+	// Keep is the maximum number of snapshots to retain (0 means no limit)
+	Keep uint16
+	// MaxAge is the age after which snapshots are deleted (0 means no limit)
+	MaxAge time.Duration `mapstructure:"max_age"`
 }
 
 // Config describes the configuration for Server
@@ -100,6 +141,32 @@ type Config struct {
 		ConfigDefaults  WebspaceConfig `mapstructure:"config_defaults"`
 		MaxStartupDelay uint16         `mapstructure:"max_startup_delay"`
 		IPTimeout       time.Duration  `mapstructure:"ip_timeout"`
+		// MaxImportSize limits the size of uploaded backups (0 means no limit)
+		MaxImportSize ByteSize `mapstructure:"max_import_size"`
+
+		IdleTimeout          time.Duration `mapstructure:"idle_timeout"`
+		MaxIdleTimeout       time.Duration `mapstructure:"max_idle_timeout"`
+		IdleCheckInterval    time.Duration `mapstructure:"idle_check_interval"`
+		IdleTrafficThreshold int64         `mapstructure:"idle_traffic_threshold"`
+
+		// ResyncInterval is how often routing / port forwarding configs are reconciled with webspaces' state
+		ResyncInterval time.Duration `mapstructure:"resync_interval"`
+		// FullResyncInterval is how often routing configs are regenerated even if they aren't known to have changed
+		// (repairing changes made outside of webspaced, 0 disables this)
+		FullResyncInterval time.Duration `mapstructure:"full_resync_interval"`
+
+		// DomainVerification controls custom domains which can't be verified straight away (e.g. because DNS hasn't
+		// propagated yet)
+		DomainVerification struct {
+			// Timeout is how long a domain can stay pending before it's dropped (0 disables pending domains)
+			Timeout time.Duration
+			// CheckInterval is how often pending domains are checked (and the initial retry delay)
+			CheckInterval time.Duration `mapstructure:"check_interval"`
+			// MaxInterval caps the exponential backoff between checks of a domain
+			MaxInterval time.Duration `mapstructure:"max_interval"`
+			// MaxPending is the maximum number of pending domains a webspace can have
+			MaxPending uint16 `mapstructure:"max_pending"`
+		} `mapstructure:"domain_verification"`
 
 		Ports struct {
 			Start uint16
@@ -107,18 +174,52 @@ type Config struct {
 			Max   uint16
 
 			KubernetesService string `mapstructure:"kubernetes_service"`
+
+			TrafficFlushInterval time.Duration `mapstructure:"traffic_flush_interval"`
+			UDPSessionTimeout    time.Duration `mapstructure:"udp_session_timeout"`
+			// Grace period for established TCP connections to finish when a port forward is removed (or on shutdown), UDP
+			// sessions end straight away
+			DrainTimeout time.Duration `mapstructure:"drain_timeout"`
+
+			// Connection limits applied to each port forward (0 means no limit), port forwards can set lower limits
+			MaxConnections      int     `mapstructure:"max_connections"`
+			MaxConnectionsPerIP int     `mapstructure:"max_connections_per_ip"`
+			ConnectionRate      float64 `mapstructure:"connection_rate"`
+			ConnectionBurst     int     `mapstructure:"connection_burst"`
+		}
+
+		Limits struct {
+			Defaults ResourceLimits
+			Max      ResourceLimits
+		}
+
+		UsageHistory struct {
+			Interval time.Duration
+			Samples  int
+		} `mapstructure:"usage_history"`
+
+		Snapshots struct {
+			Max uint16
+
+			CheckInterval time.Duration `mapstructure:"check_interval"`
+			Daily         SnapshotPolicy
+			Weekly        SnapshotPolicy
 		}
 	}
 
 	HTTP struct {
 		ListenAddress string `mapstructure:"listen_address"`
+		// MetricsAddress is where Prometheus metrics are served (separately from the API so they aren't public), an
+		// empty address disables them
+		MetricsAddress string `mapstructure:"metrics_address"`
 
 		CORS struct {
 			AllowedOrigins []string `mapstructure:"allowed_origins"`
 		}
 	}
 
-	Traefik struct {
+	// Routing configures how HTTP(S) traffic is routed to webspaces (previously the `traefik` section)
+	Routing struct {
 		Provider string
 
 		Redis struct {
@@ -131,7 +232,44 @@ type Config struct {
 			DefaultSecret string `mapstructure:"default_secret"`
 			ClusterIssuer string `mapstructure:"cluster_issuer"`
 		}
+		File struct {
+			Directory    string
+			Format       string
+			CertResolver string `mapstructure:"cert_resolver"`
+		}
+		Caddy struct {
+			AdminURL string `mapstructure:"admin_url"`
+			Server   string
+		}
+		Builtin struct {
+			HTTPAddress   string `mapstructure:"http_address"`
+			HTTPSAddress  string `mapstructure:"https_address"`
+			CertFile      string `mapstructure:"cert_file"`
+			KeyFile       string `mapstructure:"key_file"`
+			RedirectHTTPS bool   `mapstructure:"redirect_https"`
+
+			ReadHeaderTimeout time.Duration `mapstructure:"read_header_timeout"`
+			// ReadTimeout limits reading an entire request (including the body), it doesn't apply to upgraded
+			// connections (e.g. WebSockets)
+			ReadTimeout time.Duration `mapstructure:"read_timeout"`
+			IdleTimeout time.Duration `mapstructure:"idle_timeout"`
+		}
+
+		// ACME is used to obtain certificates for webspaces' custom domains. Only the file and builtin providers
+		// support this, the other providers have their own mechanisms (cert_resolver for Redis, cert-manager for
+		// Kubernetes and automatic HTTPS for Caddy).
+		ACME struct {
+			DirectoryURL  string `mapstructure:"directory_url"`
+			Email         string
+			StorageDir    string        `mapstructure:"storage_dir"`
+			RenewBefore   time.Duration `mapstructure:"renew_before"`
+			CheckInterval time.Duration `mapstructure:"check_interval"`
+			// RetryBackoff is how long to wait before retrying after a failure (doubling for each consecutive
+			// failure)
+			RetryBackoff time.Duration `mapstructure:"retry_backoff"`
+		}
 
+		HTTPEntryPoint  string   `mapstructure:"http_entrypoint"`
 		HTTPSEntryPoint string   `mapstructure:"https_entrypoint"`
 		DefaultSANs     []string `mapstructure:"default_sans"`
 
@@ -196,7 +334,7 @@ func (c *Config) ReadSecrets() error {
 		}
 	}
 
-	if err := loadSecret(&c.Traefik, "IAMToken"); err != nil {
+	if err := loadSecret(&c.Routing, "IAMToken"); err != nil {
 		return err
 	}
 
@@ -0,0 +1,85 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "webspaced"
+
+// Webspace metrics are read from LXD when scraped (by a collector in the webspace package)
+var (
+	// Webspaces counts webspaces by LXD instance state
+	Webspaces = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "webspaces"),
+		"Number of webspaces by state.",
+		[]string{"state"}, nil,
+	)
+
+	// WebspaceCPU counts each webspace's total CPU time
+	WebspaceCPU = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "webspace", "cpu_seconds_total"),
+		"Total CPU time consumed by a running webspace.",
+		[]string{"user"}, nil,
+	)
+
+	// WebspaceMemory tracks each webspace's memory usage
+	WebspaceMemory = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "webspace", "memory_bytes"),
+		"Memory used by a running webspace.",
+		[]string{"user"}, nil,
+	)
+)
+
+var (
+	// LXDReconnects counts successful LXD event listener reconnects
+	LXDReconnects = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "lxd",
+		Name:      "listener_reconnects_total",
+		Help:      "Number of times the LXD event listener has been reconnected.",
+	})
+
+	// BootDuration tracks how long it takes to start a webspace on demand
+	BootDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "webspace",
+		Name:      "boot_duration_seconds",
+		Help:      "Time taken to boot a stopped webspace on demand.",
+		Buckets:   []float64{.5, 1, 2, 3, 5, 7.5, 10, 15, 20, 30, 60},
+	})
+
+	// PortForwardConnections counts connections handled by port forwards
+	PortForwardConnections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "port_forward",
+		Name:      "connections_total",
+		Help:      "Number of connections (or UDP sessions) accepted by a port forward.",
+	}, []string{"port", "protocol"})
+
+	// PortForwardRejected counts connections refused by port forward access control lists or connection limits
+	PortForwardRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "port_forward",
+		Name:      "rejected_connections_total",
+		Help: "Number of connections (or UDP sessions) rejected by a port forward, by reason (`acl` or the " +
+			"connection limit which was hit).",
+	}, []string{"port", "protocol", "reason"})
+
+	// PortForwardBytes counts bytes forwarded by port forwards
+	PortForwardBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "port_forward",
+		Name:      "bytes_total",
+		Help:      "Number of bytes forwarded by a port forward, by direction (`in` is towards the webspace).",
+	}, []string{"port", "protocol", "direction"})
+
+	// HTTPRequestDuration tracks API request latencies
+	HTTPRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "Time taken to handle HTTP requests.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "code"})
+)
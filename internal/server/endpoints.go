@@ -3,14 +3,19 @@ package server
 import (
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/http/httputil"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
 	iam "github.com/netsoc/iam/client"
 	"github.com/netsoc/webspaced/internal/webspace"
 	"github.com/netsoc/webspaced/pkg/util"
+	log "github.com/sirupsen/logrus"
 )
 
 var upgrader = websocket.Upgrader{}
@@ -25,6 +30,50 @@ func (s *Server) apiImages(w http.ResponseWriter, r *http.Request) {
 	util.JSONResponse(w, images, http.StatusOK)
 }
 
+func (s *Server) apiListWebspaces(w http.ResponseWriter, r *http.Request) {
+	var opts webspace.ListOptions
+	q := r.URL.Query()
+
+	switch q.Get("state") {
+	case "":
+	case "running":
+		running := true
+		opts.Running = &running
+	case "stopped":
+		running := false
+		opts.Running = &running
+	default:
+		util.JSONErrResponse(w, fmt.Errorf("%w (state must be one of running, stopped)", util.ErrBadQuery), 0)
+		return
+	}
+
+	var err error
+	if v := q.Get("offset"); v != "" {
+		if opts.Offset, err = strconv.Atoi(v); err != nil || opts.Offset < 0 {
+			util.JSONErrResponse(w, fmt.Errorf("%w (invalid offset)", util.ErrBadQuery), 0)
+			return
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if opts.Limit, err = strconv.Atoi(v); err != nil || opts.Limit < 0 {
+			util.JSONErrResponse(w, fmt.Errorf("%w (invalid limit)", util.ErrBadQuery), 0)
+			return
+		}
+	}
+
+	webspaces, total, err := s.Webspaces.List(r.Context(), opts)
+	if err != nil {
+		util.JSONErrResponse(w, err, 0)
+		return
+	}
+	if webspaces == nil {
+		webspaces = []webspace.Summary{}
+	}
+
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	util.JSONResponse(w, webspaces, http.StatusOK)
+}
+
 type createWebspaceReq struct {
 	Image    string `json:"image"`
 	Password string `json:"password"`
@@ -59,6 +108,40 @@ func (s *Server) apiCreateWebspace(w http.ResponseWriter, r *http.Request) {
 
 	util.JSONResponse(w, ws, http.StatusCreated)
 }
+func (s *Server) apiImportWebspace(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(keyUser).(*iam.User)
+
+	body := r.Body
+	if s.Config.Webspaces.MaxImportSize > 0 {
+		body = http.MaxBytesReader(w, r.Body, int64(s.Config.Webspaces.MaxImportSize))
+	}
+
+	ws, err := s.Webspaces.Import(r.Context(), int(user.Id), body)
+	if err != nil {
+		util.JSONErrResponse(w, err, 0)
+		return
+	}
+
+	util.JSONResponse(w, ws, http.StatusCreated)
+}
+func (s *Server) apiExportWebspace(w http.ResponseWriter, r *http.Request) {
+	ws := r.Context().Value(keyWebspace).(*webspace.Webspace)
+	user := r.Context().Value(keyUser).(*iam.User)
+
+	backup, size, err := ws.Export()
+	if err != nil {
+		util.JSONErrResponse(w, err, 0)
+		return
+	}
+	defer backup.Close()
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="webspace-%v.tar.gz"`, user.Username))
+	if _, err := io.Copy(w, backup); err != nil {
+		log.WithError(err).WithField("uid", user.Id).Warn("Failed to send webspace export")
+	}
+}
 func (s *Server) apiDeleteWebspace(w http.ResponseWriter, r *http.Request) {
 	ws := r.Context().Value(keyWebspace).(*webspace.Webspace)
 	if err := ws.Delete(); err != nil {
@@ -102,6 +185,22 @@ func (s *Server) apiGetWebspaceState(w http.ResponseWriter, r *http.Request) {
 	util.JSONResponse(w, state, http.StatusOK)
 }
 
+func (s *Server) apiGetWebspaceMetrics(w http.ResponseWriter, r *http.Request) {
+	ws := r.Context().Value(keyWebspace).(*webspace.Webspace)
+
+	var since time.Time
+	if v := r.URL.Query().Get("since"); v != "" {
+		if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+			since = time.Unix(secs, 0)
+		} else if since, err = time.Parse(time.RFC3339, v); err != nil {
+			util.JSONErrResponse(w, fmt.Errorf("%w (since must be a Unix timestamp or RFC 3339 date)", util.ErrBadQuery), 0)
+			return
+		}
+	}
+
+	util.JSONResponse(w, ws.UsageHistory(since), http.StatusOK)
+}
+
 func (s *Server) apiGetWebspaceConfig(w http.ResponseWriter, r *http.Request) {
 	ws := r.Context().Value(keyWebspace).(*webspace.Webspace)
 	util.JSONResponse(w, ws.Config, http.StatusOK)
@@ -110,10 +209,11 @@ func (s *Server) apiUpdateWebspaceConfig(w http.ResponseWriter, r *http.Request)
 	ws := r.Context().Value(keyWebspace).(*webspace.Webspace)
 	oldConf := ws.Config
 
-	if err := util.ParseJSONBody(&ws.Config, w, r); err != nil {
+	conf := ws.Config
+	if err := util.ParseJSONBody(&conf, w, r); err != nil {
 		return
 	}
-	if err := ws.Save(); err != nil {
+	if err := ws.SetConfig(conf); err != nil {
 		util.JSONErrResponse(w, err, 0)
 		return
 	}
@@ -121,6 +221,26 @@ func (s *Server) apiUpdateWebspaceConfig(w http.ResponseWriter, r *http.Request)
 	util.JSONResponse(w, oldConf, http.StatusOK)
 }
 
+func (s *Server) apiGetWebspaceLimits(w http.ResponseWriter, r *http.Request) {
+	ws := r.Context().Value(keyWebspace).(*webspace.Webspace)
+	util.JSONResponse(w, ws.EffectiveLimits(), http.StatusOK)
+}
+func (s *Server) apiUpdateWebspaceLimits(w http.ResponseWriter, r *http.Request) {
+	ws := r.Context().Value(keyWebspace).(*webspace.Webspace)
+	oldLimits := ws.Limits
+
+	limits := ws.Limits
+	if err := util.ParseJSONBody(&limits, w, r); err != nil {
+		return
+	}
+	if err := ws.SetLimits(limits); err != nil {
+		util.JSONErrResponse(w, err, 0)
+		return
+	}
+
+	util.JSONResponse(w, oldLimits, http.StatusOK)
+}
+
 func (s *Server) apiGetWebspaceDomains(w http.ResponseWriter, r *http.Request) {
 	ws := r.Context().Value(keyWebspace).(*webspace.Webspace)
 	domains, err := ws.GetDomains(r.Context())
@@ -131,14 +251,24 @@ func (s *Server) apiGetWebspaceDomains(w http.ResponseWriter, r *http.Request) {
 
 	util.JSONResponse(w, domains, http.StatusOK)
 }
+func (s *Server) apiGetWebspacePendingDomains(w http.ResponseWriter, r *http.Request) {
+	ws := r.Context().Value(keyWebspace).(*webspace.Webspace)
+
+	pending := ws.PendingDomains
+	if pending == nil {
+		pending = map[string]*webspace.PendingDomain{}
+	}
+	util.JSONResponse(w, pending, http.StatusOK)
+}
 func (s *Server) apiWebspaceDomain(w http.ResponseWriter, r *http.Request) {
 	ws := r.Context().Value(keyWebspace).(*webspace.Webspace)
 	d := mux.Vars(r)["domain"]
 
 	var err error
+	var pending bool
 	switch r.Method {
 	case "POST":
-		err = ws.AddDomain(d)
+		pending, err = ws.AddDomain(d)
 	case "DELETE":
 		err = ws.RemoveDomain(r.Context(), d)
 	}
@@ -147,17 +277,97 @@ func (s *Server) apiWebspaceDomain(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if pending {
+		// Domain will be activated once it's verified
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
 	w.WriteHeader(http.StatusNoContent)
 }
 
+func (s *Server) apiGetWebspaceDomainStatus(w http.ResponseWriter, r *http.Request) {
+	ws := r.Context().Value(keyWebspace).(*webspace.Webspace)
+
+	status, err := ws.DomainStatus(r.Context(), mux.Vars(r)["domain"])
+	if err != nil {
+		util.JSONErrResponse(w, err, 0)
+		return
+	}
+
+	util.JSONResponse(w, status, http.StatusOK)
+}
+
 type addImplicitPortRes struct {
 	EPort uint16 `json:"ePort"`
 }
 
 func (s *Server) apiGetWebspacePorts(w http.ResponseWriter, r *http.Request) {
 	ws := r.Context().Value(keyWebspace).(*webspace.Webspace)
+
+	ports := make(map[uint16]uint16, len(ws.Ports))
+	for e, m := range ws.Ports {
+		ports[e] = m.Port
+	}
+	util.JSONResponse(w, ports, http.StatusOK)
+}
+func (s *Server) apiGetWebspacePortMappings(w http.ResponseWriter, r *http.Request) {
+	ws := r.Context().Value(keyWebspace).(*webspace.Webspace)
 	util.JSONResponse(w, ws.Ports, http.StatusOK)
 }
+func (s *Server) apiGetWebspacePortsTraffic(w http.ResponseWriter, r *http.Request) {
+	ws := r.Context().Value(keyWebspace).(*webspace.Webspace)
+	util.JSONResponse(w, ws.Traffic(), http.StatusOK)
+}
+
+// parseProxyProtocolQuery sets a port mapping's PROXY protocol version from the `proxyProtocol` query parameter (if
+// present)
+func parseProxyProtocolQuery(r *http.Request, m *webspace.PortMapping) error {
+	v := r.URL.Query().Get("proxyProtocol")
+	if v == "" {
+		return nil
+	}
+
+	p, err := strconv.ParseUint(v, 10, 8)
+	if err != nil {
+		return fmt.Errorf("%w (proxyProtocol)", util.ErrBadQuery)
+	}
+
+	m.ProxyProtocol = uint8(p)
+	return nil
+}
+func (s *Server) apiUpdateWebspacePort(w http.ResponseWriter, r *http.Request) {
+	e, err := strconv.ParseUint(mux.Vars(r)["ePort"], 10, 16)
+	if err != nil {
+		util.JSONErrResponse(w, util.ErrBadPort, http.StatusBadRequest)
+		return
+	}
+	external := uint16(e)
+
+	ws := r.Context().Value(keyWebspace).(*webspace.Webspace)
+	old, ok := ws.Ports[external]
+	if !ok {
+		util.JSONErrResponse(w, util.ErrGenericNotFound, 0)
+		return
+	}
+
+	mapping := old
+	// Don't let the JSON decoder overwrite the old lists in place
+	mapping.Allow = append([]string(nil), old.Allow...)
+	mapping.Deny = append([]string(nil), old.Deny...)
+	if err := util.ParseJSONBody(&mapping, w, r); err != nil {
+		return
+	}
+	if err := parseProxyProtocolQuery(r, &mapping); err != nil {
+		util.JSONErrResponse(w, err, http.StatusBadRequest)
+		return
+	}
+	if err := ws.UpdatePort(external, mapping); err != nil {
+		util.JSONErrResponse(w, err, 0)
+		return
+	}
+
+	util.JSONResponse(w, old, http.StatusOK)
+}
 func (s *Server) apiWebspacePorts(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	explicit := false
@@ -195,7 +405,19 @@ func (s *Server) apiWebspacePorts(w http.ResponseWriter, r *http.Request) {
 	ws := r.Context().Value(keyWebspace).(*webspace.Webspace)
 	switch r.Method {
 	case "POST":
-		external, err = ws.AddPort(external, internal)
+		mapping := webspace.PortMapping{
+			Port:     internal,
+			Protocol: r.URL.Query().Get("protocol"),
+		}
+		if mapping.Protocol == "" {
+			mapping.Protocol = webspace.ProtocolTCP
+		}
+		if err := parseProxyProtocolQuery(r, &mapping); err != nil {
+			util.JSONErrResponse(w, err, http.StatusBadRequest)
+			return
+		}
+
+		external, err = ws.AddPort(external, mapping)
 		if err != nil {
 			util.JSONErrResponse(w, err, 0)
 			return
@@ -217,6 +439,39 @@ func (s *Server) apiWebspacePorts(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (s *Server) apiGetWebspaceSnapshots(w http.ResponseWriter, r *http.Request) {
+	ws := r.Context().Value(keyWebspace).(*webspace.Webspace)
+	snapshots, err := ws.Snapshots()
+	if err != nil {
+		util.JSONErrResponse(w, err, 0)
+		return
+	}
+
+	util.JSONResponse(w, snapshots, http.StatusOK)
+}
+func (s *Server) apiWebspaceSnapshot(w http.ResponseWriter, r *http.Request) {
+	ws := r.Context().Value(keyWebspace).(*webspace.Webspace)
+	name := mux.Vars(r)["snapshot"]
+
+	var err error
+	status := http.StatusNoContent
+	switch r.Method {
+	case "POST":
+		err = ws.CreateSnapshot(name)
+		status = http.StatusCreated
+	case "PUT":
+		err = ws.RestoreSnapshot(name)
+	case "DELETE":
+		err = ws.DeleteSnapshot(name)
+	}
+	if err != nil {
+		util.JSONErrResponse(w, err, 0)
+		return
+	}
+
+	w.WriteHeader(status)
+}
+
 func (s *Server) apiConsoleLog(w http.ResponseWriter, r *http.Request) {
 	ws := r.Context().Value(keyWebspace).(*webspace.Webspace)
 
@@ -252,3 +507,40 @@ func (s *Server) internalAPIEnsureStarted(w http.ResponseWriter, r *http.Request
 
 	fmt.Fprint(w, ip)
 }
+
+// internalAPIProxy ensures a webspace is started and then passes the request on to it (used to boot webspaces on
+// demand by reverse proxies without a native hook, e.g. Caddy)
+func (s *Server) internalAPIProxy(w http.ResponseWriter, r *http.Request) {
+	ws := r.Context().Value(keyWebspace).(*webspace.Webspace)
+	ip, err := ws.EnsureStarted()
+	if err != nil {
+		util.JSONErrResponse(w, err, 0)
+		return
+	}
+
+	// Path is /internal/{username}/proxy/...
+	path := "/"
+	if parts := strings.SplitN(r.URL.Path, "/", 5); len(parts) == 5 {
+		path += parts[4]
+	}
+
+	proxy := httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			r.URL.Scheme = "http"
+			r.URL.Host = net.JoinHostPort(ip, strconv.Itoa(int(ws.Config.HTTPPort)))
+			r.URL.Path = path
+			r.URL.RawPath = ""
+
+			// Restore the client's original Host and credentials
+			if h := r.Header.Get(webspace.CaddyForwardedHostHeader); h != "" {
+				r.Host = h
+			}
+			r.Header.Del("Authorization")
+			if a := r.Header.Get(webspace.CaddyForwardedAuthHeader); a != "" {
+				r.Header.Set("Authorization", a)
+			}
+			r.Header.Del(webspace.CaddyForwardedAuthHeader)
+		},
+	}
+	proxy.ServeHTTP(w, r)
+}
@@ -5,11 +5,14 @@ import (
 	"io"
 	"net/http"
 	"regexp"
+	"strconv"
+	"time"
 
 	"github.com/dgrijalva/jwt-go/v4"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	iam "github.com/netsoc/iam/client"
+	"github.com/netsoc/webspaced/internal/metrics"
 	"github.com/netsoc/webspaced/pkg/util"
 	log "github.com/sirupsen/logrus"
 )
@@ -63,8 +66,12 @@ func writeAccessLog(w io.Writer, params handlers.LogFormatterParams) {
 		uid = c.(*UserClaims).Subject
 	}
 
+	metrics.HTTPRequestDuration.
+		WithLabelValues(params.Request.Method, strconv.Itoa(params.StatusCode)).
+		Observe(time.Since(params.TimeStamp).Seconds())
+
 	level := log.DebugLevel
-	if params.URL.Path == "/health" {
+	if params.URL.Path == "/health" || params.URL.Path == "/metrics" {
 		level = log.TraceLevel
 	}
 	log.StandardLogger().
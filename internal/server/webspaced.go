@@ -5,6 +5,7 @@ import (
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 
 	oapiMiddleware "github.com/go-openapi/runtime/middleware"
@@ -12,6 +13,7 @@ import (
 	"github.com/gorilla/mux"
 	lxd "github.com/lxc/lxd/client"
 	iam "github.com/netsoc/iam/client"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/cors"
 	log "github.com/sirupsen/logrus"
 
@@ -26,9 +28,11 @@ type Server struct {
 	Config    config.Config
 	Webspaces *webspace.Manager
 
-	iam  *iam.APIClient
-	lxd  lxd.InstanceServer
-	http *http.Server
+	iam     *iam.APIClient
+	lxd     lxd.InstanceServer
+	http    *http.Server
+	metrics *http.Server
+	handoff *webspace.Handoff
 }
 
 // NewServer returns an initialized Server
@@ -44,6 +48,7 @@ func NewServer(config config.Config) *Server {
 			http.MethodDelete,
 		},
 		AllowedHeaders:   []string{"*"},
+		ExposedHeaders:   []string{"X-Total-Count"},
 		AllowCredentials: true,
 	})
 
@@ -71,31 +76,57 @@ func NewServer(config config.Config) *Server {
 		iam:  iam.NewAPIClient(cfg),
 		http: httpSrv,
 	}
+	if config.HTTP.MetricsAddress != "" {
+		s.metrics = &http.Server{
+			Addr:    config.HTTP.MetricsAddress,
+			Handler: promhttp.Handler(),
+		}
+	}
 
 	r.HandleFunc("/v1/images", s.apiImages).Methods("GET")
 
 	authM := authMiddleware{IAM: s.iam}
+	adminAuthM := authMiddleware{IAM: s.iam, NeedAdmin: true}
+
+	adminRouter := r.PathPrefix("/v1/webspaces").Subrouter()
+	adminRouter.Use(adminAuthM.Middleware)
+	adminRouter.HandleFunc("", s.apiListWebspaces).Methods("GET")
+
 	wsRouter := r.PathPrefix("/v1/webspace/{username}").Subrouter()
 	wsRouter.Use(authM.Middleware)
 	wsRouter.HandleFunc("", s.apiCreateWebspace).Methods("POST")
+	wsRouter.HandleFunc("/import", s.apiImportWebspace).Methods("POST")
 
 	wsOpRouter := wsRouter.NewRoute().Subrouter()
 	wsOpRouter.Use(s.getWebspaceMiddleware)
 	wsOpRouter.HandleFunc("", s.apiGetWebspace).Methods("GET")
 	wsOpRouter.HandleFunc("", s.apiDeleteWebspace).Methods("DELETE")
+	wsOpRouter.HandleFunc("/export", s.apiExportWebspace).Methods("GET")
 
 	wsOpRouter.HandleFunc("/state", s.apiGetWebspaceState).Methods("GET")
 	wsOpRouter.HandleFunc("/state", s.apiSetWebspaceState).Methods("POST", "PATCH", "PUT", "DELETE")
+	wsOpRouter.HandleFunc("/metrics", s.apiGetWebspaceMetrics).Methods("GET")
 
 	wsOpRouter.HandleFunc("/config", s.apiGetWebspaceConfig).Methods("GET")
 	wsOpRouter.HandleFunc("/config", s.apiUpdateWebspaceConfig).Methods("PATCH")
 
+	wsOpRouter.HandleFunc("/limits", s.apiGetWebspaceLimits).Methods("GET")
+	wsOpRouter.Handle("/limits", adminAuthM.Middleware(http.HandlerFunc(s.apiUpdateWebspaceLimits))).Methods("PATCH")
+
 	wsOpRouter.HandleFunc("/domains", s.apiGetWebspaceDomains).Methods("GET")
+	wsOpRouter.HandleFunc("/domains/pending", s.apiGetWebspacePendingDomains).Methods("GET")
 	wsOpRouter.HandleFunc("/domains/{domain}", s.apiWebspaceDomain).Methods("POST", "DELETE")
+	wsOpRouter.HandleFunc("/domains/{domain}/status", s.apiGetWebspaceDomainStatus).Methods("GET")
 
 	wsOpRouter.HandleFunc("/ports", s.apiGetWebspacePorts).Methods("GET")
+	wsOpRouter.HandleFunc("/ports/mappings", s.apiGetWebspacePortMappings).Methods("GET")
+	wsOpRouter.HandleFunc("/ports/traffic", s.apiGetWebspacePortsTraffic).Methods("GET")
 	wsOpRouter.HandleFunc("/ports/{ePort}/{iPort}", s.apiWebspacePorts).Methods("POST")
 	wsOpRouter.HandleFunc("/ports/{port}", s.apiWebspacePorts).Methods("POST", "DELETE")
+	wsOpRouter.HandleFunc("/ports/{ePort}", s.apiUpdateWebspacePort).Methods("PATCH")
+
+	wsOpRouter.HandleFunc("/snapshots", s.apiGetWebspaceSnapshots).Methods("GET")
+	wsOpRouter.HandleFunc("/snapshots/{snapshot}", s.apiWebspaceSnapshot).Methods("POST", "PUT", "DELETE")
 
 	wsOpRouter.HandleFunc("/log", s.apiConsoleLog).Methods("GET")
 	wsOpRouter.HandleFunc("/log", s.apiClearConsoleLog).Methods("DELETE")
@@ -103,10 +134,10 @@ func NewServer(config config.Config) *Server {
 	wsOpRouter.HandleFunc("/exec", s.apiExec).Methods("POST")
 	wsOpRouter.HandleFunc("/exec", s.apiExecInteractive).Methods("GET")
 
-	adminAuthM := authMiddleware{IAM: s.iam, NeedAdmin: true}
 	internalWsOpRouter := r.PathPrefix("/internal/{username}").Subrouter()
 	internalWsOpRouter.Use(adminAuthM.Middleware, s.getWebspaceMiddleware)
 	internalWsOpRouter.HandleFunc("/ensure-started", s.internalAPIEnsureStarted).Methods("POST")
+	internalWsOpRouter.PathPrefix("/proxy").HandlerFunc(s.internalAPIProxy)
 
 	r.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(data.AssetFile())))
 	r.PathPrefix("/swagger").Handler(oapiMiddleware.SwaggerUI(oapiMiddleware.SwaggerUIOpts{
@@ -114,6 +145,7 @@ func NewServer(config config.Config) *Server {
 		Path:    "swagger",
 	}, nil))
 
+	r.PathPrefix("/.well-known/acme-challenge/").HandlerFunc(s.acmeChallenge)
 	r.HandleFunc("/health", s.healthCheck)
 
 	r.NotFoundHandler = http.HandlerFunc(apiNotFound)
@@ -124,6 +156,9 @@ func NewServer(config config.Config) *Server {
 
 // Start begins listening
 func (s *Server) Start(ctx context.Context) error {
+	handoff := s.handoff
+	s.handoff = nil
+
 	var err error
 	s.lxd, err = lxd.ConnectLXD(s.Config.LXD.URL, &lxd.ConnectionArgs{
 		TLSCA:              s.Config.LXD.TLS.CA,
@@ -133,29 +168,62 @@ func (s *Server) Start(ctx context.Context) error {
 		InsecureSkipVerify: s.Config.LXD.TLS.AllowInsecure,
 	})
 	if err != nil {
+		handoff.Stop()
 		return fmt.Errorf("failed to connect to LXD: %w", err)
 	}
 
 	s.Webspaces, err = webspace.NewManager(&s.Config, s.iam, s.lxd)
 	if err != nil {
+		handoff.Stop()
 		return fmt.Errorf("failed to create webspace manager: %w", err)
 	}
+	// From here on the manager owns the handed off port forwards
+	s.Webspaces.Adopt(handoff)
+
 	if err := s.Webspaces.Start(ctx); err != nil {
+		s.abort()
 		return fmt.Errorf("failed to start webspace manager: %w", err)
 	}
 	log.Info("Webspace manager startup completed")
 
+	if s.metrics != nil {
+		l, err := net.Listen("tcp", s.metrics.Addr)
+		if err != nil {
+			s.abort()
+			return fmt.Errorf("failed to listen for metrics: %w", err)
+		}
+
+		go func() {
+			if err := s.metrics.Serve(l); !errors.Is(err, http.ErrServerClosed) {
+				log.WithError(err).Error("Metrics server failed")
+			}
+		}()
+	}
+
 	if err := s.http.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		if s.metrics != nil {
+			s.metrics.Close()
+		}
+		s.abort()
 		return fmt.Errorf("failed to start HTTP server: %w", err)
 	}
 
 	return nil
 }
 
+// abort shuts down the webspace manager after a failed start, so its port forwards (including adopted ones) aren't
+// left running
+func (s *Server) abort() {
+	ctx, cancel := context.WithTimeout(context.Background(), s.Config.Timeouts.Shutdown)
+	defer cancel()
+
+	s.Webspaces.Shutdown(ctx)
+}
+
 // Stop shuts down the server and listener
 func (s *Server) Stop(ctx context.Context) error {
-	if err := s.http.Shutdown(ctx); err != nil {
-		return fmt.Errorf("failed to stop HTTP server: %w", err)
+	if err := s.shutdownHTTP(ctx); err != nil {
+		return err
 	}
 
 	s.Webspaces.Shutdown(ctx)
@@ -165,6 +233,38 @@ func (s *Server) Stop(ctx context.Context) error {
 	return nil
 }
 
+// Handoff shuts down the server, leaving port forwards running (and keeping usage history) to be passed on to a new
+// server (e.g. after reloading the config)
+func (s *Server) Handoff(ctx context.Context) (*webspace.Handoff, error) {
+	if err := s.shutdownHTTP(ctx); err != nil {
+		return nil, err
+	}
+
+	h := s.Webspaces.Handoff(ctx)
+
+	s.lxd.Disconnect()
+
+	return h, nil
+}
+
+func (s *Server) shutdownHTTP(ctx context.Context) error {
+	if err := s.http.Shutdown(ctx); err != nil {
+		return fmt.Errorf("failed to stop HTTP server: %w", err)
+	}
+	if s.metrics != nil {
+		if err := s.metrics.Shutdown(ctx); err != nil {
+			return fmt.Errorf("failed to stop metrics server: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Adopt sets state handed off from a previous server to be taken over on startup
+func (s *Server) Adopt(h *webspace.Handoff) {
+	s.handoff = h
+}
+
 func apiNotFound(w http.ResponseWriter, r *http.Request) {
 	util.JSONErrResponse(w, util.ErrNotFound, http.StatusNotFound)
 }
@@ -173,6 +273,10 @@ func apiMethodNotAllowed(w http.ResponseWriter, r *http.Request) {
 	util.JSONErrResponse(w, util.ErrMethodNotAllowed, http.StatusMethodNotAllowed)
 }
 
+func (s *Server) acmeChallenge(w http.ResponseWriter, r *http.Request) {
+	s.Webspaces.ACMEChallenge(w, r)
+}
+
 func (s *Server) healthCheck(w http.ResponseWriter, r *http.Request) {
 	if !s.Webspaces.Healthy() {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -0,0 +1,79 @@
+package webspace
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// maxPortACLEntries is the maximum number of entries in a port forward's allow or deny list
+const maxPortACLEntries = 64
+
+// portACL is a port forward's parsed source address allow and deny lists
+type portACL struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+func parseCIDRs(list []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			// Plain IP address
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", s)
+			}
+
+			if ip4 := ip.To4(); ip4 != nil {
+				nets = append(nets, &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)})
+			} else {
+				nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)})
+			}
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", s)
+		}
+		nets = append(nets, n)
+	}
+
+	return nets, nil
+}
+
+func parsePortACL(allow, deny []string) (*portACL, error) {
+	var err error
+	a := &portACL{}
+	if a.allow, err = parseCIDRs(allow); err != nil {
+		return nil, err
+	}
+	if a.deny, err = parseCIDRs(deny); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// permits returns true if a client with the given address is allowed to connect (deny entries take precedence)
+func (a *portACL) permits(ip net.IP) bool {
+	if a == nil {
+		return true
+	}
+	if containsIP(a.deny, ip) {
+		return false
+	}
+
+	return len(a.allow) == 0 || containsIP(a.allow, ip)
+}
@@ -0,0 +1,594 @@
+package webspace
+
+import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/go-acme/lego/v4/certificate"
+	"github.com/go-acme/lego/v4/challenge/http01"
+	"github.com/go-acme/lego/v4/lego"
+	"github.com/go-acme/lego/v4/registration"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/netsoc/webspaced/internal/config"
+)
+
+// certificateConsumer is implemented by routing providers which can serve certificates obtained via ACME
+type certificateConsumer interface {
+	useCertificates(s *certStore)
+}
+
+// acmeCert is a certificate obtained for a webspace's custom domains
+type acmeCert struct {
+	Domains   []string  `json:"domains"`
+	NotBefore time.Time `json:"notBefore"`
+	NotAfter  time.Time `json:"notAfter"`
+
+	certFile string
+	keyFile  string
+	cert     *tls.Certificate
+}
+
+// certStore holds certificates obtained via ACME (on disk and in memory) and pending HTTP-01 challenge responses
+type certStore struct {
+	dir string
+
+	mu    sync.RWMutex
+	certs map[string]*acmeCert
+	hosts map[string]*acmeCert
+
+	challenges sync.Map
+}
+
+func newCertStore(dir string) (*certStore, error) {
+	s := &certStore{
+		dir: dir,
+
+		certs: map[string]*acmeCert{},
+		hosts: map[string]*acmeCert{},
+	}
+	if err := os.MkdirAll(s.certDir(), 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create certificate directory: %w", err)
+	}
+
+	files, err := ioutil.ReadDir(s.certDir())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list certificate directory: %w", err)
+	}
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+
+		n := strings.TrimSuffix(f.Name(), ".json")
+		if err := s.load(n); err != nil {
+			log.WithField("instance", n).WithError(err).Warn("Failed to load stored certificate")
+		}
+	}
+
+	return s, nil
+}
+
+func (s *certStore) certDir() string {
+	return filepath.Join(s.dir, "certificates")
+}
+
+func (s *certStore) paths(n string) (string, string, string) {
+	base := filepath.Join(s.certDir(), n)
+	return base + ".json", base + ".crt", base + ".key"
+}
+
+func (s *certStore) load(n string) error {
+	metaFile, certFile, keyFile := s.paths(n)
+
+	data, err := ioutil.ReadFile(metaFile)
+	if err != nil {
+		return fmt.Errorf("failed to read certificate metadata: %w", err)
+	}
+
+	c := &acmeCert{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := json.Unmarshal(data, c); err != nil {
+		return fmt.Errorf("failed to decode certificate metadata: %w", err)
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate: %w", err)
+	}
+	c.cert = &cert
+
+	s.set(n, c)
+	return nil
+}
+
+func (s *certStore) set(n string, c *acmeCert) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.clear(n)
+	s.certs[n] = c
+	for _, d := range c.Domains {
+		s.hosts[strings.ToLower(d)] = c
+	}
+}
+
+func (s *certStore) clear(n string) {
+	if old, ok := s.certs[n]; ok {
+		for _, d := range old.Domains {
+			delete(s.hosts, strings.ToLower(d))
+		}
+	}
+	delete(s.certs, n)
+}
+
+// store saves a newly obtained certificate
+func (s *certStore) store(n string, res *certificate.Resource, domains []string) error {
+	x509Cert, err := certcrypto.ParsePEMCertificate(res.Certificate)
+	if err != nil {
+		return fmt.Errorf("failed to parse certificate: %w", err)
+	}
+
+	cert, err := tls.X509KeyPair(res.Certificate, res.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate: %w", err)
+	}
+
+	metaFile, certFile, keyFile := s.paths(n)
+	c := &acmeCert{
+		Domains:   domains,
+		NotBefore: x509Cert.NotBefore,
+		NotAfter:  x509Cert.NotAfter,
+
+		certFile: certFile,
+		keyFile:  keyFile,
+		cert:     &cert,
+	}
+
+	meta, err := json.Marshal(c)
+	if err != nil {
+		return fmt.Errorf("failed to encode certificate metadata: %w", err)
+	}
+	if err := ioutil.WriteFile(keyFile, res.PrivateKey, 0o600); err != nil {
+		return fmt.Errorf("failed to write certificate key: %w", err)
+	}
+	if err := ioutil.WriteFile(certFile, res.Certificate, 0o644); err != nil {
+		return fmt.Errorf("failed to write certificate: %w", err)
+	}
+	if err := ioutil.WriteFile(metaFile, meta, 0o644); err != nil {
+		return fmt.Errorf("failed to write certificate metadata: %w", err)
+	}
+
+	s.set(n, c)
+	return nil
+}
+
+// remove deletes the certificate for an instance
+func (s *certStore) remove(n string) error {
+	s.mu.Lock()
+	s.clear(n)
+	s.mu.Unlock()
+
+	metaFile, certFile, keyFile := s.paths(n)
+	for _, f := range []string{metaFile, certFile, keyFile} {
+		if err := os.Remove(f); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove certificate file: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// get returns the certificate for an instance (nil if there isn't one)
+func (s *certStore) get(n string) *acmeCert {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.certs[n]
+}
+
+// instances returns the names of all instances with a certificate
+func (s *certStore) instances() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	names := make([]string, 0, len(s.certs))
+	for n := range s.certs {
+		names = append(names, n)
+	}
+
+	return names
+}
+
+// forHost returns the certificate covering a host name (nil if there isn't one)
+func (s *certStore) forHost(host string) *tls.Certificate {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if c, ok := s.hosts[strings.ToLower(host)]; ok {
+		return c.cert
+	}
+
+	return nil
+}
+
+// Present makes an HTTP-01 challenge response available
+func (s *certStore) Present(domain, token, keyAuth string) error {
+	s.challenges.Store(token, keyAuth)
+	return nil
+}
+
+// CleanUp removes an HTTP-01 challenge response
+func (s *certStore) CleanUp(domain, token, keyAuth string) error {
+	s.challenges.Delete(token)
+	return nil
+}
+
+// isChallenge returns true if a request is for an HTTP-01 challenge response
+func isChallenge(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, http01.ChallengePath(""))
+}
+
+// ServeHTTP responds to HTTP-01 challenge requests
+func (s *certStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.URL.Path, http01.ChallengePath(""))
+	keyAuth, ok := s.challenges.Load(token)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(keyAuth.(string)))
+}
+
+// acmeUser is the ACME account webspaced uses
+type acmeUser struct {
+	email        string
+	registration *registration.Resource
+	key          crypto.PrivateKey
+}
+
+func (u *acmeUser) GetEmail() string {
+	return u.email
+}
+func (u *acmeUser) GetRegistration() *registration.Resource {
+	return u.registration
+}
+func (u *acmeUser) GetPrivateKey() crypto.PrivateKey {
+	return u.key
+}
+
+// acmeMaxBackoff caps the delay between attempts to obtain a certificate which keeps failing
+const acmeMaxBackoff = 24 * time.Hour
+
+// acmeFailure is a failed attempt to obtain a certificate
+type acmeFailure struct {
+	err     error
+	at      time.Time
+	domains []string
+	// attempts is the number of consecutive failures for the same domains
+	attempts int
+}
+
+// backoff returns how long to wait after the failure before trying again
+func (f *acmeFailure) backoff(base time.Duration) time.Duration {
+	d := base
+	for i := 1; i < f.attempts && d < acmeMaxBackoff; i++ {
+		d *= 2
+	}
+	if d > acmeMaxBackoff {
+		d = acmeMaxBackoff
+	}
+
+	return d
+}
+
+// acmeManager obtains and renews certificates for webspaces' custom domains
+type acmeManager struct {
+	config *config.Config
+	store  *certStore
+	client *lego.Client
+
+	failuresMu sync.Mutex
+	// failures holds the last failed attempt to obtain a certificate for each instance
+	failures map[string]*acmeFailure
+
+	check chan struct{}
+}
+
+func newACMEManager(cfg *config.Config) (*acmeManager, error) {
+	store, err := newCertStore(cfg.Routing.ACME.StorageDir)
+	if err != nil {
+		return nil, err
+	}
+
+	return &acmeManager{
+		config: cfg,
+		store:  store,
+
+		failures: map[string]*acmeFailure{},
+
+		check: make(chan struct{}, 1),
+	}, nil
+}
+
+// setupClient creates the ACME client, registering a new account if necessary
+func (a *acmeManager) setupClient() error {
+	keyFile := filepath.Join(a.config.Routing.ACME.StorageDir, "account.key")
+
+	var key crypto.PrivateKey
+	existing := true
+	data, err := ioutil.ReadFile(keyFile)
+	switch {
+	case err == nil:
+		if key, err = certcrypto.ParsePEMPrivateKey(data); err != nil {
+			return fmt.Errorf("failed to parse ACME account key: %w", err)
+		}
+	case errors.Is(err, os.ErrNotExist):
+		existing = false
+		if key, err = certcrypto.GeneratePrivateKey(certcrypto.EC256); err != nil {
+			return fmt.Errorf("failed to generate ACME account key: %w", err)
+		}
+		if err := ioutil.WriteFile(keyFile, certcrypto.PEMEncode(key), 0o600); err != nil {
+			return fmt.Errorf("failed to write ACME account key: %w", err)
+		}
+	default:
+		return fmt.Errorf("failed to read ACME account key: %w", err)
+	}
+
+	user := &acmeUser{
+		email: a.config.Routing.ACME.Email,
+		key:   key,
+	}
+
+	legoConfig := lego.NewConfig(user)
+	legoConfig.CADirURL = a.config.Routing.ACME.DirectoryURL
+	legoConfig.Certificate.KeyType = certcrypto.EC256
+
+	client, err := lego.NewClient(legoConfig)
+	if err != nil {
+		return fmt.Errorf("failed to create ACME client: %w", err)
+	}
+	if err := client.Challenge.SetHTTP01Provider(a.store); err != nil {
+		return fmt.Errorf("failed to set up HTTP-01 challenge provider: %w", err)
+	}
+
+	if existing {
+		user.registration, err = client.Registration.ResolveAccountByKey()
+	} else {
+		user.registration, err = client.Registration.Register(registration.RegisterOptions{
+			TermsOfServiceAgreed: true,
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("failed to set up ACME account: %w", err)
+	}
+
+	a.client = client
+	return nil
+}
+
+// renewBefore returns how long before expiry a certificate should be renewed. Certificates with a lifetime shorter
+// than the configured duration are renewed once two thirds of their lifetime has passed (otherwise they'd be renewed
+// on every check).
+func (a *acmeManager) renewBefore(c *acmeCert) time.Duration {
+	d := a.config.Routing.ACME.RenewBefore
+	if !c.NotBefore.IsZero() {
+		if third := c.NotAfter.Sub(c.NotBefore) / 3; third < d {
+			d = third
+		}
+	}
+
+	return d
+}
+
+// needsCertificate returns true if a new certificate should be obtained for the given domains
+func (a *acmeManager) needsCertificate(n string, domains []string) bool {
+	c := a.store.get(n)
+	return c == nil || !reflect.DeepEqual(c.Domains, domains) || time.Until(c.NotAfter) < a.renewBefore(c)
+}
+
+func (a *acmeManager) obtain(n string, domains []string) error {
+	if a.client == nil {
+		if err := a.setupClient(); err != nil {
+			return err
+		}
+	}
+
+	res, err := a.client.Certificate.Obtain(certificate.ObtainRequest{
+		Domains: domains,
+		Bundle:  true,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to obtain certificate: %w", err)
+	}
+
+	return a.store.store(n, res, domains)
+}
+
+// setFailure records the result of an attempt to obtain a certificate for the given domains (clearing any previous
+// failure if err is nil)
+func (a *acmeManager) setFailure(n string, domains []string, err error) {
+	a.failuresMu.Lock()
+	defer a.failuresMu.Unlock()
+
+	if err == nil {
+		delete(a.failures, n)
+		return
+	}
+
+	f := &acmeFailure{
+		err:      err,
+		at:       time.Now(),
+		domains:  domains,
+		attempts: 1,
+	}
+	if old, ok := a.failures[n]; ok && reflect.DeepEqual(old.domains, domains) {
+		f.attempts = old.attempts + 1
+	}
+	a.failures[n] = f
+}
+
+// failure returns the error from the last failed attempt to obtain a certificate for an instance (if any)
+func (a *acmeManager) failure(n string) error {
+	a.failuresMu.Lock()
+	defer a.failuresMu.Unlock()
+
+	if f, ok := a.failures[n]; ok {
+		return f.err
+	}
+
+	return nil
+}
+
+// backingOff returns true if the last attempt to obtain a certificate for the same domains failed too recently to try
+// again
+func (a *acmeManager) backingOff(n string, domains []string) bool {
+	a.failuresMu.Lock()
+	defer a.failuresMu.Unlock()
+
+	f, ok := a.failures[n]
+	if !ok || !reflect.DeepEqual(f.domains, domains) {
+		return false
+	}
+
+	return time.Since(f.at) < f.backoff(a.config.Routing.ACME.RetryBackoff)
+}
+
+// requestCertificates triggers a certificate check (if ACME is enabled)
+func (m *Manager) requestCertificates() {
+	if m.acme == nil {
+		return
+	}
+
+	select {
+	case m.acme.check <- struct{}{}:
+	default:
+	}
+}
+
+// ACMEChallenge responds to an HTTP-01 challenge request (for routing providers which forward them to webspaced)
+func (m *Manager) ACMEChallenge(w http.ResponseWriter, r *http.Request) {
+	if m.acme == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	m.acme.store.ServeHTTP(w, r)
+}
+
+// checkCertificates obtains any missing certificates, renews those which are close to expiry and removes those which
+// are no longer needed
+func (m *Manager) checkCertificates(ctx context.Context) error {
+	webspaces, err := m.GetAll()
+	if err != nil {
+		return fmt.Errorf("failed to retrieve all webspaces: %w", err)
+	}
+
+	uids := map[string]int{}
+	needed := map[string]struct{}{}
+	for _, w := range webspaces {
+		n := w.InstanceName()
+		uids[n] = w.UserID
+		if len(w.Domains) == 0 || w.Config.SNIPassthrough {
+			// TLS is handled by the webspace itself with SNI passthrough
+			m.acme.setFailure(n, nil, nil)
+			continue
+		}
+		needed[n] = struct{}{}
+
+		domains := append([]string(nil), w.Domains...)
+		sort.Strings(domains)
+		if !m.acme.needsCertificate(n, domains) {
+			continue
+		}
+		if m.acme.backingOff(n, domains) {
+			log.WithField("uid", w.UserID).Debug("Not retrying failed ACME certificate request yet")
+			continue
+		}
+
+		// Make sure routing for the domains (and challenges) is in place first
+		if err := m.reconcileWebspace(ctx, w.UserID); err != nil {
+			log.WithField("uid", w.UserID).WithError(err).Warn("Failed to reconcile webspace config before ACME")
+		}
+
+		log.WithFields(log.Fields{
+			"uid":     w.UserID,
+			"domains": domains,
+		}).Info("Obtaining certificate via ACME")
+		err := m.acme.obtain(n, domains)
+		m.acme.setFailure(n, domains, err)
+		if err != nil {
+			log.WithField("uid", w.UserID).WithError(err).Error("Failed to obtain certificate")
+			continue
+		}
+
+		m.routes.forget(w.UserID)
+		if err := m.reconcileWebspace(ctx, w.UserID); err != nil {
+			log.WithField("uid", w.UserID).WithError(err).Error("Failed to update webspace config with certificate")
+		}
+	}
+
+	for _, n := range m.acme.store.instances() {
+		if _, ok := needed[n]; ok {
+			continue
+		}
+
+		m.acme.setFailure(n, nil, nil)
+		if err := m.acme.store.remove(n); err != nil {
+			log.WithField("instance", n).WithError(err).Warn("Failed to remove unused certificate")
+		}
+
+		if uid, ok := uids[n]; ok {
+			m.routes.forget(uid)
+			if err := m.reconcileWebspace(ctx, uid); err != nil {
+				log.WithField("uid", uid).WithError(err).Error("Failed to update webspace config without certificate")
+			}
+		}
+	}
+
+	return nil
+}
+
+func (m *Manager) acmeLoop() {
+	t := time.NewTicker(m.config.Routing.ACME.CheckInterval)
+	defer t.Stop()
+
+	check := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), m.config.Routing.ACME.CheckInterval)
+		defer cancel()
+
+		if err := m.checkCertificates(ctx); err != nil {
+			log.WithError(err).Error("Failed to check ACME certificates")
+		}
+	}
+
+	check()
+	for {
+		select {
+		case <-t.C:
+			check()
+		case <-m.acme.check:
+			check()
+		case <-m.stop:
+			return
+		}
+	}
+}
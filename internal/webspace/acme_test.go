@@ -0,0 +1,165 @@
+package webspace
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/netsoc/webspaced/internal/config"
+)
+
+func testACMEManager(t *testing.T, directoryURL string) *acmeManager {
+	dir, err := os.MkdirTemp("", "webspaced-acme")
+	if err != nil {
+		t.Fatalf("failed to create storage directory: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	cfg := &config.Config{}
+	cfg.Routing.ACME.DirectoryURL = directoryURL
+	cfg.Routing.ACME.StorageDir = dir
+	cfg.Routing.ACME.RenewBefore = 30 * 24 * time.Hour
+	cfg.Routing.ACME.RetryBackoff = time.Minute
+
+	a, err := newACMEManager(cfg)
+	if err != nil {
+		t.Fatalf("failed to create ACME manager: %v", err)
+	}
+
+	return a
+}
+
+func TestACMERenewBefore(t *testing.T) {
+	a := testACMEManager(t, "")
+	now := time.Now()
+
+	long := &acmeCert{NotBefore: now, NotAfter: now.Add(90 * 24 * time.Hour)}
+	if d := a.renewBefore(long); d != a.config.Routing.ACME.RenewBefore {
+		t.Errorf("expected configured renewal time for long-lived certificate, got %v", d)
+	}
+	short := &acmeCert{NotBefore: now, NotAfter: now.Add(6 * 24 * time.Hour)}
+	if d := a.renewBefore(short); d != 2*24*time.Hour {
+		t.Errorf("expected a third of the lifetime for short-lived certificate, got %v", d)
+	}
+	// Metadata stored by older versions has no start time
+	legacy := &acmeCert{NotAfter: now.Add(6 * 24 * time.Hour)}
+	if d := a.renewBefore(legacy); d != a.config.Routing.ACME.RenewBefore {
+		t.Errorf("expected configured renewal time without a start time, got %v", d)
+	}
+}
+
+func TestACMEBackoff(t *testing.T) {
+	a := testACMEManager(t, "")
+	domains := []string{"example.com"}
+
+	if a.backingOff("ws-u1", domains) {
+		t.Fatal("expected no backoff without a failure")
+	}
+
+	a.setFailure("ws-u1", domains, errors.New("failed"))
+	if !a.backingOff("ws-u1", domains) {
+		t.Error("expected backoff after a failure")
+	}
+	if a.backingOff("ws-u1", []string{"example.com", "example.org"}) {
+		t.Error("expected no backoff when the domains change")
+	}
+	if a.backingOff("ws-u2", domains) {
+		t.Error("expected backoff to be per-instance")
+	}
+	if a.failure("ws-u1") == nil {
+		t.Error("expected failure to be recorded")
+	}
+
+	// Pretend the failure happened long enough ago
+	a.failures["ws-u1"].at = time.Now().Add(-2 * time.Minute)
+	if a.backingOff("ws-u1", domains) {
+		t.Error("expected backoff to have expired")
+	}
+
+	// Consecutive failures double the delay
+	a.setFailure("ws-u1", domains, errors.New("failed"))
+	a.failures["ws-u1"].at = time.Now().Add(-90 * time.Second)
+	if !a.backingOff("ws-u1", domains) {
+		t.Error("expected backoff to double after a second failure")
+	}
+	if d := (&acmeFailure{attempts: 100}).backoff(time.Minute); d != acmeMaxBackoff {
+		t.Errorf("expected backoff to be capped at %v, got %v", acmeMaxBackoff, d)
+	}
+
+	a.setFailure("ws-u1", domains, nil)
+	if a.backingOff("ws-u1", domains) || a.failure("ws-u1") != nil {
+		t.Error("expected success to clear the failure")
+	}
+}
+
+// TestACMEPebble obtains a certificate from a Pebble (https://github.com/letsencrypt/pebble) test ACME server. Set
+// PEBBLE_DIRECTORY_URL (e.g. https://localhost:14000/dir) to run it, with LEGO_CA_CERTIFICATES pointing to Pebble's
+// TLS certificate. PEBBLE_TEST_DOMAIN (localhost by default) must resolve to this machine for Pebble, which makes
+// HTTP-01 requests to port PEBBLE_HTTP_PORT (5002 by default).
+func TestACMEPebble(t *testing.T) {
+	directoryURL := os.Getenv("PEBBLE_DIRECTORY_URL")
+	if directoryURL == "" {
+		t.Skip("PEBBLE_DIRECTORY_URL not set")
+	}
+	domain := os.Getenv("PEBBLE_TEST_DOMAIN")
+	if domain == "" {
+		domain = "localhost"
+	}
+	port := os.Getenv("PEBBLE_HTTP_PORT")
+	if port == "" {
+		port = "5002"
+	}
+
+	a := testACMEManager(t, directoryURL)
+
+	l, err := net.Listen("tcp", net.JoinHostPort("", port))
+	if err != nil {
+		t.Fatalf("failed to listen for HTTP-01 challenges: %v", err)
+	}
+	srv := &http.Server{Handler: a.store}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+
+	domains := []string{domain}
+	if !a.needsCertificate("ws-u1", domains) {
+		t.Fatal("expected a certificate to be needed")
+	}
+	if err := a.obtain("ws-u1", domains); err != nil {
+		t.Fatalf("failed to obtain certificate: %v", err)
+	}
+
+	if a.needsCertificate("ws-u1", domains) {
+		t.Error("expected no certificate to be needed after obtaining one")
+	}
+	if !a.needsCertificate("ws-u1", []string{domain, "www." + domain}) {
+		t.Error("expected a certificate to be needed when the domains change")
+	}
+	if a.store.forHost(domain) == nil {
+		t.Errorf("expected a certificate for %v", domain)
+	}
+
+	// Certificates are loaded from disk
+	s, err := newCertStore(a.config.Routing.ACME.StorageDir)
+	if err != nil {
+		t.Fatalf("failed to load certificate store: %v", err)
+	}
+	if c := s.get("ws-u1"); c == nil || c.cert == nil {
+		t.Fatal("expected stored certificate to be loaded")
+	}
+
+	// The existing account is reused
+	a.client = nil
+	if err := a.setupClient(); err != nil {
+		t.Fatalf("failed to set up client with existing account: %v", err)
+	}
+
+	if err := s.remove("ws-u1"); err != nil {
+		t.Fatalf("failed to remove certificate: %v", err)
+	}
+	if s.get("ws-u1") != nil || s.forHost(domain) != nil {
+		t.Error("expected certificate to be removed")
+	}
+}
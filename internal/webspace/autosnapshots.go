@@ -0,0 +1,146 @@
+package webspace
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/netsoc/webspaced/internal/config"
+	log "github.com/sirupsen/logrus"
+)
+
+const autoSnapshotPrefix = "auto-"
+const autoSnapshotTimeFormat = "20060102-150405"
+
+type autoSnapshotSchedule struct {
+	name string
+	// start returns the start of the period containing a time, a snapshot is taken once per period
+	start  func(t time.Time) time.Time
+	policy config.SnapshotPolicy
+}
+
+// startOfDay returns the start of the (UTC) day containing t
+func startOfDay(t time.Time) time.Time {
+	y, m, d := t.UTC().Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+// startOfWeek returns the start of the (UTC) week containing t, weeks start on Monday
+func startOfWeek(t time.Time) time.Time {
+	day := startOfDay(t)
+	return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+}
+
+func (s *autoSnapshotSchedule) prefix() string {
+	return autoSnapshotPrefix + s.name + "-"
+}
+
+func (m *Manager) autoSnapshotSchedules() []autoSnapshotSchedule {
+	var schedules []autoSnapshotSchedule
+	if m.config.Webspaces.Snapshots.Daily.Enabled {
+		schedules = append(schedules, autoSnapshotSchedule{"daily", startOfDay, m.config.Webspaces.Snapshots.Daily})
+	}
+	if m.config.Webspaces.Snapshots.Weekly.Enabled {
+		schedules = append(schedules, autoSnapshotSchedule{"weekly", startOfWeek, m.config.Webspaces.Snapshots.Weekly})
+	}
+
+	return schedules
+}
+
+// autoSnapshot takes any automatic snapshots that are due for a webspace and prunes old ones
+func (w *Webspace) autoSnapshot(schedules []autoSnapshotSchedule) error {
+	w.manager.Lock(w.UserID)
+	defer w.manager.Unlock(w.UserID)
+
+	snapshots, err := w.Snapshots()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, s := range schedules {
+		var matching []Snapshot
+		for _, snap := range snapshots {
+			if strings.HasPrefix(snap.Name, s.prefix()) {
+				matching = append(matching, snap)
+			}
+		}
+
+		// Newest first
+		sort.Slice(matching, func(i, j int) bool {
+			return matching[i].CreatedAt.After(matching[j].CreatedAt)
+		})
+
+		// Comparing periods rather than the time since the last snapshot keeps snapshots from drifting later each time
+		if len(matching) == 0 || s.start(matching[0].CreatedAt).Before(s.start(now)) {
+			name := s.prefix() + now.UTC().Format(autoSnapshotTimeFormat)
+			log.WithFields(log.Fields{
+				"uid":      w.UserID,
+				"snapshot": name,
+			}).Debug("Taking automatic snapshot")
+
+			if err := w.createSnapshot(name); err != nil {
+				return err
+			}
+
+			matching = append([]Snapshot{{Name: name, CreatedAt: now}}, matching...)
+		}
+
+		for i, snap := range matching {
+			if (s.policy.Keep == 0 || i < int(s.policy.Keep)) &&
+				(s.policy.MaxAge == 0 || now.Sub(snap.CreatedAt) < s.policy.MaxAge) {
+				continue
+			}
+
+			log.WithFields(log.Fields{
+				"uid":      w.UserID,
+				"snapshot": snap.Name,
+			}).Debug("Pruning automatic snapshot")
+
+			if err := w.deleteSnapshot(snap.Name); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (m *Manager) checkAutoSnapshots() {
+	schedules := m.autoSnapshotSchedules()
+	if len(schedules) == 0 {
+		return
+	}
+
+	webspaces, err := m.GetAll()
+	if err != nil {
+		log.WithError(err).Error("Failed to retrieve webspaces for automatic snapshots")
+		return
+	}
+
+	for _, w := range webspaces {
+		if w.Config.DisableAutoSnapshots {
+			continue
+		}
+
+		if err := w.autoSnapshot(schedules); err != nil {
+			log.WithError(err).WithField("uid", w.UserID).Error("Failed to process automatic snapshots")
+		}
+	}
+}
+
+func (m *Manager) autoSnapshotLoop() {
+	m.checkAutoSnapshots()
+
+	t := time.NewTicker(m.config.Webspaces.Snapshots.CheckInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			m.checkAutoSnapshots()
+		case <-m.stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package webspace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	lxd "github.com/lxc/lxd/client"
+	lxdApi "github.com/lxc/lxd/shared/api"
+	"github.com/netsoc/webspaced/internal/config"
+	"github.com/netsoc/webspaced/pkg/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// tempBackup is a backup downloaded to a temporary file, which is deleted when closed
+type tempBackup struct {
+	*os.File
+}
+
+// Close closes and deletes the temporary file
+func (b tempBackup) Close() error {
+	err := b.File.Close()
+	if rmErr := os.Remove(b.Name()); err == nil {
+		err = rmErr
+	}
+
+	return err
+}
+
+// Export downloads a tarball (LXD backup) of the webspace, returning it along with its size. The caller must close
+// the returned reader.
+func (w *Webspace) Export() (io.ReadCloser, int64, error) {
+	n := w.InstanceName()
+
+	// Concurrent exports of the same webspace need distinct backup names
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return nil, 0, fmt.Errorf("failed to generate backup name: %w", err)
+	}
+	name := fmt.Sprintf("export-%v-%v", time.Now().Unix(), hex.EncodeToString(suffix))
+
+	w.manager.Lock(w.UserID)
+	op, err := w.manager.lxd.CreateInstanceBackup(n, lxdApi.InstanceBackupsPost{
+		Name:                 name,
+		ExpiresAt:            time.Now().Add(1 * time.Hour),
+		InstanceOnly:         true,
+		CompressionAlgorithm: "gzip",
+	})
+	if err == nil {
+		err = op.Wait()
+	}
+	w.manager.Unlock(w.UserID)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to create LXD instance backup: %w", convertLXDError(err))
+	}
+	defer func() {
+		op, err := w.manager.lxd.DeleteInstanceBackup(n, name)
+		if err == nil {
+			err = op.Wait()
+		}
+		if err != nil {
+			log.WithError(convertLXDError(err)).WithField("uid", w.UserID).Warn("Failed to delete LXD instance backup")
+		}
+	}()
+
+	// LXD needs to be able to seek while downloading the backup
+	f, err := ioutil.TempFile("", "webspace-export-*.tar.gz")
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	backup := tempBackup{f}
+
+	resp, err := w.manager.lxd.GetInstanceBackupFile(n, name, &lxd.BackupFileRequest{
+		BackupFile: f,
+	})
+	if err != nil {
+		backup.Close()
+		return nil, 0, fmt.Errorf("failed to download LXD instance backup: %w", convertLXDError(err))
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		backup.Close()
+		return nil, 0, fmt.Errorf("failed to rewind temporary file: %w", err)
+	}
+
+	return backup, resp.Size, nil
+}
+
+// importedConfigAllowed returns true if an LXD config key from an imported backup should be kept
+func importedConfigAllowed(key string) bool {
+	return key == lxdConfigKey || strings.HasPrefix(key, "image.") || strings.HasPrefix(key, "volatile.")
+}
+
+// sanitizeImported fixes up the stored webspace configuration of an imported instance, dropping anything that
+// conflicts with other webspaces or is no longer valid
+func (w *Webspace) sanitizeImported(i *lxdApi.Instance) error {
+	uid := w.UserID
+	defaults := w.manager.config.Webspaces.ConfigDefaults
+	if confJSON, ok := i.Config[lxdConfigKey]; ok {
+		if err := json.Unmarshal([]byte(confJSON), w); err != nil {
+			log.WithError(err).WithField("uid", uid).Warn("Failed to parse imported webspace configuration")
+			w.Config = defaults
+			w.Domains = []string{}
+			w.PendingDomains = nil
+			w.Ports = map[uint16]PortMapping{}
+		}
+	}
+
+	w.UserID = uid
+	// Resource limits are set by admins, don't trust the backup
+	w.Limits = config.ResourceLimits{}
+	if _, err := w.lxdConfig(); err != nil {
+		w.Config = defaults
+	}
+
+	webspaces, err := w.manager.GetAll()
+	if err != nil {
+		return err
+	}
+
+	usedDomains := map[string]bool{}
+	usedPorts := map[uint16]bool{}
+	for _, other := range webspaces {
+		if other.UserID == w.UserID {
+			continue
+		}
+
+		for _, d := range other.Domains {
+			usedDomains[d] = true
+		}
+		for e := range other.Ports {
+			usedPorts[e] = true
+		}
+	}
+
+	domains := []string{}
+	for _, d := range w.Domains {
+		if usedDomains[d] {
+			continue
+		}
+		if err := w.verifyDomain(d); err != nil {
+			log.WithError(err).WithFields(log.Fields{
+				"uid":    w.UserID,
+				"domain": d,
+			}).Debug("Dropping unverified domain from imported webspace")
+			continue
+		}
+
+		domains = append(domains, d)
+	}
+	w.Domains = domains
+
+	ports := map[uint16]PortMapping{}
+	for e, i := range w.Ports {
+		if len(ports) == int(w.manager.config.Webspaces.Ports.Max) {
+			break
+		}
+		if usedPorts[e] || i.validate() != nil ||
+			e < w.manager.config.Webspaces.Ports.Start || e > w.manager.config.Webspaces.Ports.End {
+			continue
+		}
+
+		ports[e] = i
+	}
+	w.Ports = ports
+
+	return nil
+}
+
+// Import creates a new webspace from an uploaded tarball (LXD backup)
+func (m *Manager) Import(ctx context.Context, uid int, backup io.Reader) (*Webspace, error) {
+	w, err := m.doImport(uid, backup)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := w.Sync(ctx); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+func (m *Manager) doImport(uid int, backup io.Reader) (*Webspace, error) {
+	m.Lock(uid)
+	defer m.Unlock(uid)
+
+	w := &Webspace{
+		manager: m,
+
+		UserID:  uid,
+		Config:  m.config.Webspaces.ConfigDefaults,
+		Domains: []string{},
+		Ports:   map[uint16]PortMapping{},
+	}
+	n := w.InstanceName()
+
+	if _, _, err := m.lxd.GetInstance(n); err == nil {
+		return nil, util.ErrExists
+	}
+
+	op, err := m.lxd.CreateInstanceFromBackup(lxd.InstanceBackupArgs{
+		BackupFile: backup,
+		Name:       n,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create LXD instance from backup: %w", convertLXDError(err))
+	}
+	if err := op.Wait(); err != nil {
+		return nil, fmt.Errorf("failed to create LXD instance from backup: %w", convertLXDError(err))
+	}
+
+	if err := w.setupImported(); err != nil {
+		// Don't leave behind an instance we couldn't sanitize
+		if op, err := m.lxd.DeleteInstance(n); err == nil {
+			op.Wait()
+		}
+
+		return nil, err
+	}
+
+	return w, nil
+}
+
+func (w *Webspace) setupImported() error {
+	n := w.InstanceName()
+
+	i, etag, err := w.manager.lxd.GetInstance(n)
+	if err != nil {
+		return fmt.Errorf("failed to get LXD instance: %w", convertLXDError(err))
+	}
+
+	// Snapshots would allow restoring the unsanitized configuration
+	snapshots, err := w.Snapshots()
+	if err != nil {
+		return err
+	}
+	for _, s := range snapshots {
+		if err := w.deleteSnapshot(s.Name); err != nil {
+			return err
+		}
+	}
+
+	if err := w.sanitizeImported(i); err != nil {
+		return err
+	}
+	lxdConf, err := w.lxdConfig()
+	if err != nil {
+		return err
+	}
+
+	// Only keep the config that LXD itself manages, everything else (e.g. security settings and devices) comes from
+	// the webspace profile
+	config := map[string]string{}
+	for k, v := range i.Config {
+		if importedConfigAllowed(k) {
+			config[k] = v
+		}
+	}
+	config[lxdConfigKey] = lxdConf
+
+	op, err := w.manager.lxd.UpdateInstance(n, lxdApi.InstancePut{
+		Architecture: i.Architecture,
+		Config:       config,
+		Devices:      map[string]map[string]string{},
+		Ephemeral:    false,
+		Profiles:     []string{w.manager.config.Webspaces.LXDProfile},
+	}, etag)
+	if err != nil {
+		return fmt.Errorf("failed to update LXD instance: %w", convertLXDError(err))
+	}
+
+	if err := op.Wait(); err != nil {
+		return fmt.Errorf("failed to update LXD instance: %w", convertLXDError(err))
+	}
+
+	// Apply resource limits now that the profile's devices are in effect
+	return w.Save()
+}
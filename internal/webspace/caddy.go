@@ -0,0 +1,327 @@
+package webspace
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/netsoc/webspaced/internal/config"
+	"github.com/netsoc/webspaced/pkg/util"
+)
+
+// CaddyForwardedAuthHeader is the header Caddy uses to pass a client's own Authorization header through webspaced's
+// boot proxy (since the real one is replaced with webspaced's IAM token)
+const CaddyForwardedAuthHeader = "X-Forwarded-Authorization"
+
+// CaddyForwardedHostHeader is the header Caddy uses to pass the original Host header through webspaced's boot proxy
+const CaddyForwardedHostHeader = "X-Forwarded-Host"
+
+// caddyAutomatePath is the Caddy config path for the list of names Caddy should manage certificates for
+const caddyAutomatePath = "/config/apps/tls/certificates/automate"
+
+// caddyRoute is a route in a Caddy HTTP server
+type caddyRoute struct {
+	ID       string                   `json:"@id"`
+	Match    []map[string]interface{} `json:"match"`
+	Handle   []map[string]interface{} `json:"handle"`
+	Terminal bool                     `json:"terminal"`
+}
+
+// Caddy manages webspace configuration for Caddy via its admin API
+type Caddy struct {
+	config *config.Config
+	client http.Client
+
+	adminURL string
+	// ownedID matches the IDs of routes which webspaced generates
+	ownedID *regexp.Regexp
+}
+
+// NewCaddy creates a new Caddy config manager
+func NewCaddy(cfg *config.Config) (RoutingProvider, error) {
+	if _, err := url.Parse(cfg.Routing.Caddy.AdminURL); err != nil {
+		return nil, fmt.Errorf("failed to parse Caddy admin API URL: %w", err)
+	}
+
+	return &Caddy{
+		config: cfg,
+
+		adminURL: strings.TrimSuffix(cfg.Routing.Caddy.AdminURL, "/"),
+		ownedID:  regexp.MustCompile(`^` + regexp.QuoteMeta(cfg.Webspaces.InstancePrefix) + `u\d+$`),
+	}, nil
+}
+
+// do makes a request to the Caddy admin API, decoding the response into out (if not nil)
+func (c *Caddy) do(ctx context.Context, method, path string, in, out interface{}) (int, error) {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return 0, fmt.Errorf("failed to encode request body: %w", err)
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.adminURL+path, body)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create request: %w", err)
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to make request to Caddy admin API: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		msg, _ := ioutil.ReadAll(res.Body)
+		return res.StatusCode, fmt.Errorf("Caddy admin API returned non-ok status %v: %v",
+			res.StatusCode, strings.TrimSpace(string(msg)))
+	}
+
+	if out != nil {
+		if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+			return res.StatusCode, fmt.Errorf("failed to decode Caddy admin API response: %w", err)
+		}
+	}
+
+	return res.StatusCode, nil
+}
+
+func (c *Caddy) routesPath() string {
+	return fmt.Sprintf("/config/apps/http/servers/%v/routes", url.PathEscape(c.config.Routing.Caddy.Server))
+}
+
+func (c *Caddy) deleteRoute(ctx context.Context, id string) error {
+	if status, err := c.do(ctx, http.MethodDelete, "/id/"+url.PathEscape(id), nil, nil); err != nil &&
+		status != http.StatusNotFound {
+		return fmt.Errorf("failed to delete route %v: %w", id, err)
+	}
+
+	return nil
+}
+
+// automateCertificates makes sure Caddy manages a wildcard certificate for the webspace domain (along with the default
+// SANs), which covers all webspaces' default domains. Caddy must be configured with a DNS challenge for this.
+func (c *Caddy) automateCertificates(ctx context.Context) error {
+	names := append([]string{"*." + c.config.Webspaces.Domain}, c.config.Routing.DefaultSANs...)
+
+	var automated []string
+	// Caddy returns 400 if a parent of the path (e.g. the TLS app) doesn't exist yet
+	if status, err := c.do(ctx, http.MethodGet, caddyAutomatePath, nil, &automated); err != nil &&
+		status != http.StatusNotFound && status != http.StatusBadRequest {
+		return fmt.Errorf("failed to get automated certificates: %w", err)
+	}
+
+	have := make(map[string]bool, len(automated))
+	for _, n := range automated {
+		have[n] = true
+	}
+	var missing []string
+	for _, n := range names {
+		if !have[n] {
+			missing = append(missing, n)
+			have[n] = true
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	method, path := http.MethodPost, caddyAutomatePath+"/..."
+	if automated == nil {
+		// PUT creates any missing parents
+		method, path = http.MethodPut, caddyAutomatePath
+	}
+	if _, err := c.do(ctx, method, path, missing, nil); err != nil {
+		return fmt.Errorf("failed to add automated certificates: %w", err)
+	}
+
+	return nil
+}
+
+// ClearAll cleans all configuration for all instances
+func (c *Caddy) ClearAll(ctx context.Context) error {
+	var routes []caddyRoute
+	if status, err := c.do(ctx, http.MethodGet, c.routesPath(), nil, &routes); err != nil &&
+		status != http.StatusNotFound {
+		return fmt.Errorf("failed to list routes: %w", err)
+	}
+
+	for _, r := range routes {
+		if !c.ownedID.MatchString(r.ID) {
+			continue
+		}
+
+		if err := c.deleteRoute(ctx, r.ID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Instances returns the names of all instances which have configuration
+func (c *Caddy) Instances(ctx context.Context) ([]string, error) {
+	var routes []caddyRoute
+	if status, err := c.do(ctx, http.MethodGet, c.routesPath(), nil, &routes); err != nil &&
+		status != http.StatusNotFound {
+		return nil, fmt.Errorf("failed to list routes: %w", err)
+	}
+
+	instances := map[string]struct{}{}
+	for _, r := range routes {
+		if c.ownedID.MatchString(r.ID) {
+			instances[r.ID] = struct{}{}
+		}
+	}
+
+	return sortedInstances(instances), nil
+}
+
+// ClearConfig cleans out any configuration for an instance
+func (c *Caddy) ClearConfig(ctx context.Context, n string) error {
+	return c.deleteRoute(ctx, n)
+}
+
+// bootHandlers returns handlers which send requests to webspaced's boot proxy, which starts the webspace and passes
+// the request on (the equivalent of Traefik's WebspaceBoot middleware)
+func (c *Caddy) bootHandlers(ws *Webspace) ([]map[string]interface{}, error) {
+	u, err := url.Parse(c.config.Routing.WebspacedURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse webspaced URL: %w", err)
+	}
+
+	host := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	proxy := map[string]interface{}{
+		"handler":   "reverse_proxy",
+		"upstreams": []map[string]interface{}{{"dial": host}},
+		"headers": map[string]interface{}{
+			"request": map[string]interface{}{
+				"set": map[string][]string{
+					"Host":                   {u.Host},
+					"Authorization":          {"Bearer " + c.config.Routing.IAMToken},
+					CaddyForwardedAuthHeader: {"{http.request.header.Authorization}"},
+					CaddyForwardedHostHeader: {"{http.request.hostport}"},
+				},
+			},
+		},
+	}
+	if u.Scheme == "https" {
+		proxy["transport"] = map[string]interface{}{
+			"protocol": "http",
+			"tls":      map[string]interface{}{},
+		}
+	}
+
+	return []map[string]interface{}{
+		{
+			"handler": "rewrite",
+			"uri": fmt.Sprintf("%v/internal/id:%v/proxy{http.request.uri}",
+				strings.TrimSuffix(u.Path, "/"), ws.UserID),
+		},
+		proxy,
+	}, nil
+}
+
+// GenerateConfig creates or updates the Caddy route for a webspace (leaving it untouched if nothing changed). The
+// default domain is covered by the wildcard certificate (see automateCertificates), certificates for custom domains
+// are managed by Caddy's automatic HTTPS.
+func (c *Caddy) GenerateConfig(ctx context.Context, ws *Webspace, addr string) error {
+	n := ws.InstanceName()
+
+	if addr == "" && c.config.Routing.WebspacedURL == "" {
+		// Boot hooks (only used when webspaces aren't running) are disabled
+		return c.ClearConfig(ctx, n)
+	}
+	if ws.Config.SNIPassthrough {
+		return fmt.Errorf("%w (SNI passthrough is not supported by Caddy)", util.ErrBadValue)
+	}
+	if err := c.automateCertificates(ctx); err != nil {
+		return err
+	}
+
+	domains, err := ws.GetDomains(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get webspace domains: %w", err)
+	}
+
+	route := caddyRoute{
+		ID:       n,
+		Match:    []map[string]interface{}{{"host": domains}},
+		Terminal: true,
+	}
+	if addr != "" {
+		route.Handle = []map[string]interface{}{
+			{
+				"handler": "reverse_proxy",
+				"upstreams": []map[string]interface{}{
+					{"dial": net.JoinHostPort(addr, fmt.Sprint(ws.Config.HTTPPort))},
+				},
+			},
+		}
+	} else if route.Handle, err = c.bootHandlers(ws); err != nil {
+		return err
+	}
+
+	var existing interface{}
+	status, err := c.do(ctx, http.MethodGet, "/id/"+url.PathEscape(n), nil, &existing)
+	switch {
+	case err == nil:
+		// Round-trip through JSON so the comparison is like-for-like
+		var desired interface{}
+		data, err := json.Marshal(route)
+		if err != nil {
+			return fmt.Errorf("failed to encode route: %w", err)
+		}
+		if err := json.Unmarshal(data, &desired); err != nil {
+			return fmt.Errorf("failed to decode route: %w", err)
+		}
+
+		if reflect.DeepEqual(existing, desired) {
+			return nil
+		}
+
+		if _, err := c.do(ctx, http.MethodPatch, "/id/"+url.PathEscape(n), route, nil); err != nil {
+			return fmt.Errorf("failed to update route: %w", err)
+		}
+	case status == http.StatusNotFound:
+		var routes []caddyRoute
+		if _, err := c.do(ctx, http.MethodGet, c.routesPath(), nil, &routes); err != nil || routes == nil {
+			// No routes yet, POSTing an array to a missing key will create it
+			if _, err := c.do(ctx, http.MethodPost, c.routesPath(), []caddyRoute{route}, nil); err != nil {
+				return fmt.Errorf("failed to create route: %w", err)
+			}
+			return nil
+		}
+
+		// Insert at the start so webspace routes take priority over any catch-all routes
+		if _, err := c.do(ctx, http.MethodPut, c.routesPath()+"/0", route, nil); err != nil {
+			return fmt.Errorf("failed to create route: %w", err)
+		}
+	default:
+		return fmt.Errorf("failed to get existing route: %w", err)
+	}
+
+	return nil
+}
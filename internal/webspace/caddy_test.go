@@ -0,0 +1,364 @@
+package webspace
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	iam "github.com/netsoc/iam/client"
+
+	"github.com/netsoc/webspaced/internal/config"
+)
+
+// fakeCaddy implements the parts of Caddy's admin API (/config/ and /id/) used by the Caddy provider
+type fakeCaddy struct {
+	sync.Mutex
+	config interface{}
+	// writes counts requests which modify the config
+	writes int
+}
+
+// find returns the path of the object with the given @id
+func (f *fakeCaddy) find(v interface{}, id string, path []string) []string {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if v["@id"] == id {
+			return path
+		}
+		for k, c := range v {
+			if p := f.find(c, id, append(path[:len(path):len(path)], k)); p != nil {
+				return p
+			}
+		}
+	case []interface{}:
+		for i, c := range v {
+			if p := f.find(c, id, append(path[:len(path):len(path)], strconv.Itoa(i))); p != nil {
+				return p
+			}
+		}
+	}
+
+	return nil
+}
+
+// access applies an operation to the value at path, returning the new value of the parent (and a HTTP status)
+func access(parent interface{}, path []string, method string, val interface{}, expand bool) (interface{}, interface{}, int) {
+	if len(path) == 0 {
+		return nil, nil, http.StatusBadRequest
+	}
+	part := path[0]
+
+	switch p := parent.(type) {
+	case map[string]interface{}:
+		existing, ok := p[part]
+		if len(path) > 1 {
+			if !ok && method == http.MethodPut {
+				existing = map[string]interface{}{}
+			} else if !ok {
+				return nil, nil, http.StatusBadRequest
+			}
+
+			child, out, status := access(existing, path[1:], method, val, expand)
+			if status == http.StatusOK {
+				p[part] = child
+			}
+			return p, out, status
+		}
+
+		switch method {
+		case http.MethodGet:
+			return p, existing, http.StatusOK
+		case http.MethodPost:
+			if arr, isArr := existing.([]interface{}); isArr {
+				if expand {
+					p[part] = append(arr, val.([]interface{})...)
+				} else {
+					p[part] = append(arr, val)
+				}
+			} else {
+				p[part] = val
+			}
+		case http.MethodPut:
+			if ok {
+				return nil, nil, http.StatusConflict
+			}
+			p[part] = val
+		case http.MethodPatch:
+			if !ok {
+				return nil, nil, http.StatusNotFound
+			}
+			p[part] = val
+		case http.MethodDelete:
+			if !ok {
+				return nil, nil, http.StatusNotFound
+			}
+			delete(p, part)
+		}
+		return p, nil, http.StatusOK
+	case []interface{}:
+		i, err := strconv.Atoi(part)
+		if err != nil || i < 0 || i > len(p) || (i == len(p) && (method != http.MethodPut || len(path) > 1)) {
+			return nil, nil, http.StatusBadRequest
+		}
+		if len(path) > 1 {
+			child, out, status := access(p[i], path[1:], method, val, expand)
+			if status == http.StatusOK {
+				p[i] = child
+			}
+			return p, out, status
+		}
+
+		switch method {
+		case http.MethodGet:
+			return p, p[i], http.StatusOK
+		case http.MethodPut:
+			p = append(p[:i], append([]interface{}{val}, p[i:]...)...)
+		case http.MethodPatch:
+			p[i] = val
+		case http.MethodDelete:
+			p = append(p[:i], p[i+1:]...)
+		default:
+			return nil, nil, http.StatusBadRequest
+		}
+		return p, nil, http.StatusOK
+	default:
+		return nil, nil, http.StatusBadRequest
+	}
+}
+
+func (f *fakeCaddy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	var path []string
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/config/"):
+		path = strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/config/"), "/"), "/")
+	case strings.HasPrefix(r.URL.Path, "/id/"):
+		if path = f.find(f.config, strings.TrimPrefix(r.URL.Path, "/id/"), []string{}); path == nil {
+			http.Error(w, "unknown object ID", http.StatusNotFound)
+			return
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	expand := false
+	if path[len(path)-1] == "..." {
+		expand = true
+		path = path[:len(path)-1]
+	}
+
+	var val interface{}
+	if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+		if err := json.NewDecoder(r.Body).Decode(&val); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.writes++
+	} else if r.Method == http.MethodDelete {
+		f.writes++
+	}
+
+	root, out, status := access(f.config, path, r.Method, val, expand)
+	if status != http.StatusOK {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	f.config = root
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// get returns the value at a config path
+func (f *fakeCaddy) get(t *testing.T, path string) interface{} {
+	t.Helper()
+	f.Lock()
+	defer f.Unlock()
+
+	_, v, status := access(f.config, strings.Split(path, "/"), http.MethodGet, nil, false)
+	if status != http.StatusOK {
+		t.Fatalf("failed to get %v: %v", path, status)
+	}
+
+	return v
+}
+
+func (f *fakeCaddy) writeCount() int {
+	f.Lock()
+	defer f.Unlock()
+
+	return f.writes
+}
+
+// testCaddy creates a Caddy provider pointed at a fake admin API with a server (srv0) that has a catch-all route
+func testCaddy(t *testing.T) (*Caddy, *fakeCaddy, *Manager) {
+	fake := &fakeCaddy{}
+	if err := json.Unmarshal([]byte(`{
+		"apps": {"http": {"servers": {"srv0": {
+			"listen": [":443"],
+			"routes": [{"handle": [{"handler": "static_response", "status_code": 404}]}]
+		}}}}
+	}`), &fake.config); err != nil {
+		t.Fatalf("failed to parse initial config: %v", err)
+	}
+
+	s := httptest.NewServer(fake)
+	t.Cleanup(s.Close)
+
+	cfg := &config.Config{}
+	cfg.Webspaces.InstancePrefix = "ws-"
+	cfg.Webspaces.Domain = "ng.localhost"
+	cfg.Routing.Caddy.AdminURL = s.URL + "/"
+	cfg.Routing.Caddy.Server = "srv0"
+	cfg.Routing.DefaultSANs = []string{"ng.localhost"}
+	cfg.Routing.WebspacedURL = "http://webspaced:8080"
+	cfg.Routing.IAMToken = "token"
+
+	c, err := NewCaddy(cfg)
+	if err != nil {
+		t.Fatalf("failed to create Caddy provider: %v", err)
+	}
+
+	return c.(*Caddy), fake, &Manager{config: cfg}
+}
+
+func testCaddyWebspace(m *Manager, uid int, username string, domains ...string) *Webspace {
+	return &Webspace{
+		manager: m,
+		user:    &iam.User{Username: username},
+		UserID:  uid,
+		Config:  config.WebspaceConfig{HTTPPort: 80},
+		Domains: domains,
+	}
+}
+
+// routeIDs returns the @id of each of srv0's routes
+func routeIDs(t *testing.T, fake *fakeCaddy) []string {
+	t.Helper()
+
+	routes := fake.get(t, "apps/http/servers/srv0/routes").([]interface{})
+	ids := make([]string, len(routes))
+	for i, r := range routes {
+		ids[i], _ = r.(map[string]interface{})["@id"].(string)
+	}
+
+	return ids
+}
+
+func TestCaddyGenerateConfig(t *testing.T) {
+	c, fake, m := testCaddy(t)
+	ctx := context.Background()
+	w := testCaddyWebspace(m, 1, "alice", "example.com")
+
+	// Create (stopped webspace)
+	if err := c.GenerateConfig(ctx, w, ""); err != nil {
+		t.Fatalf("failed to generate config: %v", err)
+	}
+	if ids := routeIDs(t, fake); !reflect.DeepEqual(ids, []string{"ws-u1", ""}) {
+		t.Fatalf("expected webspace route to be inserted before the catch-all route, got %v", ids)
+	}
+	route := fake.get(t, "apps/http/servers/srv0/routes/0").(map[string]interface{})
+	hosts := route["match"].([]interface{})[0].(map[string]interface{})["host"]
+	if !reflect.DeepEqual(hosts, []interface{}{"alice.ng.localhost", "example.com"}) {
+		t.Errorf("unexpected hosts %v", hosts)
+	}
+	handle := route["handle"].([]interface{})
+	if h := handle[0].(map[string]interface{}); h["handler"] != "rewrite" || h["uri"] != "/internal/id:1/proxy{http.request.uri}" {
+		t.Errorf("unexpected boot rewrite handler %v", h)
+	}
+
+	automated := fake.get(t, "apps/tls/certificates/automate")
+	if !reflect.DeepEqual(automated, []interface{}{"*.ng.localhost", "ng.localhost"}) {
+		t.Errorf("unexpected automated certificates %v", automated)
+	}
+
+	// No-op
+	writes := fake.writeCount()
+	if err := c.GenerateConfig(ctx, w, ""); err != nil {
+		t.Fatalf("failed to generate config: %v", err)
+	}
+	if n := fake.writeCount() - writes; n != 0 {
+		t.Errorf("expected no changes to be made for the same config, got %v writes", n)
+	}
+
+	// Update (started webspace)
+	if err := c.GenerateConfig(ctx, w, "10.0.0.2"); err != nil {
+		t.Fatalf("failed to generate config: %v", err)
+	}
+	if ids := routeIDs(t, fake); !reflect.DeepEqual(ids, []string{"ws-u1", ""}) {
+		t.Fatalf("expected webspace route to be updated in place, got %v", ids)
+	}
+	route = fake.get(t, "apps/http/servers/srv0/routes/0").(map[string]interface{})
+	handle = route["handle"].([]interface{})
+	if len(handle) != 1 {
+		t.Fatalf("expected a single handler, got %v", handle)
+	}
+	upstreams := handle[0].(map[string]interface{})["upstreams"]
+	if !reflect.DeepEqual(upstreams, []interface{}{map[string]interface{}{"dial": "10.0.0.2:80"}}) {
+		t.Errorf("unexpected upstreams %v", upstreams)
+	}
+
+	// Existing automated certificates are kept
+	c.config.Routing.DefaultSANs = []string{"ng.localhost", "extra.localhost"}
+	if err := c.GenerateConfig(ctx, w, "10.0.0.2"); err != nil {
+		t.Fatalf("failed to generate config: %v", err)
+	}
+	automated = fake.get(t, "apps/tls/certificates/automate")
+	if !reflect.DeepEqual(automated, []interface{}{"*.ng.localhost", "ng.localhost", "extra.localhost"}) {
+		t.Errorf("unexpected automated certificates %v", automated)
+	}
+
+	w.Config.SNIPassthrough = true
+	if err := c.GenerateConfig(ctx, w, "10.0.0.2"); err == nil {
+		t.Error("expected SNI passthrough to be rejected")
+	}
+}
+
+func TestCaddyClearAll(t *testing.T) {
+	c, fake, m := testCaddy(t)
+	ctx := context.Background()
+
+	for _, w := range []*Webspace{testCaddyWebspace(m, 1, "alice"), testCaddyWebspace(m, 2, "bob")} {
+		if err := c.GenerateConfig(ctx, w, "10.0.0.2"); err != nil {
+			t.Fatalf("failed to generate config: %v", err)
+		}
+	}
+	if _, err := c.do(ctx, http.MethodPost, c.routesPath(), map[string]interface{}{"@id": "ws-other"}, nil); err != nil {
+		t.Fatalf("failed to add unrelated route: %v", err)
+	}
+
+	instances, err := c.Instances(ctx)
+	if err != nil {
+		t.Fatalf("failed to list instances: %v", err)
+	}
+	if !reflect.DeepEqual(instances, []string{"ws-u1", "ws-u2"}) {
+		t.Errorf("unexpected instances %v", instances)
+	}
+
+	if err := c.ClearConfig(ctx, "ws-u1"); err != nil {
+		t.Fatalf("failed to clear config: %v", err)
+	}
+	if ids := routeIDs(t, fake); !reflect.DeepEqual(ids, []string{"ws-u2", "", "ws-other"}) {
+		t.Errorf("unexpected routes after clearing config: %v", ids)
+	}
+	// Already gone
+	if err := c.ClearConfig(ctx, "ws-u1"); err != nil {
+		t.Errorf("failed to clear missing config: %v", err)
+	}
+
+	if err := c.ClearAll(ctx); err != nil {
+		t.Fatalf("failed to clear all config: %v", err)
+	}
+	if ids := routeIDs(t, fake); !reflect.DeepEqual(ids, []string{"", "ws-other"}) {
+		t.Errorf("unexpected routes after clearing all config: %v", ids)
+	}
+}
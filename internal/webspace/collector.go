@@ -0,0 +1,63 @@
+package webspace
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	lxdApi "github.com/lxc/lxd/shared/api"
+	"github.com/netsoc/webspaced/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// usageCollector is a Prometheus collector which reads webspace state and resource usage from LXD on each scrape
+type usageCollector struct {
+	m *Manager
+}
+
+// Describe implements prometheus.Collector
+func (c usageCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- metrics.Webspaces
+	ch <- metrics.WebspaceCPU
+	ch <- metrics.WebspaceMemory
+}
+
+// Collect implements prometheus.Collector
+func (c usageCollector) Collect(ch chan<- prometheus.Metric) {
+	instances, err := c.m.lxd.GetInstancesFull(lxdApi.InstanceTypeContainer)
+	if err != nil {
+		err = convertLXDError(err)
+		log.WithError(err).Error("Failed to retrieve LXD instances for metrics")
+		ch <- prometheus.NewInvalidMetric(metrics.Webspaces, err)
+		return
+	}
+
+	states := map[string]int{}
+	for _, i := range instances {
+		if _, ok := i.Config[lxdConfigKey]; !ok {
+			continue
+		}
+
+		w, err := c.m.instanceToWebspace(&i.Instance)
+		if err != nil {
+			log.WithError(err).WithField("instance", i.Name).Error("Failed to parse webspace for metrics")
+			continue
+		}
+		states[strings.ToLower(i.Status)]++
+
+		if i.State == nil || i.State.StatusCode != lxdApi.Running {
+			continue
+		}
+
+		u := usageFromLXD(i.State)
+		uid := strconv.Itoa(w.UserID)
+		ch <- prometheus.MustNewConstMetric(metrics.WebspaceCPU, prometheus.CounterValue,
+			float64(u.CPU)/float64(time.Second), uid)
+		ch <- prometheus.MustNewConstMetric(metrics.WebspaceMemory, prometheus.GaugeValue, float64(u.Memory), uid)
+	}
+
+	for state, n := range states {
+		ch <- prometheus.MustNewConstMetric(metrics.Webspaces, prometheus.GaugeValue, float64(n), state)
+	}
+}
@@ -0,0 +1,167 @@
+package webspace
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/netsoc/webspaced/internal/config"
+	"github.com/netsoc/webspaced/pkg/util"
+	"golang.org/x/time/rate"
+)
+
+// Reasons a connection to a port forward can be rejected
+const (
+	rejectACL            = "acl"
+	rejectMaxConnections = "max_connections"
+	rejectMaxPerIP       = "max_connections_per_ip"
+	rejectRate           = "rate"
+)
+
+// PortLimits overrides the server's connection limits for a port forward. A value of 0 means the server's limit (if
+// any) applies, otherwise the lower of the two is used.
+type PortLimits struct {
+	MaxConnections      int     `json:"maxConnections"`
+	MaxConnectionsPerIP int     `json:"maxConnectionsPerIP"`
+	ConnectionRate      float64 `json:"connectionRate"`
+	ConnectionBurst     int     `json:"connectionBurst"`
+}
+
+func (l PortLimits) validate(cfg *config.Config) error {
+	if l.MaxConnections < 0 || l.MaxConnectionsPerIP < 0 || l.ConnectionRate < 0 || l.ConnectionBurst < 0 {
+		return fmt.Errorf("%w (connection limits cannot be negative)", util.ErrBadPort)
+	}
+
+	c := cfg.Webspaces.Ports
+	if c.MaxConnections > 0 && l.MaxConnections > c.MaxConnections {
+		return fmt.Errorf("%w (maxConnections cannot be more than %v)", util.ErrBadPort, c.MaxConnections)
+	}
+	if c.MaxConnectionsPerIP > 0 && l.MaxConnectionsPerIP > c.MaxConnectionsPerIP {
+		return fmt.Errorf("%w (maxConnectionsPerIP cannot be more than %v)", util.ErrBadPort, c.MaxConnectionsPerIP)
+	}
+	if c.ConnectionRate > 0 && l.ConnectionRate > c.ConnectionRate {
+		return fmt.Errorf("%w (connectionRate cannot be more than %v)", util.ErrBadPort, c.ConnectionRate)
+	}
+	if c.ConnectionRate > 0 && c.ConnectionBurst > 0 && l.ConnectionBurst > c.ConnectionBurst {
+		return fmt.Errorf("%w (connectionBurst cannot be more than %v)", util.ErrBadPort, c.ConnectionBurst)
+	}
+
+	return nil
+}
+
+// effective returns the limits which apply given the server's config
+func (l PortLimits) effective(cfg *config.Config) PortLimits {
+	if cfg == nil {
+		return l
+	}
+
+	lower := func(server, override int) int {
+		if server == 0 || (override > 0 && override < server) {
+			return override
+		}
+		return server
+	}
+
+	c := cfg.Webspaces.Ports
+	e := PortLimits{
+		MaxConnections:      lower(c.MaxConnections, l.MaxConnections),
+		MaxConnectionsPerIP: lower(c.MaxConnectionsPerIP, l.MaxConnectionsPerIP),
+		ConnectionRate:      c.ConnectionRate,
+		ConnectionBurst:     lower(c.ConnectionBurst, l.ConnectionBurst),
+	}
+	if c.ConnectionRate == 0 {
+		// The server's burst only means something alongside its rate
+		e.ConnectionRate, e.ConnectionBurst = l.ConnectionRate, l.ConnectionBurst
+	} else if l.ConnectionRate > 0 && l.ConnectionRate < c.ConnectionRate {
+		e.ConnectionRate = l.ConnectionRate
+	}
+
+	return e
+}
+
+// connLimiter enforces concurrent connection and new connection rate limits for a port forward
+type connLimiter struct {
+	sync.Mutex
+	cfg       *config.Config
+	overrides PortLimits
+
+	max      int
+	maxPerIP int
+	rate     *rate.Limiter
+
+	total int
+	perIP map[string]int
+}
+
+func newConnLimiter(cfg *config.Config) *connLimiter {
+	l := &connLimiter{
+		perIP: map[string]int{},
+	}
+	l.configure(cfg)
+
+	return l
+}
+
+// configure applies the server's limits from a config, keeping track of existing connections
+func (l *connLimiter) configure(cfg *config.Config) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.cfg = cfg
+	l.apply()
+}
+
+// override applies a port forward's own limits
+func (l *connLimiter) override(o PortLimits) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.overrides = o
+	l.apply()
+}
+
+func (l *connLimiter) apply() {
+	e := l.overrides.effective(l.cfg)
+
+	l.max, l.maxPerIP, l.rate = e.MaxConnections, e.MaxConnectionsPerIP, nil
+	if e.ConnectionRate > 0 {
+		burst := e.ConnectionBurst
+		if burst < 1 {
+			burst = 1
+		}
+
+		l.rate = rate.NewLimiter(rate.Limit(e.ConnectionRate), burst)
+	}
+}
+
+// acquire reserves a connection slot for a client, returning the reason if the connection should be rejected
+func (l *connLimiter) acquire(ip string) (string, bool) {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.max > 0 && l.total >= l.max {
+		return rejectMaxConnections, false
+	}
+	if l.maxPerIP > 0 && l.perIP[ip] >= l.maxPerIP {
+		return rejectMaxPerIP, false
+	}
+	if l.rate != nil && !l.rate.Allow() {
+		return rejectRate, false
+	}
+
+	l.total++
+	l.perIP[ip]++
+	return "", true
+}
+
+// release frees a connection slot previously reserved with acquire
+func (l *connLimiter) release(ip string) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.total--
+	if l.perIP[ip] <= 1 {
+		delete(l.perIP, ip)
+	} else {
+		l.perIP[ip]--
+	}
+}
@@ -0,0 +1,165 @@
+package webspace
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/netsoc/webspaced/pkg/util"
+)
+
+const (
+	// CertificateReady indicates that a valid certificate covering the domain is in use
+	CertificateReady = "ready"
+	// CertificatePending indicates that a certificate covering the domain hasn't been issued yet
+	CertificatePending = "pending"
+	// CertificateFailed indicates that a certificate covering the domain couldn't be issued
+	CertificateFailed = "failed"
+	// CertificateUnknown indicates that webspaced has no way of knowing the state of the domain's certificate
+	CertificateUnknown = "unknown"
+)
+
+// DomainVerification is the state of a domain's DNS verification
+type DomainVerification struct {
+	Verified bool `json:"verified"`
+	// Pending is true if the domain is waiting to be verified in the background (until Deadline)
+	Pending   bool       `json:"pending"`
+	Deadline  *time.Time `json:"deadline,omitempty"`
+	NextCheck *time.Time `json:"nextCheck,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// DomainRouting is the state of the reverse proxy configuration for a domain
+type DomainRouting struct {
+	Configured bool   `json:"configured"`
+	Running    bool   `json:"running"`
+	Error      string `json:"error,omitempty"`
+}
+
+// CertificateStatus is the state of the TLS certificate for a domain
+type CertificateStatus struct {
+	Source   string     `json:"source"`
+	Status   string     `json:"status"`
+	NotAfter *time.Time `json:"notAfter,omitempty"`
+	Error    string     `json:"error,omitempty"`
+}
+
+// DomainStatus describes whether a webspace domain is working (and if not, why)
+type DomainStatus struct {
+	Domain       string             `json:"domain"`
+	Default      bool               `json:"default"`
+	Verification DomainVerification `json:"verification"`
+	Routing      DomainRouting      `json:"routing"`
+	Certificate  CertificateStatus  `json:"certificate"`
+}
+
+// certificateStatusProvider is implemented by routing providers which can report on the certificates they manage
+type certificateStatusProvider interface {
+	certificateStatus(ctx context.Context, ws *Webspace, domain string) (CertificateStatus, error)
+}
+
+func (w *Webspace) certificateStatus(ctx context.Context, domain string, isDefault bool) (CertificateStatus, error) {
+	n := w.InstanceName()
+
+	switch {
+	case w.Config.SNIPassthrough:
+		// TLS is handled by the webspace itself
+		return CertificateStatus{Source: "passthrough", Status: CertificateUnknown}, nil
+	case isDefault:
+		return CertificateStatus{Source: "default", Status: CertificateUnknown}, nil
+	case w.manager.acme != nil:
+		s := CertificateStatus{Source: "acme", Status: CertificatePending}
+		if c := w.manager.acme.store.get(n); c != nil {
+			for _, d := range c.Domains {
+				if d == domain {
+					s.NotAfter = &c.NotAfter
+					s.Status = CertificateReady
+					if time.Now().After(c.NotAfter) {
+						s.Status = CertificateFailed
+						s.Error = "certificate has expired"
+					}
+					break
+				}
+			}
+		}
+		if err := w.manager.acme.failure(n); err != nil {
+			s.Error = err.Error()
+			if s.Status == CertificatePending {
+				s.Status = CertificateFailed
+			}
+		}
+
+		return s, nil
+	}
+
+	if p, ok := w.manager.routing.(certificateStatusProvider); ok {
+		return p.certificateStatus(ctx, w, domain)
+	}
+
+	// Certificates are obtained by the reverse proxy itself (e.g. a Traefik cert resolver)
+	return CertificateStatus{Source: "provider", Status: CertificateUnknown}, nil
+}
+
+// DomainStatus reports on DNS verification, routing and the TLS certificate for one of a webspace's domains
+func (w *Webspace) DomainStatus(ctx context.Context, domain string) (*DomainStatus, error) {
+	defaultDomain, err := w.DefaultDomain(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &DomainStatus{
+		Domain:  domain,
+		Default: domain == defaultDomain,
+	}
+	pending, isPending := w.PendingDomains[domain]
+	if !s.Default && !isPending {
+		found := false
+		for _, d := range w.Domains {
+			if d == domain {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, util.ErrGenericNotFound
+		}
+	}
+
+	switch {
+	case s.Default:
+		s.Verification.Verified = true
+	case isPending:
+		// Report the background checks' view rather than racing them
+		s.Verification.Pending = true
+		s.Verification.Deadline = &pending.Deadline
+		s.Verification.NextCheck = &pending.NextCheck
+		s.Verification.Error = pending.LastError
+	default:
+		if err := w.verifyDomain(domain); err != nil {
+			s.Verification.Error = err.Error()
+		} else {
+			s.Verification.Verified = true
+		}
+	}
+
+	route, ok, routeErr := w.manager.routes.get(w.UserID)
+	if ok {
+		for _, d := range route.Domains {
+			if d == domain {
+				s.Routing.Configured = true
+				break
+			}
+		}
+		s.Routing.Configured = s.Routing.Configured || s.Default
+		s.Routing.Running = route.Addr != ""
+	}
+	if routeErr != nil {
+		s.Routing.Error = routeErr.Error()
+	}
+
+	if s.Certificate, err = w.certificateStatus(ctx, domain, s.Default); err != nil {
+		return nil, fmt.Errorf("failed to get certificate status: %w", err)
+	}
+
+	return s, nil
+}
@@ -0,0 +1,188 @@
+package webspace
+
+import (
+	"sync"
+	"time"
+
+	lxdApi "github.com/lxc/lxd/shared/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// UsageSample describes a webspace's resource usage at a point in time
+type UsageSample struct {
+	Time time.Time `json:"time"`
+	Usage
+
+	BytesReceived int64 `json:"bytesReceived"`
+	BytesSent     int64 `json:"bytesSent"`
+}
+
+// sampleRing is a fixed size ring buffer of usage samples
+type sampleRing struct {
+	samples []UsageSample
+	next    int
+	full    bool
+}
+
+func (r *sampleRing) add(s UsageSample) {
+	r.samples[r.next] = s
+	r.next = (r.next + 1) % len(r.samples)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// since returns samples taken after t, oldest first
+func (r *sampleRing) since(t time.Time) []UsageSample {
+	ordered := r.samples[:r.next]
+	if r.full {
+		ordered = append(append([]UsageSample{}, r.samples[r.next:]...), r.samples[:r.next]...)
+	}
+
+	samples := []UsageSample{}
+	for _, s := range ordered {
+		if s.Time.After(t) {
+			samples = append(samples, s)
+		}
+	}
+
+	return samples
+}
+
+// usageHistory keeps recent resource usage samples for each webspace
+type usageHistory struct {
+	sync.Mutex
+	size      int
+	webspaces map[int]*sampleRing
+}
+
+func newUsageHistory(size int) *usageHistory {
+	return &usageHistory{
+		size:      size,
+		webspaces: map[int]*sampleRing{},
+	}
+}
+
+func (h *usageHistory) add(uid int, s UsageSample) {
+	h.Lock()
+	defer h.Unlock()
+
+	r, ok := h.webspaces[uid]
+	if !ok {
+		r = &sampleRing{samples: make([]UsageSample, h.size)}
+		h.webspaces[uid] = r
+	}
+	r.add(s)
+}
+
+func (h *usageHistory) since(uid int, t time.Time) []UsageSample {
+	h.Lock()
+	defer h.Unlock()
+
+	r, ok := h.webspaces[uid]
+	if !ok {
+		return []UsageSample{}
+	}
+
+	return r.since(t)
+}
+
+// adopt copies samples from another history (e.g. one belonging to a manager being replaced), keeping only as many as
+// fit in this history
+func (h *usageHistory) adopt(old *usageHistory) {
+	if h.size <= 0 {
+		return
+	}
+
+	old.Lock()
+	samples := make(map[int][]UsageSample, len(old.webspaces))
+	for uid, r := range old.webspaces {
+		samples[uid] = r.since(time.Time{})
+	}
+	old.Unlock()
+
+	for uid, s := range samples {
+		for _, sample := range s {
+			h.add(uid, sample)
+		}
+	}
+}
+
+// trim removes history for webspaces which no longer exist
+func (h *usageHistory) trim(exists map[int]bool) {
+	h.Lock()
+	defer h.Unlock()
+
+	for uid := range h.webspaces {
+		if !exists[uid] {
+			delete(h.webspaces, uid)
+		}
+	}
+}
+
+func sampleFromLXD(ls *lxdApi.InstanceState) UsageSample {
+	s := UsageSample{
+		Time:  time.Now(),
+		Usage: usageFromLXD(ls),
+	}
+
+	for name, info := range ls.Network {
+		if name == "lo" {
+			continue
+		}
+
+		s.BytesReceived += info.Counters.BytesReceived
+		s.BytesSent += info.Counters.BytesSent
+	}
+
+	return s
+}
+
+// UsageHistory returns the webspace's resource usage samples taken after since
+func (w *Webspace) UsageHistory(since time.Time) []UsageSample {
+	return w.manager.history.since(w.UserID, since)
+}
+
+func (m *Manager) sampleUsage() {
+	instances, err := m.lxd.GetInstancesFull(lxdApi.InstanceTypeContainer)
+	if err != nil {
+		log.WithError(convertLXDError(err)).Error("Failed to retrieve LXD instances for usage sampling")
+		return
+	}
+
+	exists := map[int]bool{}
+	for _, i := range instances {
+		if _, ok := i.Config[lxdConfigKey]; !ok {
+			continue
+		}
+
+		w, err := m.instanceToWebspace(&i.Instance)
+		if err != nil {
+			log.WithError(err).WithField("instance", i.Name).Error("Failed to parse webspace for usage sampling")
+			continue
+		}
+		exists[w.UserID] = true
+
+		if i.State == nil || i.State.StatusCode != lxdApi.Running {
+			continue
+		}
+
+		m.history.add(w.UserID, sampleFromLXD(i.State))
+	}
+
+	m.history.trim(exists)
+}
+
+func (m *Manager) usageHistoryLoop() {
+	t := time.NewTicker(m.config.Webspaces.UsageHistory.Interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			m.sampleUsage()
+		case <-m.stop:
+			return
+		}
+	}
+}
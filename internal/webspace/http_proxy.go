@@ -0,0 +1,374 @@
+package webspace
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/netsoc/webspaced/internal/config"
+	"github.com/netsoc/webspaced/pkg/util"
+)
+
+// proxyRoute is where requests for a webspace's domains are sent
+type proxyRoute struct {
+	ws   *Webspace
+	addr string
+
+	// bootMu ensures only one request at a time tries to boot the webspace
+	bootMu sync.Mutex
+}
+
+// backend returns the address requests should be sent to, booting the webspace if necessary
+func (r *proxyRoute) backend(p *BuiltinProxy) (*Webspace, string, error) {
+	p.mu.RLock()
+	ws, addr := r.ws, r.addr
+	p.mu.RUnlock()
+
+	if addr == "" {
+		r.bootMu.Lock()
+		defer r.bootMu.Unlock()
+
+		var err error
+		if addr, err = ws.EnsureStarted(); err != nil {
+			return ws, "", err
+		}
+	} else {
+		ws.manager.idle.touch(ws.UserID)
+	}
+
+	return ws, net.JoinHostPort(addr, strconv.Itoa(int(ws.Config.HTTPPort))), nil
+}
+
+// proxyConnKey is the request context key for a client's connection to the built-in proxy
+type proxyConnKey struct{}
+
+// sameListenAddress returns true if two listen addresses would conflict
+func sameListenAddress(a, b string) bool {
+	aHost, aPort, err := net.SplitHostPort(a)
+	if err != nil {
+		return false
+	}
+	bHost, bPort, err := net.SplitHostPort(b)
+	if err != nil || aPort != bPort {
+		return false
+	}
+
+	unspecified := func(h string) bool {
+		ip := net.ParseIP(h)
+		return h == "" || (ip != nil && ip.IsUnspecified())
+	}
+	return aHost == bHost || unspecified(aHost) || unspecified(bHost)
+}
+
+// BuiltinProxy is a HTTP(S) reverse proxy which routes requests to webspaces by host, booting them on demand
+type BuiltinProxy struct {
+	config *config.Config
+
+	mu        sync.RWMutex
+	routes    map[string]*proxyRoute
+	instances map[string][]string
+
+	tls     *tls.Config
+	static  *tls.Certificate
+	certs   *certStore
+	servers []*http.Server
+}
+
+// NewBuiltinProxy creates a new built-in reverse proxy
+func NewBuiltinProxy(cfg *config.Config) (RoutingProvider, error) {
+	b := cfg.Routing.Builtin
+	for _, addr := range []string{b.HTTPAddress, b.HTTPSAddress} {
+		if addr != "" && sameListenAddress(addr, cfg.HTTP.ListenAddress) {
+			return nil, fmt.Errorf("%w (built-in proxy address %v conflicts with the API's listen address %v)",
+				util.ErrBadValue, addr, cfg.HTTP.ListenAddress)
+		}
+	}
+	if b.HTTPAddress != "" && b.HTTPSAddress != "" && sameListenAddress(b.HTTPAddress, b.HTTPSAddress) {
+		return nil, fmt.Errorf("%w (built-in proxy HTTP and HTTPS addresses conflict)", util.ErrBadValue)
+	}
+
+	p := &BuiltinProxy{
+		config: cfg,
+
+		routes:    map[string]*proxyRoute{},
+		instances: map[string][]string{},
+	}
+
+	if cfg.Routing.Builtin.HTTPSAddress != "" {
+		// Without a static certificate, only domains with a certificate obtained via ACME will work
+		if cfg.Routing.Builtin.CertFile != "" {
+			cert, err := tls.LoadX509KeyPair(cfg.Routing.Builtin.CertFile, cfg.Routing.Builtin.KeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+			}
+			p.static = &cert
+		}
+
+		p.tls = &tls.Config{
+			GetCertificate: p.getCertificate,
+		}
+	}
+
+	return p, nil
+}
+
+func (p *BuiltinProxy) useCertificates(s *certStore) {
+	p.certs = s
+}
+
+// getCertificate picks the certificate for a TLS connection, preferring one obtained via ACME
+func (p *BuiltinProxy) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if p.certs != nil {
+		if cert := p.certs.forHost(hello.ServerName); cert != nil {
+			return cert, nil
+		}
+	}
+	if p.static != nil {
+		return p.static, nil
+	}
+
+	return nil, fmt.Errorf("no certificate for %v", hello.ServerName)
+}
+
+func (p *BuiltinProxy) route(host string) *proxyRoute {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.routes[strings.ToLower(host)]
+}
+
+func (p *BuiltinProxy) errorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	log.WithFields(log.Fields{
+		"host": r.Host,
+		"path": r.URL.Path,
+	}).WithError(err).Debug("Proxied request failed")
+
+	w.WriteHeader(http.StatusBadGateway)
+}
+
+func (p *BuiltinProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if p.certs != nil && isChallenge(r) {
+		p.certs.ServeHTTP(w, r)
+		return
+	}
+
+	if r.TLS == nil && p.tls != nil && p.config.Routing.Builtin.RedirectHTTPS {
+		u := *r.URL
+		u.Scheme = "https"
+		u.Host = r.Host
+		http.Redirect(w, r, u.String(), http.StatusPermanentRedirect)
+		return
+	}
+
+	route := p.route(r.Host)
+	if route == nil {
+		http.Error(w, "No webspace found for this host", http.StatusNotFound)
+		return
+	}
+
+	// Holds the request until the webspace is up
+	ws, backend, err := route.backend(p)
+	if err != nil {
+		log.WithField("uid", ws.UserID).WithError(err).Error("Failed to ensure webspace is booted")
+		http.Error(w, "Failed to start webspace", http.StatusBadGateway)
+		return
+	}
+
+	if r.Header.Get("Upgrade") != "" {
+		// The read timeout would otherwise cut off the upgraded connection
+		if c, ok := r.Context().Value(proxyConnKey{}).(net.Conn); ok {
+			c.SetReadDeadline(time.Time{})
+		}
+	}
+
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+
+	// httputil.ReverseProxy handles protocol upgrades (e.g. WebSockets) on its own
+	proxy := httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			r.URL.Scheme = "http"
+			r.URL.Host = backend
+
+			// We're the front proxy, so clients don't get to set these (X-Forwarded-For is filled in afterwards)
+			r.Header.Del("X-Forwarded-For")
+			r.Header.Set("X-Forwarded-Host", r.Host)
+			r.Header.Set("X-Forwarded-Proto", proto)
+		},
+		ErrorHandler: p.errorHandler,
+	}
+	proxy.ServeHTTP(w, r)
+}
+
+// Start begins listening for requests
+func (p *BuiltinProxy) Start() error {
+	start := func(addr string, tlsConfig *tls.Config) error {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return fmt.Errorf("failed to listen on %v: %w", addr, err)
+		}
+
+		srv := &http.Server{
+			Addr:      addr,
+			Handler:   p,
+			TLSConfig: tlsConfig,
+
+			ReadHeaderTimeout: p.config.Routing.Builtin.ReadHeaderTimeout,
+			ReadTimeout:       p.config.Routing.Builtin.ReadTimeout,
+			IdleTimeout:       p.config.Routing.Builtin.IdleTimeout,
+			ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+				return context.WithValue(ctx, proxyConnKey{}, c)
+			},
+		}
+		p.servers = append(p.servers, srv)
+
+		go func() {
+			var err error
+			if tlsConfig != nil {
+				// Certificates come from the TLS config
+				err = srv.ServeTLS(l, "", "")
+			} else {
+				err = srv.Serve(l)
+			}
+			if !errors.Is(err, http.ErrServerClosed) {
+				log.WithField("address", addr).WithError(err).Error("Built-in proxy server failed")
+			}
+		}()
+
+		return nil
+	}
+
+	if p.config.Routing.Builtin.HTTPAddress != "" {
+		if err := start(p.config.Routing.Builtin.HTTPAddress, nil); err != nil {
+			return err
+		}
+	}
+	if p.tls != nil {
+		if err := start(p.config.Routing.Builtin.HTTPSAddress, p.tls); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Shutdown stops listening, waiting for in-flight requests to complete
+func (p *BuiltinProxy) Shutdown(ctx context.Context) error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(p.servers))
+	for i, srv := range p.servers {
+		i, srv := i, srv
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = srv.Shutdown(ctx)
+		}()
+	}
+	wg.Wait()
+
+	var msgs []string
+	for i, err := range errs {
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("%v: %v", p.servers[i].Addr, err))
+		}
+	}
+	if len(msgs) > 0 {
+		return fmt.Errorf("failed to shut down built-in proxy servers: %v", strings.Join(msgs, ", "))
+	}
+
+	return nil
+}
+
+// ClearAll cleans all configuration for all instances
+func (p *BuiltinProxy) ClearAll(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.routes = map[string]*proxyRoute{}
+	p.instances = map[string][]string{}
+	return nil
+}
+
+// Instances returns the names of all instances which have configuration
+func (p *BuiltinProxy) Instances(ctx context.Context) ([]string, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	instances := make(map[string]struct{}, len(p.instances))
+	for n := range p.instances {
+		instances[n] = struct{}{}
+	}
+
+	return sortedInstances(instances), nil
+}
+
+func (p *BuiltinProxy) clear(n string) {
+	for _, h := range p.instances[n] {
+		delete(p.routes, h)
+	}
+	delete(p.instances, n)
+}
+
+// ClearConfig cleans out any configuration for an instance
+func (p *BuiltinProxy) ClearConfig(ctx context.Context, n string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.clear(n)
+	return nil
+}
+
+// GenerateConfig updates the routes for a webspace
+func (p *BuiltinProxy) GenerateConfig(ctx context.Context, ws *Webspace, addr string) error {
+	n := ws.InstanceName()
+
+	if ws.Config.SNIPassthrough {
+		return fmt.Errorf("%w (SNI passthrough is not supported by the built-in proxy)", util.ErrBadValue)
+	}
+
+	domains, err := ws.GetDomains(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get webspace domains: %w", err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// Keep the existing route (if there is one) so requests waiting on a boot aren't disturbed
+	var route *proxyRoute
+	if hosts := p.instances[n]; len(hosts) > 0 {
+		route = p.routes[hosts[0]]
+	}
+	if route == nil {
+		route = &proxyRoute{}
+	}
+	route.ws = ws
+	route.addr = addr
+
+	p.clear(n)
+	hosts := make([]string, len(domains))
+	for i, d := range domains {
+		hosts[i] = strings.ToLower(d)
+		p.routes[hosts[i]] = route
+	}
+	p.instances[n] = hosts
+
+	return nil
+}
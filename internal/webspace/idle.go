@@ -0,0 +1,148 @@
+package webspace
+
+import (
+	"sync"
+	"time"
+
+	lxdApi "github.com/lxc/lxd/shared/api"
+	log "github.com/sirupsen/logrus"
+)
+
+type activity struct {
+	last time.Time
+	rx   int64
+}
+
+// idleTracker keeps track of the last activity for each running webspace
+type idleTracker struct {
+	sync.Mutex
+	webspaces map[int]*activity
+}
+
+func newIdleTracker() *idleTracker {
+	return &idleTracker{
+		webspaces: map[int]*activity{},
+	}
+}
+
+// touch marks a webspace as having been active just now
+func (t *idleTracker) touch(uid int) {
+	t.Lock()
+	defer t.Unlock()
+
+	a, ok := t.webspaces[uid]
+	if !ok {
+		a = &activity{}
+		t.webspaces[uid] = a
+	}
+	a.last = time.Now()
+}
+
+// update records the current received byte count for a webspace, treating it as activity if the difference exceeds
+// the threshold
+func (t *idleTracker) update(uid int, rx int64, threshold int64) time.Time {
+	t.Lock()
+	defer t.Unlock()
+
+	a, ok := t.webspaces[uid]
+	if !ok {
+		// First time we've seen this webspace running, start counting from now
+		a = &activity{last: time.Now(), rx: rx}
+		t.webspaces[uid] = a
+	}
+
+	if threshold > 0 && rx-a.rx >= threshold {
+		a.last = time.Now()
+	}
+	a.rx = rx
+
+	return a.last
+}
+
+func (t *idleTracker) forget(uid int) {
+	t.Lock()
+	defer t.Unlock()
+
+	delete(t.webspaces, uid)
+}
+
+// IdleTimeout returns the effective idle timeout for the webspace (0 means the webspace should never be shut down)
+func (w *Webspace) IdleTimeout() time.Duration {
+	if w.Config.IdleTimeout > 0 {
+		return time.Duration(w.Config.IdleTimeout * float64(time.Second))
+	}
+
+	return w.manager.config.Webspaces.IdleTimeout
+}
+
+func receivedBytes(state *lxdApi.InstanceState) int64 {
+	var rx int64
+	for name, info := range state.Network {
+		if name == "lo" {
+			continue
+		}
+
+		rx += info.Counters.BytesReceived
+	}
+
+	return rx
+}
+
+func (m *Manager) checkIdle() {
+	webspaces, err := m.GetAll()
+	if err != nil {
+		log.WithError(err).Error("Failed to retrieve webspaces for idle check")
+		return
+	}
+
+	for _, w := range webspaces {
+		state, _, err := m.lxd.GetInstanceState(w.InstanceName())
+		if err != nil {
+			log.WithError(convertLXDError(err)).WithField("uid", w.UserID).Error("Failed to retrieve LXD instance state")
+			continue
+		}
+
+		if state.StatusCode != lxdApi.Running {
+			m.idle.forget(w.UserID)
+			continue
+		}
+
+		last := m.idle.update(w.UserID, receivedBytes(state), m.config.Webspaces.IdleTrafficThreshold)
+		if m.ports.ActiveConnections(w) > 0 {
+			m.idle.touch(w.UserID)
+			continue
+		}
+
+		timeout := w.IdleTimeout()
+		if timeout == 0 || time.Since(last) < timeout {
+			continue
+		}
+
+		log.WithFields(log.Fields{
+			"uid":     w.UserID,
+			"idleFor": time.Since(last),
+		}).Info("Shutting down idle webspace")
+
+		m.Lock(w.UserID)
+		if err := w.Shutdown(); err != nil {
+			log.WithError(err).WithField("uid", w.UserID).Error("Failed to shut down idle webspace")
+		} else {
+			m.idle.forget(w.UserID)
+		}
+		m.Unlock(w.UserID)
+	}
+}
+
+func (m *Manager) idleLoop() {
+	t := time.NewTicker(m.config.Webspaces.IdleCheckInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			m.checkIdle()
+		case <-m.stop:
+			return
+		}
+	}
+}
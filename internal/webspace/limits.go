@@ -0,0 +1,102 @@
+package webspace
+
+import (
+	"fmt"
+	"strconv"
+
+	lxdApi "github.com/lxc/lxd/shared/api"
+	"github.com/netsoc/webspaced/internal/config"
+	"github.com/netsoc/webspaced/pkg/util"
+)
+
+// EffectiveLimits returns the webspace's resource limits, taking into account the global defaults
+func (w *Webspace) EffectiveLimits() config.ResourceLimits {
+	l := w.Limits
+	d := w.manager.config.Webspaces.Limits.Defaults
+
+	if l.CPU == 0 {
+		l.CPU = d.CPU
+	}
+	if l.Memory == 0 {
+		l.Memory = d.Memory
+	}
+	if l.Disk == 0 {
+		l.Disk = d.Disk
+	}
+	if l.Processes == 0 {
+		l.Processes = d.Processes
+	}
+	if l.Traffic == 0 {
+		l.Traffic = d.Traffic
+	}
+
+	return l
+}
+
+func (w *Webspace) checkLimits() error {
+	l := w.Limits
+	max := w.manager.config.Webspaces.Limits.Max
+
+	if max.CPU != 0 && l.CPU > max.CPU {
+		return fmt.Errorf("%w (CPU limit cannot be more than %v)", util.ErrBadValue, max.CPU)
+	}
+	if max.Memory != 0 && l.Memory > max.Memory {
+		return fmt.Errorf("%w (memory limit cannot be more than %v bytes)", util.ErrBadValue, max.Memory)
+	}
+	if max.Disk != 0 && l.Disk > max.Disk {
+		return fmt.Errorf("%w (disk limit cannot be more than %v bytes)", util.ErrBadValue, max.Disk)
+	}
+	if max.Processes != 0 && l.Processes > max.Processes {
+		return fmt.Errorf("%w (process limit cannot be more than %v)", util.ErrBadValue, max.Processes)
+	}
+	if max.Traffic != 0 && l.Traffic > max.Traffic {
+		return fmt.Errorf("%w (traffic limit cannot be more than %v bytes)", util.ErrBadValue, max.Traffic)
+	}
+	if l.Memory < 0 || l.Disk < 0 || l.Traffic < 0 {
+		return util.ErrBadValue
+	}
+
+	return nil
+}
+
+func setLimit(conf map[string]string, key string, value int64) {
+	if value == 0 {
+		delete(conf, key)
+		return
+	}
+
+	conf[key] = strconv.FormatInt(value, 10)
+}
+
+// applyLimits sets the LXD config keys and devices needed to enforce the webspace's resource limits
+func (w *Webspace) applyLimits(i *lxdApi.Instance) {
+	l := w.EffectiveLimits()
+
+	if i.Config == nil {
+		i.Config = map[string]string{}
+	}
+	setLimit(i.Config, "limits.cpu", int64(l.CPU))
+	setLimit(i.Config, "limits.memory", int64(l.Memory))
+	setLimit(i.Config, "limits.processes", int64(l.Processes))
+
+	if i.Devices == nil {
+		i.Devices = map[string]map[string]string{}
+	}
+	if l.Disk == 0 {
+		delete(i.Devices, "root")
+		return
+	}
+
+	// Override the profile's root disk with our own size
+	root := map[string]string{
+		"type": "disk",
+		"path": "/",
+	}
+	if expanded, ok := i.ExpandedDevices["root"]; ok {
+		for k, v := range expanded {
+			root[k] = v
+		}
+	}
+	root["size"] = strconv.FormatInt(int64(l.Disk), 10)
+	i.Devices["root"] = root
+}
@@ -0,0 +1,105 @@
+package webspace
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	lxdApi "github.com/lxc/lxd/shared/api"
+	iam "github.com/netsoc/iam/client"
+)
+
+// Summary describes a webspace along with its owner and current state
+type Summary struct {
+	Webspace
+
+	Owner   string `json:"owner"`
+	Running bool   `json:"running"`
+	Usage   Usage  `json:"usage"`
+}
+
+// MarshalJSON serializes the summary (Webspace's MarshalJSON would otherwise be used, leaving out the other fields)
+func (s Summary) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		webspaceJSON
+
+		Owner   string `json:"owner"`
+		Running bool   `json:"running"`
+		Usage   Usage  `json:"usage"`
+	}{s.Webspace.toJSON(), s.Owner, s.Running, s.Usage})
+}
+
+// ListOptions filters and paginates the list of webspaces
+type ListOptions struct {
+	// Running only includes webspaces in the given state (nil means all)
+	Running *bool
+	Offset  int
+	// Limit is the maximum number of webspaces to return (0 means no limit)
+	Limit int
+}
+
+// List retrieves a summary of all webspaces, along with the total number matching the filter
+func (m *Manager) List(ctx context.Context, opts ListOptions) ([]Summary, int, error) {
+	instances, err := m.lxd.GetInstancesFull(lxdApi.InstanceTypeContainer)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to retrieve LXD instances: %w", convertLXDError(err))
+	}
+
+	var summaries []Summary
+	for _, i := range instances {
+		if _, ok := i.Config[lxdConfigKey]; !ok {
+			continue
+		}
+
+		w, err := m.instanceToWebspace(&i.Instance)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		s := Summary{
+			Webspace: *w,
+			Usage: Usage{
+				Disks: map[string]int64{},
+			},
+		}
+		if i.State != nil {
+			s.Running = i.State.StatusCode == lxdApi.Running
+			s.Usage = usageFromLXD(i.State)
+		}
+		if opts.Running != nil && s.Running != *opts.Running {
+			continue
+		}
+
+		summaries = append(summaries, s)
+	}
+
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].UserID < summaries[j].UserID
+	})
+
+	total := len(summaries)
+	if opts.Offset > total {
+		opts.Offset = total
+	}
+	summaries = summaries[opts.Offset:]
+	if opts.Limit > 0 && opts.Limit < len(summaries) {
+		summaries = summaries[:opts.Limit]
+	}
+
+	ctx = context.WithValue(ctx, iam.ContextAccessToken, m.config.IAM.Token)
+	users, _, err := m.iam.UsersApi.GetUsers(ctx)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to retrieve users: %w", err)
+	}
+
+	usernames := make(map[int]string, len(users))
+	for _, u := range users {
+		usernames[int(u.Id)] = u.Username
+	}
+	for i := range summaries {
+		summaries[i].Owner = usernames[summaries[i].UserID]
+	}
+
+	return summaries, total, nil
+}
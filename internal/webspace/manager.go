@@ -15,7 +15,9 @@ import (
 	lxdApi "github.com/lxc/lxd/shared/api"
 	iam "github.com/netsoc/iam/client"
 	"github.com/netsoc/webspaced/internal/config"
+	"github.com/netsoc/webspaced/internal/metrics"
 	"github.com/netsoc/webspaced/pkg/util"
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -29,26 +31,72 @@ type Manager struct {
 	lxdListener    *lxd.EventListener
 	lxdLastEvent   time.Time
 	lxdOK          bool
+	// lxdHandlers is held (for reading) by LXD event handlers so shutdown can wait for them to finish
+	lxdHandlers sync.RWMutex
 
 	locks   sync.Map
-	traefik Traefik
+	routing RoutingProvider
+	routes  *routeTracker
 	ports   *PortsManager
+	idle    *idleTracker
+	history *usageHistory
+	traffic *trafficTracker
+	acme    *acmeManager
+
+	stop chan struct{}
 }
 
 // NewManager returns a new Manager instance
 func NewManager(cfg *config.Config, iam *iam.APIClient, l lxd.InstanceServer) (*Manager, error) {
-	var traefik Traefik
+	var routing RoutingProvider
 	var err error
-	switch cfg.Traefik.Provider {
+	switch cfg.Routing.Provider {
 	case "kubernetes":
-		traefik, err = NewTraefikKubernetes(cfg)
+		routing, err = NewTraefikKubernetes(cfg)
 	case "redis", "":
-		traefik = NewTraefikRedis(cfg)
+		routing = NewTraefikRedis(cfg)
+	case "file":
+		routing, err = NewTraefikFile(cfg)
+	case "caddy":
+		routing, err = NewCaddy(cfg)
+	case "builtin":
+		routing, err = NewBuiltinProxy(cfg)
 	default:
-		return nil, util.ErrTraefikProvider
+		return nil, util.ErrRoutingProvider
 	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to initializae Traefik config provider %v: %w", cfg.Traefik.Provider, err)
+		return nil, fmt.Errorf("failed to initialize routing provider %v: %w", cfg.Routing.Provider, err)
+	}
+
+	var acme *acmeManager
+	if cfg.Routing.ACME.DirectoryURL != "" {
+		if consumer, ok := routing.(certificateConsumer); ok {
+			if acme, err = newACMEManager(cfg); err != nil {
+				return nil, fmt.Errorf("failed to initialize ACME manager: %w", err)
+			}
+			consumer.useCertificates(acme.store)
+		} else {
+			// Only the file and builtin providers use webspaced's ACME certificates, the others obtain their own. Custom
+			// domains would be left without certificates if that isn't set up.
+			var missing string
+			switch routing.(type) {
+			case *TraefikRedis:
+				if cfg.Routing.Redis.CertResolver == "" {
+					missing = "routing.redis.cert_resolver"
+				}
+			case *TraefikKubernetes:
+				if cfg.Routing.Kubernetes.ClusterIssuer == "" {
+					missing = "routing.kubernetes.cluster_issuer"
+				}
+			}
+			if missing != "" {
+				return nil, fmt.Errorf("%w (routing provider %v doesn't use ACME certificates, %v must be set instead)",
+					util.ErrBadValue, cfg.Routing.Provider, missing)
+			}
+
+			log.WithField("provider", cfg.Routing.Provider).
+				Warn("Routing provider obtains its own certificates, ignoring ACME configuration")
+		}
 	}
 
 	ports, err := NewPortsManager(cfg)
@@ -63,8 +111,15 @@ func NewManager(cfg *config.Config, iam *iam.APIClient, l lxd.InstanceServer) (*
 
 		lxdWsUserRegex: regexp.MustCompile(fmt.Sprintf(lxdEventUserRegexTpl, cfg.Webspaces.InstancePrefix)),
 		lxdListener:    nil,
-		traefik:        traefik,
+		routing:        routing,
+		routes:         newRouteTracker(),
 		ports:          ports,
+		idle:           newIdleTracker(),
+		history:        newUsageHistory(cfg.Webspaces.UsageHistory.Samples),
+		traffic:        newTrafficTracker(),
+		acme:           acme,
+
+		stop: make(chan struct{}),
 	}, nil
 }
 
@@ -95,10 +150,33 @@ func (m *Manager) Unlock(uid int) {
 	v.(*sync.Mutex).Unlock()
 }
 
-func (m *Manager) syncAll(ctx context.Context) error {
-	log.Debug("Clearing all existing Traefik configs")
-	m.traefik.ClearAll(ctx)
+// pruneRouting clears the routing configuration for any instances which aren't in existing (i.e. webspaces which have
+// been deleted)
+func (m *Manager) pruneRouting(ctx context.Context, existing map[string]struct{}) error {
+	instances, err := m.routing.Instances(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list routing configs: %w", err)
+	}
 
+	for _, n := range instances {
+		if _, ok := existing[n]; ok {
+			continue
+		}
+
+		log.WithField("instance", n).Debug("Removing routing config for deleted webspace")
+		if err := m.routing.ClearConfig(ctx, n); err != nil {
+			return fmt.Errorf("failed to clear routing config for %v: %w", n, err)
+		}
+	}
+
+	return nil
+}
+
+// syncAll brings the routing and port forwarding configuration for all webspaces in line with their state, updating
+// existing configuration in place (so routes stay up) and removing any left over from deleted webspaces. Like the
+// reconcile loop, only configuration which doesn't match what was last applied is pushed (e.g. changes missed while
+// the LXD listener was disconnected).
+func (m *Manager) syncAll(ctx context.Context) error {
 	webspaces, err := m.GetAll()
 	if err != nil {
 		return fmt.Errorf("failed to retrieve all webspaces: %w", err)
@@ -107,8 +185,11 @@ func (m *Manager) syncAll(ctx context.Context) error {
 		return fmt.Errorf("failed to trim port forwards: %w", err)
 	}
 
+	existing := make(map[string]struct{}, len(webspaces))
 	var wg sync.WaitGroup
 	for _, w := range webspaces {
+		existing[w.InstanceName()] = struct{}{}
+
 		state, _, err := m.lxd.GetInstanceState(w.InstanceName())
 		if err != nil {
 			return fmt.Errorf("failed to retrieve LXD instance state: %w", convertLXDError(err))
@@ -118,7 +199,7 @@ func (m *Manager) syncAll(ctx context.Context) error {
 		log.WithFields(log.Fields{
 			"uid":     w.UserID,
 			"running": running,
-		}).Debug("Syncing Traefik / port forwarding config")
+		}).Debug("Syncing routing / port forwarding config")
 
 		wg.Add(1)
 		ws := w
@@ -133,18 +214,7 @@ func (m *Manager) syncAll(ctx context.Context) error {
 					}
 				}
 
-				if err := m.traefik.ClearConfig(ctx, ws.InstanceName()); err != nil {
-					return fmt.Errorf("failed to clear traefik config: %w", err)
-				}
-				if err := m.traefik.GenerateConfig(ctx, ws, addr); err != nil {
-					return fmt.Errorf("failed to update traefik config: %w", err)
-				}
-
-				if err := m.ports.AddAll(ctx, ws, addr); err != nil {
-					return fmt.Errorf("failed to set up port forwards: %w", err)
-				}
-
-				return nil
+				return m.applyConfig(ctx, ws, addr, false)
 			}(); err != nil {
 				log.
 					WithError(err).
@@ -155,14 +225,20 @@ func (m *Manager) syncAll(ctx context.Context) error {
 	}
 	wg.Wait()
 
-	return nil
+	for _, uid := range m.routes.uids() {
+		if _, ok := existing[m.lxdInstanceName(uid)]; !ok {
+			m.routes.forget(uid)
+		}
+	}
+
+	return m.pruneRouting(ctx, existing)
 }
 
 // Start starts the webspace manager
 func (m *Manager) Start(ctx context.Context) error {
-	log.Info("Generating initial Traefik / port forwarding configs")
+	log.Info("Generating initial routing / port forwarding configs")
 	if err := m.syncAll(ctx); err != nil {
-		return fmt.Errorf("failed to sync Traefik / port forwarding configs: %w", err)
+		return fmt.Errorf("failed to sync routing / port forwarding configs: %w", err)
 	}
 
 	if err := m.setupLXDListener(); err != nil {
@@ -170,12 +246,28 @@ func (m *Manager) Start(ctx context.Context) error {
 	}
 	m.lxdOK = true
 
+	if err := prometheus.Register(usageCollector{m}); err != nil {
+		return fmt.Errorf("failed to register webspace metrics collector: %w", err)
+	}
+
+	if s, ok := m.routing.(routingServer); ok {
+		if err := s.Start(); err != nil {
+			return fmt.Errorf("failed to start routing provider: %w", err)
+		}
+	}
+
 	go func() {
 		back := backoff.NewExponentialBackOff()
 		back.MaxElapsedTime = 0
 
 		for {
 			if err := m.lxdListener.Wait(); err != nil {
+				select {
+				case <-m.stop:
+					return
+				default:
+				}
+
 				log.
 					WithError(err).
 					Warn("LXD event listener failed, restarting...")
@@ -190,6 +282,7 @@ func (m *Manager) Start(ctx context.Context) error {
 						Warn("LXD event listener reconnect failed, retrying...")
 				})
 				log.Info("LXD listener reconnect succeeded")
+				metrics.LXDReconnects.Inc()
 
 				log.Info("Re-syncing all configs after listener reconnect")
 				back.Reset()
@@ -212,6 +305,28 @@ func (m *Manager) Start(ctx context.Context) error {
 		}
 	}()
 
+	if m.config.Webspaces.IdleCheckInterval > 0 {
+		go m.idleLoop()
+	}
+	if m.config.Webspaces.UsageHistory.Interval > 0 && m.config.Webspaces.UsageHistory.Samples > 0 {
+		go m.usageHistoryLoop()
+	}
+	if m.config.Webspaces.Snapshots.CheckInterval > 0 {
+		go m.autoSnapshotLoop()
+	}
+	if m.config.Webspaces.Ports.TrafficFlushInterval > 0 {
+		go m.trafficLoop()
+	}
+	if m.config.Webspaces.ResyncInterval > 0 {
+		go m.reconcileLoop()
+	}
+	if m.config.Webspaces.DomainVerification.Timeout > 0 && m.config.Webspaces.DomainVerification.CheckInterval > 0 {
+		go m.pendingDomainsLoop()
+	}
+	if m.acme != nil && m.config.Routing.ACME.CheckInterval > 0 {
+		go m.acmeLoop()
+	}
+
 	return nil
 }
 
@@ -222,14 +337,86 @@ func (m *Manager) Healthy() bool {
 
 // Shutdown stops the webspace manager
 func (m *Manager) Shutdown(ctx context.Context) {
+	m.shutdown(ctx, false)
+}
+
+// Handoff holds state passed from one manager to another (e.g. across a config reload)
+type Handoff struct {
+	ports   PortHandoff
+	history *usageHistory
+	traffic *trafficTracker
+}
+
+// Handoff stops the webspace manager, leaving port forwards running so they can be adopted by a new manager (see
+// Adopt)
+func (m *Manager) Handoff(ctx context.Context) *Handoff {
+	return &Handoff{
+		ports:   m.shutdown(ctx, true),
+		history: m.history,
+		traffic: m.traffic,
+	}
+}
+
+// Stop stops the port forwards in a handoff which won't be adopted (e.g. because the new manager couldn't be created)
+func (h *Handoff) Stop() {
+	if h == nil {
+		return
+	}
+
+	for _, f := range h.ports {
+		f.Stop()
+	}
+}
+
+// Adopt takes over port forwards, traffic counters and usage history handed off by a previous manager, should be
+// called before Start
+func (m *Manager) Adopt(h *Handoff) {
+	if h == nil {
+		return
+	}
+
+	// Keep counting in the same tracker so that traffic forwarded during the handoff isn't lost
+	m.traffic = h.traffic
+
+	// The forwards' hooks belong to the old manager (whose LXD connection is closed) until they're replaced by syncing
+	m.ports.Adopt(h.ports, m.adoptedPortHook, func(f *PortForward, t PortTraffic) {
+		m.traffic.add(f.owner, f.ePort, t)
+	})
+	m.history.adopt(h.history)
+}
+
+func (m *Manager) shutdown(ctx context.Context, handoff bool) PortHandoff {
+	close(m.stop)
+	prometheus.Unregister(usageCollector{m})
+
 	if m.lxdListener != nil {
 		m.lxdListener.Disconnect()
 	}
-	m.ports.Shutdown(ctx)
+	// Event handlers could otherwise add port forwards after they've been detached
+	m.lxdHandlers.Lock()
+	m.lxdHandlers.Unlock()
+
+	var h PortHandoff
+	if handoff {
+		h = m.ports.Detach()
+	} else {
+		m.ports.Shutdown(ctx)
+	}
+	m.flushTraffic()
 
-	if err := m.traefik.ClearAll(ctx); err != nil {
-		log.WithError(err).Warn("Failed to clear Traefik configs")
+	if s, ok := m.routing.(routingServer); ok {
+		if err := s.Shutdown(ctx); err != nil {
+			log.WithError(err).Warn("Failed to shut down routing provider")
+		}
+	}
+	if !handoff {
+		// The next manager updates the existing configuration in place, so it's only cleared when we're stopping
+		if err := m.routing.ClearAll(ctx); err != nil {
+			log.WithError(err).Warn("Failed to clear routing configs")
+		}
 	}
+
+	return h
 }
 
 func (m *Manager) lxdInstanceName(uid int) string {
@@ -242,6 +429,14 @@ type lxdEventDetails struct {
 }
 
 func (m *Manager) onLxdEvent(e lxdApi.Event) {
+	m.lxdHandlers.RLock()
+	defer m.lxdHandlers.RUnlock()
+	select {
+	case <-m.stop:
+		return
+	default:
+	}
+
 	if e.Timestamp == m.lxdLastEvent {
 		// TODO: Why does this happen?
 		log.Warn("Duplicate LXD event detected, ignoring")
@@ -266,6 +461,12 @@ func (m *Manager) onLxdEvent(e lxdApi.Event) {
 		return
 	}
 
+	if a := lxdEventActionRegex.FindStringSubmatch(details.Action); len(a) != 0 && a[1] == "updated" &&
+		m.traffic.takeSave(uid) {
+		// Only the port forwarding traffic counters changed
+		return
+	}
+
 	ctx := context.Background()
 	m.Lock(uid)
 	defer m.Unlock(uid)
@@ -287,6 +488,11 @@ func (m *Manager) onLxdEvent(e lxdApi.Event) {
 	action := match[1]
 
 	if action == "deleted" {
+		if err := m.routing.ClearConfig(ctx, m.lxdInstanceName(uid)); err != nil {
+			log.WithField("uid", uid).WithError(err).Error("Failed to clear routing config")
+			return
+		}
+		m.routes.forget(uid)
 		return
 	}
 
@@ -331,20 +537,10 @@ func (m *Manager) onLxdEvent(e lxdApi.Event) {
 		"uid":     w.UserID,
 		"running": running,
 		"action":  action,
-	}).Debug("Updating Traefik / port forward config")
+	}).Debug("Updating routing / port forward config")
 
-	if err := m.traefik.ClearConfig(ctx, m.lxdInstanceName(uid)); err != nil {
-		log.WithField("uid", uid).WithError(err).Error("Failed to clear Traefik config")
-		return
-	}
-
-	if err := m.traefik.GenerateConfig(ctx, w, addr); err != nil {
-		log.WithField("user", w.UserID).WithError(err).Error("Failed to update Traefik config")
-		return
-	}
-
-	if err := m.ports.AddAll(ctx, w, addr); err != nil {
-		log.WithField("user", w.UserID).WithError(err).Error("Failed to update port forwards")
+	if err := m.applyConfig(ctx, w, addr, false); err != nil {
+		log.WithField("user", w.UserID).WithError(err).Error("Failed to update routing / port forward config")
 	}
 }
 
@@ -364,6 +560,7 @@ func (m *Manager) instanceToWebspace(i *lxdApi.Instance) (*Webspace, error) {
 	if w.Config.StartupDelay < 0 {
 		return nil, util.ErrBadValue
 	}
+	m.traffic.load(w.UserID, i.Config[lxdTrafficKey])
 
 	return w, nil
 }
@@ -425,12 +622,17 @@ func (m *Manager) Get(uid int, userHint *iam.User) (*Webspace, error) {
 	}
 	n := w.InstanceName()
 
-	i, _, err := m.lxd.GetInstance(n)
+	i, etag, err := m.lxd.GetInstance(n)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get LXD instance: %w", convertLXDError(err))
 	}
 
-	return m.instanceToWebspace(i)
+	if w, err = m.instanceToWebspace(i); err != nil {
+		return nil, err
+	}
+	w.etag = etag
+
+	return w, nil
 }
 
 // GetAll retrieves all the webspaces
@@ -466,7 +668,7 @@ func (m *Manager) Create(uid int, image string, password string, sshKey string)
 		UserID:  uid,
 		Config:  m.config.Webspaces.ConfigDefaults,
 		Domains: []string{},
-		Ports:   map[uint16]uint16{},
+		Ports:   map[uint16]PortMapping{},
 	}
 	n := w.InstanceName()
 
@@ -507,6 +709,11 @@ func (m *Manager) Create(uid int, image string, password string, sshKey string)
 		return nil, fmt.Errorf("failed to create LXD instance: %w", convertLXDError(err))
 	}
 
+	// Apply resource limits
+	if err := w.Save(); err != nil {
+		return nil, err
+	}
+
 	if password != "" || sshKey != "" {
 		if _, err := w.EnsureStarted(); err != nil {
 			return nil, err
@@ -563,7 +770,11 @@ func (m *Manager) Create(uid int, image string, password string, sshKey string)
 					return nil, fmt.Errorf("failed to store ssh public key: %w", err)
 				}
 
-				if _, err := w.AddPort(0, 22); err != nil {
+				// The webspace is already locked
+				if _, err := w.addPort(0, PortMapping{Port: 22, Protocol: ProtocolTCP}); err != nil {
+					return nil, fmt.Errorf("failed to add SSH port forward: %w", err)
+				}
+				if err := w.Save(); err != nil {
 					return nil, fmt.Errorf("failed to add SSH port forward: %w", err)
 				}
 			}
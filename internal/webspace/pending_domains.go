@@ -0,0 +1,175 @@
+package webspace
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/netsoc/webspaced/pkg/util"
+)
+
+// PendingDomain is a custom domain which couldn't be verified when it was added
+type PendingDomain struct {
+	Added    time.Time `json:"added"`
+	Deadline time.Time `json:"deadline"`
+
+	NextCheck time.Time `json:"nextCheck"`
+	Attempts  int       `json:"attempts"`
+	// LastError is the reason the most recent verification attempt failed
+	LastError string `json:"lastError"`
+}
+
+// PendingDomainNames returns the names of the webspace's pending domains (sorted)
+func (w *Webspace) PendingDomainNames() []string {
+	names := make([]string, 0, len(w.PendingDomains))
+	for d := range w.PendingDomains {
+		names = append(names, d)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// checkDomainUnused returns util.ErrUsed if any webspace already has a domain (pending domains don't count, so
+// someone who doesn't own a domain can't hold it hostage)
+func (m *Manager) checkDomainUnused(domain string) error {
+	webspaces, err := m.GetAll()
+	if err != nil {
+		return err
+	}
+
+	for _, w := range webspaces {
+		for _, d := range w.Domains {
+			if d == domain {
+				return util.ErrUsed
+			}
+		}
+	}
+
+	return nil
+}
+
+// pendingDomainRetry returns how long to wait before checking a pending domain again
+func (m *Manager) pendingDomainRetry(attempts int) time.Duration {
+	cfg := m.config.Webspaces.DomainVerification
+
+	d := cfg.CheckInterval
+	for i := 0; i < attempts && (cfg.MaxInterval == 0 || d < cfg.MaxInterval); i++ {
+		d *= 2
+	}
+	if cfg.MaxInterval != 0 && d > cfg.MaxInterval {
+		d = cfg.MaxInterval
+	}
+
+	return d
+}
+
+// checkPendingDomains re-checks any of a webspace's pending domains which are due, activating those which are now
+// verified and dropping those which have passed their deadline
+func (m *Manager) checkPendingDomains(uid int) error {
+	m.Lock(uid)
+	defer m.Unlock(uid)
+
+	w, err := m.Get(uid, nil)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve webspace: %w", err)
+	}
+
+	now := time.Now()
+	changed, activated := false, false
+	for _, d := range w.PendingDomainNames() {
+		p := w.PendingDomains[d]
+		if now.Before(p.NextCheck) {
+			continue
+		}
+		changed = true
+
+		l := log.WithFields(log.Fields{
+			"uid":    uid,
+			"domain": d,
+		})
+
+		verifyErr := w.verifyDomain(d)
+		if verifyErr == nil {
+			delete(w.PendingDomains, d)
+
+			if err := m.checkDomainUnused(d); err != nil {
+				if !errors.Is(err, util.ErrUsed) {
+					return err
+				}
+
+				l.Warn("Verified pending domain is already in use by another webspace, dropping")
+				continue
+			}
+
+			l.Info("Pending domain verified, activating")
+			w.Domains = append(w.Domains, d)
+			activated = true
+			continue
+		}
+
+		if now.After(p.Deadline) {
+			l.WithError(verifyErr).Info("Pending domain wasn't verified before its deadline, dropping")
+			delete(w.PendingDomains, d)
+			continue
+		}
+
+		p.Attempts++
+		p.LastError = verifyErr.Error()
+		p.NextCheck = now.Add(m.pendingDomainRetry(p.Attempts))
+		l.WithError(verifyErr).WithField("nextCheck", p.NextCheck).Debug("Pending domain still unverified")
+	}
+	if !changed {
+		return nil
+	}
+
+	// The webspace might have been updated by the API while we were checking (checks can take a while)
+	if err := w.saveUnchanged(); err != nil {
+		if errors.Is(err, util.ErrChanged) {
+			log.WithField("uid", uid).Debug("Webspace changed while checking pending domains, will retry")
+			return nil
+		}
+
+		return err
+	}
+	if activated {
+		m.requestCertificates()
+	}
+
+	return nil
+}
+
+func (m *Manager) checkAllPendingDomains() {
+	webspaces, err := m.GetAll()
+	if err != nil {
+		log.WithError(err).Error("Failed to retrieve webspaces for pending domain checks")
+		return
+	}
+
+	for _, w := range webspaces {
+		if len(w.PendingDomains) == 0 {
+			continue
+		}
+
+		if err := m.checkPendingDomains(w.UserID); err != nil {
+			log.WithError(err).WithField("uid", w.UserID).Error("Failed to check pending domains")
+		}
+	}
+}
+
+func (m *Manager) pendingDomainsLoop() {
+	t := time.NewTicker(m.config.Webspaces.DomainVerification.CheckInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			m.checkAllPendingDomains()
+		case <-m.stop:
+			return
+		}
+	}
+}
@@ -6,8 +6,11 @@ import (
 	"io"
 	"net"
 	"os"
+	"reflect"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
@@ -20,116 +23,446 @@ import (
 	k8sRetry "k8s.io/client-go/util/retry"
 
 	"github.com/netsoc/webspaced/internal/config"
+	"github.com/netsoc/webspaced/internal/metrics"
 	"github.com/netsoc/webspaced/pkg/util"
 )
 
+const (
+	// ProtocolTCP is the protocol for TCP port forwards
+	ProtocolTCP = "tcp"
+	// ProtocolUDP is the protocol for UDP port forwards
+	ProtocolUDP = "udp"
+)
+
 // PortHook represents a function to run before connecting to the backend
 type PortHook func(f *PortForward) error
 
+// PortAccountFunc represents a function to run with traffic forwarded by a port forward (called as each connection is
+// established and as data is forwarded)
+type PortAccountFunc func(f *PortForward, t PortTraffic)
+
 // PortForward represents an active port forwarding
 type PortForward struct {
-	ePort       uint16
-	backendAddr *net.TCPAddr
-	hook        PortHook
-	listener    *net.TCPListener
+	ePort    uint16
+	protocol string
+	// owner is the user ID of the webspace the port forward belongs to
+	owner int
+
+	mu          sync.RWMutex
+	backendAddr string
+	// target is the backend address the port forward was configured with (the hook might set the actual backend later)
+	target        string
+	mapping       PortMapping
+	proxyProtocol uint8
+	acl           *portACL
+	hook          PortHook
+	account       PortAccountFunc
+
+	tcpListener *net.TCPListener
+
+	udpConn        *net.UDPConn
+	udpSessions    map[string]*udpSession
+	udpMu          sync.Mutex
+	sessionTimeout time.Duration
+
+	limits *connLimiter
+	active int32
+
+	// wg tracks connection (and UDP session) handlers
+	wg     sync.WaitGroup
+	connMu sync.Mutex
+	conns  map[net.Conn]struct{}
+
+	accepting chan struct{}
+	done      chan struct{}
+	stopOnce  sync.Once
 }
 
 // NewPortForward creates and starts a port forward
-func NewPortForward(e uint16, backendAddr *net.TCPAddr, hook PortHook) (*PortForward, error) {
-	frontendAddr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf(":%v", e))
-	if err != nil {
-		return nil, err
+func NewPortForward(e uint16, protocol string, backendAddr string, hook PortHook,
+	account PortAccountFunc) (*PortForward, error) {
+	f := &PortForward{
+		ePort:    e,
+		protocol: protocol,
+
+		backendAddr: backendAddr,
+		target:      backendAddr,
+		hook:        hook,
+		account:     account,
+
+		udpSessions:    map[string]*udpSession{},
+		sessionTimeout: defaultUDPSessionTimeout,
+
+		limits: newConnLimiter(nil),
+		conns:  map[net.Conn]struct{}{},
+
+		accepting: make(chan struct{}),
+		done:      make(chan struct{}),
 	}
 
-	listener, err := net.ListenTCP("tcp", frontendAddr)
+	switch protocol {
+	case ProtocolTCP:
+		frontendAddr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf(":%v", e))
+		if err != nil {
+			return nil, err
+		}
+
+		f.tcpListener, err = net.ListenTCP("tcp", frontendAddr)
+		if err != nil {
+			return nil, err
+		}
+	case ProtocolUDP:
+		frontendAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf(":%v", e))
+		if err != nil {
+			return nil, err
+		}
+
+		f.udpConn, err = net.ListenUDP("udp", frontendAddr)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("%w (unsupported protocol %v)", util.ErrBadPort, protocol)
+	}
+
+	return f, nil
+}
+
+// Protocol returns the port forward's protocol
+func (f *PortForward) Protocol() string {
+	return f.protocol
+}
+
+// Active returns the number of connections (or UDP sessions) currently being forwarded
+func (f *PortForward) Active() int {
+	return int(atomic.LoadInt32(&f.active))
+}
+
+func (f *PortForward) backend() string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.backendAddr
+}
+
+func (f *PortForward) setBackend(addr string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.backendAddr = addr
+}
+
+func (f *PortForward) udpTimeout() time.Duration {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.sessionTimeout
+}
+
+func (f *PortForward) runHook() error {
+	f.mu.RLock()
+	hook := f.hook
+	f.mu.RUnlock()
+
+	return hook(f)
+}
+
+func (f *PortForward) runAccount(t PortTraffic) {
+	f.mu.RLock()
+	account := f.account
+	f.mu.RUnlock()
+
+	if account != nil {
+		account(f, t)
+	}
+}
+
+// forwarded records n bytes forwarded in a direction (`in` is towards the webspace)
+func (f *PortForward) forwarded(direction string, n int) {
+	if n <= 0 {
+		return
+	}
+
+	metrics.PortForwardBytes.WithLabelValues(strconv.Itoa(int(f.ePort)), f.protocol, direction).Add(float64(n))
+	if direction == "in" {
+		f.runAccount(PortTraffic{BytesIn: uint64(n)})
+	} else {
+		f.runAccount(PortTraffic{BytesOut: uint64(n)})
+	}
+}
+
+// countWriter calls count with the number of bytes written by each write
+type countWriter struct {
+	w     io.Writer
+	count func(n int)
+}
+
+func (c countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.count(n)
+	return n, err
+}
+
+// Configure applies a port mapping's PROXY protocol and access control settings
+func (f *PortForward) Configure(m PortMapping) error {
+	acl, err := parsePortACL(m.Allow, m.Deny)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return &PortForward{
-		e,
-		backendAddr,
-		hook,
-		listener,
-	}, nil
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.mapping = m
+	f.proxyProtocol = m.ProxyProtocol
+	f.acl = acl
+	f.limits.override(m.Limits)
+	return nil
 }
 
-func (f *PortForward) handleClient(client *net.TCPConn) {
+// admit checks a new client against the port forward's access control lists and connection limits, returning false
+// if it should be rejected
+func (f *PortForward) admit(ip net.IP) bool {
+	f.mu.RLock()
+	acl := f.acl
+	f.mu.RUnlock()
+
+	reason, ok := rejectACL, acl.permits(ip)
+	if ok {
+		reason, ok = f.limits.acquire(ip.String())
+	}
+	if !ok {
+		metrics.PortForwardRejected.WithLabelValues(strconv.Itoa(int(f.ePort)), f.protocol, reason).Inc()
+		log.WithFields(log.Fields{
+			"ePort":  f.ePort,
+			"client": ip,
+			"reason": reason,
+		}).Debug("Rejected port forward connection")
+	}
+
+	return ok
+}
+
+// track registers a connection to be closed if the port forward is stopped, returning false if it already has been
+func (f *PortForward) track(c net.Conn) bool {
+	f.connMu.Lock()
+	defer f.connMu.Unlock()
+
+	if f.conns == nil {
+		return false
+	}
+
+	f.conns[c] = struct{}{}
+	return true
+}
+
+func (f *PortForward) untrack(c net.Conn) {
+	f.connMu.Lock()
+	defer f.connMu.Unlock()
+
+	delete(f.conns, c)
+}
+
+// update replaces the backend address and hooks, applying to new connections
+func (f *PortForward) update(backendAddr string, hook PortHook, account PortAccountFunc) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.backendAddr = backendAddr
+	f.target = backendAddr
+	f.hook = hook
+	f.account = account
+}
+
+func (f *PortForward) handleClient(client *net.TCPConn, ip string) {
+	defer f.wg.Done()
 	defer client.Close()
-	if err := f.hook(f); err != nil {
+	defer f.limits.release(ip)
+	atomic.AddInt32(&f.active, 1)
+	defer atomic.AddInt32(&f.active, -1)
+
+	if !f.track(client) {
+		return
+	}
+	defer f.untrack(client)
+
+	if err := f.runHook(); err != nil {
 		log.WithFields(log.Fields{
 			"ePort":   f.ePort,
-			"backend": f.backendAddr,
+			"backend": f.backend(),
 		}).WithError(err).Warn("Port forward hook execution failed")
 		return
 	}
 
+	backendAddr := f.backend()
 	log.WithFields(log.Fields{
 		"ePort":   f.ePort,
-		"backend": f.backendAddr,
+		"backend": backendAddr,
 	}).Trace("Forwarding connection...")
-	backend, err := net.DialTCP("tcp", nil, f.backendAddr)
+	conn, err := net.Dial("tcp", backendAddr)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"ePort":   f.ePort,
-			"backend": f.backendAddr,
+			"backend": backendAddr,
 		}).WithError(err).Warn("Port forward backend connection failed")
 		return
 	}
+	backend := conn.(*net.TCPConn)
 	defer backend.Close()
+	if !f.track(backend) {
+		return
+	}
+	defer f.untrack(backend)
+
+	f.mu.RLock()
+	proxyProtocol := f.proxyProtocol
+	f.mu.RUnlock()
+	if proxyProtocol != 0 {
+		err := writeProxyHeader(backend, proxyProtocol, client.RemoteAddr().(*net.TCPAddr),
+			client.LocalAddr().(*net.TCPAddr))
+		if err != nil {
+			log.WithFields(log.Fields{
+				"ePort":   f.ePort,
+				"backend": backendAddr,
+			}).WithError(err).Warn("Failed to send PROXY protocol header")
+			return
+		}
+	}
 
+	metrics.PortForwardConnections.WithLabelValues(strconv.Itoa(int(f.ePort)), f.protocol).Inc()
+	f.runAccount(PortTraffic{Connections: 1})
+
+	// Traffic is accounted as it's copied so that long-lived connections count towards the quota
 	var wg sync.WaitGroup
-	pipe := func(dst, src *net.TCPConn) {
-		io.Copy(dst, src)
+	pipe := func(dst, src *net.TCPConn, direction string) {
+		io.Copy(countWriter{dst, func(n int) { f.forwarded(direction, n) }}, src)
 		src.CloseRead()
 		dst.CloseWrite()
 		wg.Done()
 	}
 
 	wg.Add(2)
-	go pipe(client, backend)
-	go pipe(backend, client)
+	go pipe(client, backend, "out")
+	go pipe(backend, client, "in")
 
 	wg.Wait()
 	log.WithFields(log.Fields{
 		"ePort":   f.ePort,
-		"backend": f.backendAddr,
+		"backend": backendAddr,
 	}).Trace("Forwarded connection ended normally")
 }
 
 // Run starts the port forward
 func (f *PortForward) Run() {
+	if f.protocol == ProtocolUDP {
+		f.runUDP()
+		return
+	}
+
+	defer close(f.accepting)
 	for {
-		client, err := f.listener.AcceptTCP()
+		client, err := f.tcpListener.AcceptTCP()
 		if err != nil {
 			log.WithFields(log.Fields{
 				"ePort":   f.ePort,
-				"backend": f.backendAddr,
+				"backend": f.backend(),
 			}).WithError(err).Info("Ending port forward")
 			return
 		}
 
-		go f.handleClient(client)
+		ip := client.RemoteAddr().(*net.TCPAddr).IP
+		if !f.admit(ip) {
+			client.Close()
+			continue
+		}
+
+		f.wg.Add(1)
+		go f.handleClient(client, ip.String())
+	}
+}
+
+// stopAccepting closes the port forward's socket so the port can be bound again straight away. Established TCP
+// connections carry on, but UDP sessions can't outlive the socket (replies are sent from it) so they are stopped.
+func (f *PortForward) stopAccepting() {
+	if f.protocol == ProtocolUDP {
+		f.Stop()
+		return
 	}
+
+	f.tcpListener.Close()
+	// Make sure no more handlers will be started (Run() returns as soon as the listener is closed)
+	<-f.accepting
 }
 
-// Stop shuts down the port forward
+// Drain stops accepting new connections and waits for established ones to finish. Once the context is done, any
+// remaining connections are closed forcibly and the context's error is returned.
+func (f *PortForward) Drain(ctx context.Context) error {
+	f.stopAccepting()
+
+	drained := make(chan struct{})
+	go func() {
+		f.wg.Wait()
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	f.Stop()
+	return err
+}
+
+// Stop immediately shuts down the port forward, closing any connections which are still active
 func (f *PortForward) Stop() {
-	f.listener.Close()
+	f.stopOnce.Do(func() {
+		close(f.done)
+		if f.tcpListener != nil {
+			f.tcpListener.Close()
+		}
+		if f.udpConn != nil {
+			f.udpConn.Close()
+		}
+
+		f.connMu.Lock()
+		defer f.connMu.Unlock()
+		for c := range f.conns {
+			c.Close()
+		}
+		f.conns = nil
+	})
 }
 
-// PortsManager manages TCP port forwarding
+// PortsManager manages TCP and UDP port forwarding
 type PortsManager struct {
 	svcName string
 	svcAPI  k8sTypedCore.ServiceInterface
 
+	config            *config.Config
+	udpSessionTimeout time.Duration
+	drainTimeout      time.Duration
+
+	// svcMu serializes updates to the Kubernetes Service's ports
+	svcMu sync.Mutex
+
+	// mu guards forwards
+	mu       sync.Mutex
 	forwards map[uint16]*PortForward
 }
 
-// NewPortsManager creates a new TCP port forward manager
+// NewPortsManager creates a new port forward manager
 func NewPortsManager(cfg *config.Config) (*PortsManager, error) {
 	p := PortsManager{
-		forwards: map[uint16]*PortForward{},
+		config:            cfg,
+		udpSessionTimeout: cfg.Webspaces.Ports.UDPSessionTimeout,
+		drainTimeout:      cfg.Webspaces.Ports.DrainTimeout,
+		forwards:          map[uint16]*PortForward{},
+	}
+	if p.udpSessionTimeout <= 0 {
+		p.udpSessionTimeout = defaultUDPSessionTimeout
 	}
 
 	if cfg.Webspaces.Ports.KubernetesService != "" {
@@ -143,7 +476,7 @@ func NewPortsManager(cfg *config.Config) (*PortsManager, error) {
 			return nil, fmt.Errorf("failed to create Kubernetes client: %w", err)
 		}
 
-		p.svcAPI = k8s.CoreV1().Services(cfg.Traefik.Kubernetes.Namespace)
+		p.svcAPI = k8s.CoreV1().Services(cfg.Routing.Kubernetes.Namespace)
 		p.svcName = cfg.Webspaces.Ports.KubernetesService
 	}
 
@@ -151,103 +484,179 @@ func NewPortsManager(cfg *config.Config) (*PortsManager, error) {
 }
 
 // Add creates a new port forwarding
-func (p *PortsManager) Add(ctx context.Context, e uint16, backendAddr *net.TCPAddr, hook PortHook) error {
+func (p *PortsManager) Add(ctx context.Context, owner int, e uint16, m PortMapping, backendAddr string,
+	hook PortHook, account PortAccountFunc) error {
+	p.mu.Lock()
+	err := p.add(owner, e, m, backendAddr, hook, account)
+	p.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return p.syncService(ctx, []uint16{e})
+}
+
+// add creates a new port forwarding, p.mu must be held
+func (p *PortsManager) add(owner int, e uint16, m PortMapping, backendAddr string, hook PortHook,
+	account PortAccountFunc) error {
 	if _, ok := p.forwards[e]; ok {
 		return util.ErrUsed
 	}
 
-	forward, err := NewPortForward(e, backendAddr, hook)
+	forward, err := NewPortForward(e, m.Protocol, backendAddr, hook, account)
 	if err != nil {
 		return err
 	}
+	if err := forward.Configure(m); err != nil {
+		forward.Stop()
+		return err
+	}
+	forward.sessionTimeout = p.udpSessionTimeout
+	forward.limits.configure(p.config)
+	forward.owner = owner
 
 	go forward.Run()
 	p.forwards[e] = forward
 
-	if p.svcName != "" {
-		if err := k8sRetry.RetryOnConflict(k8sRetry.DefaultRetry, func() error {
-			svc, err := p.svcAPI.Get(ctx, p.svcName, k8sMeta.GetOptions{})
-			if err != nil {
-				return fmt.Errorf("failed to get Kubernetes Service: %w", err)
-			}
+	return nil
+}
 
-			svcPort := k8sCore.ServicePort{
-				Name:       "ws-fwd-" + strconv.Itoa(int(e)),
-				Port:       int32(e),
-				Protocol:   k8sCore.ProtocolTCP,
-				TargetPort: intstr.FromInt(int(e)),
-			}
+// Remove removes a port forwarding, draining its established connections in the background
+func (p *PortsManager) Remove(ctx context.Context, e uint16, updateK8s bool) error {
+	p.mu.Lock()
+	err := p.removeAndDrain(e)
+	p.mu.Unlock()
+	if err != nil || !updateK8s {
+		return err
+	}
 
-			existing := false
-			for i, sp := range svc.Spec.Ports {
-				if sp.Port == int32(e) {
-					log.WithFields(log.Fields{
-						"ePort":   e,
-						"backend": backendAddr,
-					}).Debug("Kubernetes Service port already existed, overwriting")
-					svc.Spec.Ports[i] = svcPort
-					existing = true
-				}
-			}
-			if !existing {
-				svc.Spec.Ports = append(svc.Spec.Ports, svcPort)
-			}
+	return p.syncService(ctx, []uint16{e})
+}
 
-			_, err = p.svcAPI.Update(ctx, svc, k8sMeta.UpdateOptions{})
-			return err
-		}); err != nil {
-			return fmt.Errorf("failed to update Kubernetes Service: %w", err)
-		}
+// removeAndDrain removes a port forwarding and drains it in the background, p.mu must be held. The port is free to be
+// used again once this returns.
+func (p *PortsManager) removeAndDrain(e uint16) error {
+	forward, err := p.remove(e)
+	if err != nil {
+		return err
 	}
 
+	forward.stopAccepting()
+	go p.drain(context.Background(), forward)
 	return nil
 }
 
-// Remove stops and removes a port forwarding
-func (p *PortsManager) Remove(ctx context.Context, e uint16, updateK8s bool) error {
+// drain gracefully stops a port forward, waiting for up to the configured drain timeout (or until the context is done)
+func (p *PortsManager) drain(ctx context.Context, f *PortForward) {
+	if p.drainTimeout <= 0 {
+		f.Stop()
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.drainTimeout)
+	defer cancel()
+
+	n := f.Active()
+	if n > 0 {
+		log.WithFields(log.Fields{
+			"ePort":  f.ePort,
+			"active": n,
+		}).Debug("Draining port forward")
+	}
+	if err := f.Drain(ctx); err != nil {
+		log.WithFields(log.Fields{
+			"ePort":  f.ePort,
+			"active": f.Active(),
+		}).WithError(err).Warn("Port forward did not drain in time, closing remaining connections")
+	}
+}
+
+// remove removes a port forwarding without stopping it, p.mu must be held
+func (p *PortsManager) remove(e uint16) (*PortForward, error) {
 	forward, ok := p.forwards[e]
 	if !ok {
-		return util.ErrNotFound
+		return nil, util.ErrNotFound
 	}
 
-	if p.svcName != "" && updateK8s {
-		if err := k8sRetry.RetryOnConflict(k8sRetry.DefaultRetry, func() error {
-			svc, err := p.svcAPI.Get(ctx, p.svcName, k8sMeta.GetOptions{})
-			if err != nil {
-				return fmt.Errorf("failed to get Kubernetes Service: %w", err)
-			}
+	delete(p.forwards, e)
+	return forward, nil
+}
 
-			index := -1
-			for i, p := range svc.Spec.Ports {
-				if p.Port == int32(e) {
-					index = i
-					break
-				}
-			}
+// syncService updates the Kubernetes Service's ports for the given external ports to match the current port forwards
+// (if a Service is configured). p.mu must not be held, since this can take a while.
+func (p *PortsManager) syncService(ctx context.Context, ports []uint16) error {
+	if p.svcName == "" || len(ports) == 0 {
+		return nil
+	}
 
-			if index != -1 {
-				end := len(svc.Spec.Ports) - 1
-				svc.Spec.Ports[end], svc.Spec.Ports[index] = svc.Spec.Ports[index], svc.Spec.Ports[end]
-				svc.Spec.Ports = svc.Spec.Ports[:end]
+	// Updates are serialized and use the latest port forwards so an older update can't undo a newer one
+	p.svcMu.Lock()
+	defer p.svcMu.Unlock()
 
-				if _, err := p.svcAPI.Update(ctx, svc, k8sMeta.UpdateOptions{}); err != nil {
-					return err
+	if err := k8sRetry.RetryOnConflict(k8sRetry.DefaultRetry, func() error {
+		svc, err := p.svcAPI.Get(ctx, p.svcName, k8sMeta.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to get Kubernetes Service: %w", err)
+		}
+
+		// Desired Service port for each external port, nil if there should be none
+		want := make(map[int32]*k8sCore.ServicePort, len(ports))
+		p.mu.Lock()
+		for _, e := range ports {
+			want[int32(e)] = nil
+
+			if f, ok := p.forwards[e]; ok {
+				svcProtocol := k8sCore.ProtocolTCP
+				if f.protocol == ProtocolUDP {
+					svcProtocol = k8sCore.ProtocolUDP
+				}
+				want[int32(e)] = &k8sCore.ServicePort{
+					Name:       "ws-fwd-" + strconv.Itoa(int(e)),
+					Port:       int32(e),
+					Protocol:   svcProtocol,
+					TargetPort: intstr.FromInt(int(e)),
 				}
-			} else {
-				log.WithFields(log.Fields{
-					"ePort":   e,
-					"backend": forward.backendAddr,
-				}).Warn("Kubernetes Service port not found")
 			}
+		}
+		p.mu.Unlock()
+
+		changed := false
+		svcPorts := make([]k8sCore.ServicePort, 0, len(svc.Spec.Ports))
+		for _, sp := range svc.Spec.Ports {
+			w, ok := want[sp.Port]
+			switch {
+			case !ok:
+				svcPorts = append(svcPorts, sp)
+			case w == nil:
+				changed = true
+			default:
+				if sp.Name != w.Name || sp.Protocol != w.Protocol || sp.TargetPort != w.TargetPort {
+					sp = *w
+					changed = true
+				}
+				svcPorts = append(svcPorts, sp)
+				delete(want, sp.Port)
+			}
+		}
+		for _, e := range ports {
+			if w := want[int32(e)]; w != nil {
+				svcPorts = append(svcPorts, *w)
+				delete(want, int32(e))
+				changed = true
+			}
+		}
 
+		if !changed {
 			return nil
-		}); err != nil {
-			return fmt.Errorf("failed to update Kubernetes Service: %w", err)
 		}
+
+		svc.Spec.Ports = svcPorts
+		_, err = p.svcAPI.Update(ctx, svc, k8sMeta.UpdateOptions{})
+		return err
+	}); err != nil {
+		return fmt.Errorf("failed to update Kubernetes Service: %w", err)
 	}
 
-	forward.Stop()
-	delete(p.forwards, e)
 	return nil
 }
 
@@ -264,30 +673,61 @@ func (p *PortsManager) Trim(ctx context.Context, all []*Webspace) error {
 		}
 	}
 
+	var removed []uint16
+	p.mu.Lock()
 	for e := range p.forwards {
 		if _, ok := allPorts[e]; !ok {
-			p.Remove(ctx, e, true)
+			if err := p.removeAndDrain(e); err != nil {
+				log.
+					WithField("ePort", e).
+					WithError(err).
+					Warn("Failed to remove port forward")
+				continue
+			}
+
+			removed = append(removed, e)
 		}
 	}
-	return nil
+	p.mu.Unlock()
+
+	return p.syncService(ctx, removed)
 }
 
 // AddAll adds / updates port forwards for a given webspace
 func (p *PortsManager) AddAll(ctx context.Context, w *Webspace, addr string) error {
+	added, err := p.addAll(w, addr)
+	if sErr := p.syncService(ctx, added); sErr != nil && err == nil {
+		err = sErr
+	}
+
+	return err
+}
+
+// addAll adds / updates port forwards for a given webspace, returning the external ports of the forwards that were
+// (re-)created
+func (p *PortsManager) addAll(w *Webspace, addr string) ([]uint16, error) {
+	account := func(f *PortForward, t PortTraffic) {
+		w.manager.traffic.add(w.UserID, f.ePort, t)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var added []uint16
+
 	for e, i := range w.Ports {
-		// Using an existing port forward is validated externally - if this exists it belongs to us
-		if _, ok := p.forwards[e]; ok {
-			// Don't trigger a change in Kubernetes!
-			if err := p.Remove(ctx, e, false); err != nil {
-				return fmt.Errorf("failed to remove existing port forward: %w", err)
-			}
-		}
+		e, i := e, i
 
 		hook := func(f *PortForward) error {
+			if err := w.checkTrafficQuota(); err != nil {
+				return err
+			}
+
+			w.manager.idle.touch(w.UserID)
 			log.WithFields(log.Fields{
 				"uid":   w.UserID,
 				"ePort": e,
-				"iPort": i,
+				"iPort": i.Port,
 			}).Debug("Waiting for webspace to start to forward port")
 
 			addr, err := w.EnsureStarted()
@@ -295,42 +735,175 @@ func (p *PortsManager) AddAll(ctx context.Context, w *Webspace, addr string) err
 				return fmt.Errorf("failed to ensure webspace was started: %w", err)
 			}
 
-			backendAddr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf("%v:%v", addr, i))
-			if err != nil {
-				panic(err)
-			}
-			f.backendAddr = backendAddr
+			f.setBackend(net.JoinHostPort(addr, strconv.Itoa(int(i.Port))))
 			return nil
 		}
 
-		var backendAddr *net.TCPAddr
+		var backendAddr string
 		if addr != "" {
-			var err error
-			backendAddr, err = net.ResolveTCPAddr("tcp", fmt.Sprintf("%v:%v", addr, i))
-			if err != nil {
-				panic(err)
-			}
+			backendAddr = net.JoinHostPort(addr, strconv.Itoa(int(i.Port)))
 
 			// Only ensure started if we're not running already
-			hook = func(_ *PortForward) error { return nil }
+			hook = func(_ *PortForward) error {
+				if err := w.checkTrafficQuota(); err != nil {
+					return err
+				}
+
+				w.manager.idle.touch(w.UserID)
+				return nil
+			}
+		}
+
+		// Using an existing port forward is validated externally - if this exists it belongs to us (unless it was
+		// handed over from before a reload)
+		if f, ok := p.forwards[e]; ok {
+			if f.owner == w.UserID && f.Protocol() == i.Protocol {
+				// Update in place so the listener (and any UDP sessions) stay up
+				f.update(backendAddr, hook, account)
+				if err := f.Configure(i); err != nil {
+					return added, fmt.Errorf("failed to update port forward: %w", err)
+				}
+				continue
+			}
+
+			// The Kubernetes Service is only synced once the new port forward has been added
+			if err := p.removeAndDrain(e); err != nil {
+				return added, fmt.Errorf("failed to remove existing port forward: %w", err)
+			}
+		}
+
+		if err := p.add(w.UserID, e, i, backendAddr, hook, account); err != nil {
+			return added, fmt.Errorf("failed to add port forward for: %w", err)
 		}
+		added = append(added, e)
+	}
+
+	return added, nil
+}
+
+// InSync returns true if the port forwards for a webspace are all set up and match its current configuration
+func (p *PortsManager) InSync(w *Webspace, addr string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for e, i := range w.Ports {
+		f, ok := p.forwards[e]
+		if !ok || f.owner != w.UserID || f.protocol != i.Protocol {
+			return false
+		}
+
+		var target string
+		if addr != "" {
+			target = net.JoinHostPort(addr, strconv.Itoa(int(i.Port)))
+		}
+
+		f.mu.RLock()
+		ok = f.target == target && reflect.DeepEqual(f.mapping, i)
+		f.mu.RUnlock()
+		if !ok {
+			return false
+		}
+	}
+
+	return true
+}
 
-		if err := p.Add(ctx, e, backendAddr, hook); err != nil {
-			return fmt.Errorf("failed to add port forward for: %w", err)
+// ActiveConnections returns the number of connections currently being forwarded to a webspace
+func (p *PortsManager) ActiveConnections(w *Webspace) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var n int
+	for e := range w.Ports {
+		if f, ok := p.forwards[e]; ok {
+			n += f.Active()
 		}
 	}
 
+	return n
+}
+
+// adoptedPortHook is the hook for port forwards taken over from a previous manager, until syncing replaces it
+func (m *Manager) adoptedPortHook(f *PortForward) error {
+	w, err := m.Get(f.owner, nil)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve webspace: %w", err)
+	}
+	i, ok := w.Ports[f.ePort]
+	if !ok {
+		return fmt.Errorf("port forward no longer exists: %w", util.ErrGenericNotFound)
+	}
+
+	if err := w.checkTrafficQuota(); err != nil {
+		return err
+	}
+	m.idle.touch(w.UserID)
+
+	addr, err := w.EnsureStarted()
+	if err != nil {
+		return fmt.Errorf("failed to ensure webspace was started: %w", err)
+	}
+
+	f.setBackend(net.JoinHostPort(addr, strconv.Itoa(int(i.Port))))
 	return nil
 }
 
-// Shutdown stops and removes all port forwards
+// PortHandoff holds running port forwards being passed from one PortsManager to another (e.g. across a config reload)
+type PortHandoff map[uint16]*PortForward
+
+// Detach removes all port forwards from the manager without stopping them, so they can be adopted by another manager
+func (p *PortsManager) Detach() PortHandoff {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	h := PortHandoff(p.forwards)
+	p.forwards = map[uint16]*PortForward{}
+
+	return h
+}
+
+// Adopt takes over port forwards detached from another manager, applying this manager's config and the given hooks to
+// them. Until they are updated (or trimmed) by syncing webspaces, they continue forwarding with their existing
+// settings.
+func (p *PortsManager) Adopt(h PortHandoff, hook PortHook, account PortAccountFunc) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for e, f := range h {
+		f.mu.Lock()
+		f.sessionTimeout = p.udpSessionTimeout
+		f.hook = hook
+		f.account = account
+		f.mu.Unlock()
+		f.limits.configure(p.config)
+
+		p.forwards[e] = f
+	}
+}
+
+// Shutdown removes all port forwards, waiting for their active connections to drain
 func (p *PortsManager) Shutdown(ctx context.Context) {
-	for e := range p.forwards {
-		if err := p.Remove(ctx, e, true); err != nil {
-			log.
-				WithField("ePort", e).
-				WithError(err).
-				Warn("Failed to remove port forward")
-		}
+	p.mu.Lock()
+	forwards := p.forwards
+	p.forwards = map[uint16]*PortForward{}
+	p.mu.Unlock()
+
+	var wg sync.WaitGroup
+	ports := make([]uint16, 0, len(forwards))
+	for e, forward := range forwards {
+		forward := forward
+		ports = append(ports, e)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.drain(ctx, forward)
+		}()
 	}
+
+	if err := p.syncService(ctx, ports); err != nil {
+		log.WithError(err).Warn("Failed to remove port forwards from Kubernetes Service")
+	}
+
+	wg.Wait()
 }
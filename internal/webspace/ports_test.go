@@ -0,0 +1,171 @@
+package webspace
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/netsoc/webspaced/internal/config"
+)
+
+// echoServer starts a TCP server on loopback which echoes back each line it receives
+func echoServer(t *testing.T) uint16 {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start echo server: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer c.Close()
+
+				r := bufio.NewReader(c)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if _, err := c.Write([]byte(line)); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	return uint16(l.Addr().(*net.TCPAddr).Port)
+}
+
+// freePorts finds n TCP ports which are currently free
+func freePorts(t *testing.T, n int) []uint16 {
+	t.Helper()
+
+	ports := make([]uint16, 0, n)
+	for len(ports) < n {
+		l, err := net.Listen("tcp", ":0")
+		if err != nil {
+			t.Fatalf("failed to find free port: %v", err)
+		}
+		defer l.Close()
+
+		ports = append(ports, uint16(l.Addr().(*net.TCPAddr).Port))
+	}
+
+	return ports
+}
+
+// echo sends a line through a port forward and checks it comes back
+func echo(e uint16, msg string) error {
+	c, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(e))), time.Second)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := fmt.Fprintln(c, msg); err != nil {
+		return err
+	}
+	line, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if line != msg+"\n" {
+		return fmt.Errorf("got %q back, expected %q", line, msg)
+	}
+
+	return nil
+}
+
+func TestPortsManagerConcurrent(t *testing.T) {
+	cfg := &config.Config{}
+	m := &Manager{
+		config:  cfg,
+		idle:    newIdleTracker(),
+		traffic: newTrafficTracker(),
+	}
+	p, err := NewPortsManager(cfg)
+	if err != nil {
+		t.Fatalf("failed to create ports manager: %v", err)
+	}
+
+	backend := echoServer(t)
+	ePorts := freePorts(t, 4)
+	webspaces := make([]*Webspace, len(ePorts))
+	for i, e := range ePorts {
+		webspaces[i] = &Webspace{
+			manager: m,
+			UserID:  i + 1,
+			Ports: map[uint16]PortMapping{
+				e: {Port: backend, Protocol: ProtocolTCP},
+			},
+		}
+	}
+
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	run := func(n int, f func(i int)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				f(i)
+			}
+		}()
+	}
+
+	// Errors are expected while forwards are being removed and re-added underneath each other, the point is that
+	// the manager's state stays consistent
+	for i, w := range webspaces {
+		w, e := w, ePorts[i]
+		run(50, func(_ int) { p.AddAll(ctx, w, "127.0.0.1") })
+		run(50, func(i int) { echo(e, fmt.Sprintf("message %v", i)) })
+	}
+	run(50, func(i int) { p.Trim(ctx, webspaces[:i%len(webspaces)]) })
+	run(50, func(i int) { p.Remove(ctx, ePorts[i%len(ePorts)], true) })
+	run(50, func(_ int) {
+		for _, w := range webspaces {
+			p.InSync(w, "127.0.0.1")
+			p.ActiveConnections(w)
+		}
+	})
+	wg.Wait()
+
+	for _, w := range webspaces {
+		if err := p.AddAll(ctx, w, "127.0.0.1"); err != nil {
+			t.Fatalf("failed to add port forwards for webspace %v: %v", w.UserID, err)
+		}
+		if !p.InSync(w, "127.0.0.1") {
+			t.Errorf("port forwards for webspace %v not in sync", w.UserID)
+		}
+	}
+	for _, e := range ePorts {
+		if err := echo(e, "hello"); err != nil {
+			t.Errorf("failed to forward port %v: %v", e, err)
+		}
+	}
+
+	p.Shutdown(ctx)
+	for _, e := range ePorts {
+		l, err := net.Listen("tcp", fmt.Sprintf(":%v", e))
+		if err != nil {
+			t.Errorf("port %v still in use after shutdown: %v", e, err)
+			continue
+		}
+		l.Close()
+	}
+}
@@ -0,0 +1,69 @@
+package webspace
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+// proxyV2Signature is the fixed prefix of a PROXY protocol v2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ipv6String formats an IP address in IPv6 form (net.IP.String() uses dotted decimal for IPv4-mapped addresses)
+func ipv6String(ip net.IP) string {
+	ip = ip.To16()
+	if ip.To4() == nil {
+		return ip.String()
+	}
+
+	return fmt.Sprintf("::ffff:%x:%x", uint16(ip[12])<<8|uint16(ip[13]), uint16(ip[14])<<8|uint16(ip[15]))
+}
+
+// writeProxyHeader writes a PROXY protocol (https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt) header
+// describing a TCP connection from src to dst
+func writeProxyHeader(w io.Writer, version uint8, src, dst *net.TCPAddr) error {
+	src4, dst4 := src.IP.To4(), dst.IP.To4()
+	ipv4 := src4 != nil && dst4 != nil
+
+	switch version {
+	case 1:
+		family, srcIP, dstIP := "TCP4", src4.String(), dst4.String()
+		if !ipv4 {
+			// With mixed families, IPv4 addresses need to be given in their IPv4-mapped IPv6 form
+			family, srcIP, dstIP = "TCP6", ipv6String(src.IP), ipv6String(dst.IP)
+		}
+
+		_, err := fmt.Fprintf(w, "PROXY %v %v %v %v %v\r\n", family, srcIP, dstIP, src.Port, dst.Port)
+		return err
+	case 2:
+		var addrs bytes.Buffer
+		// AF_INET6, STREAM
+		family := byte(0x21)
+		if ipv4 {
+			// AF_INET, STREAM
+			family = 0x11
+			addrs.Write(src4)
+			addrs.Write(dst4)
+		} else {
+			addrs.Write(src.IP.To16())
+			addrs.Write(dst.IP.To16())
+		}
+		binary.Write(&addrs, binary.BigEndian, uint16(src.Port))
+		binary.Write(&addrs, binary.BigEndian, uint16(dst.Port))
+
+		var header bytes.Buffer
+		header.Write(proxyV2Signature)
+		// Version 2, PROXY command
+		header.WriteByte(0x21)
+		header.WriteByte(family)
+		binary.Write(&header, binary.BigEndian, uint16(addrs.Len()))
+		header.Write(addrs.Bytes())
+
+		_, err := w.Write(header.Bytes())
+		return err
+	default:
+		return fmt.Errorf("unsupported PROXY protocol version %v", version)
+	}
+}
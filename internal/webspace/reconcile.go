@@ -0,0 +1,237 @@
+package webspace
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	lxdApi "github.com/lxc/lxd/shared/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// routeState is everything a webspace's routing configuration is generated from
+type routeState struct {
+	Addr           string
+	HTTPPort       uint16
+	SNIPassthrough bool
+	Domains        []string
+}
+
+func newRouteState(w *Webspace, addr string) routeState {
+	return routeState{
+		Addr:           addr,
+		HTTPPort:       w.Config.HTTPPort,
+		SNIPassthrough: w.Config.SNIPassthrough,
+		Domains:        append([]string(nil), w.Domains...),
+	}
+}
+
+// routeTracker keeps track of the routing configuration which has been applied for each webspace
+type routeTracker struct {
+	sync.Mutex
+	routes map[int]routeState
+	// failures holds the error from the last failed attempt to apply each webspace's configuration
+	failures map[int]error
+	// lastFull is when all configuration was last regenerated regardless of the applied state
+	lastFull time.Time
+}
+
+func newRouteTracker() *routeTracker {
+	return &routeTracker{
+		routes:   map[int]routeState{},
+		failures: map[int]error{},
+		// Nothing has been applied yet, so the initial sync generates everything
+		lastFull: time.Now(),
+	}
+}
+
+// fullDue returns true (and records the time) if all configuration should be regenerated. The applied state only
+// reflects what webspaced has done, so changes made to the provider's configuration by anything else would otherwise
+// never be undone.
+func (t *routeTracker) fullDue(interval time.Duration) bool {
+	t.Lock()
+	defer t.Unlock()
+
+	if interval <= 0 || time.Since(t.lastFull) < interval {
+		return false
+	}
+
+	t.lastFull = time.Now()
+	return true
+}
+
+// invalidate marks the applied configuration for a webspace as unknown, so it will be regenerated
+func (t *routeTracker) invalidate(uid int) {
+	t.Lock()
+	defer t.Unlock()
+
+	delete(t.routes, uid)
+}
+
+// changed returns true if the routing configuration for a webspace isn't known to match the given state
+func (t *routeTracker) changed(uid int, s routeState) bool {
+	t.Lock()
+	defer t.Unlock()
+
+	applied, ok := t.routes[uid]
+	return !ok || !reflect.DeepEqual(applied, s)
+}
+
+func (t *routeTracker) set(uid int, s routeState) {
+	t.Lock()
+	defer t.Unlock()
+
+	t.routes[uid] = s
+	delete(t.failures, uid)
+}
+
+func (t *routeTracker) fail(uid int, err error) {
+	t.Lock()
+	defer t.Unlock()
+
+	t.failures[uid] = err
+}
+
+func (t *routeTracker) forget(uid int) {
+	t.Lock()
+	defer t.Unlock()
+
+	delete(t.routes, uid)
+	delete(t.failures, uid)
+}
+
+// get returns the configuration state which has been applied for a webspace (if any) and the error from the last
+// failed attempt to apply it
+func (t *routeTracker) get(uid int) (routeState, bool, error) {
+	t.Lock()
+	defer t.Unlock()
+
+	s, ok := t.routes[uid]
+	return s, ok, t.failures[uid]
+}
+
+func (t *routeTracker) uids() []int {
+	t.Lock()
+	defer t.Unlock()
+
+	uids := make([]int, 0, len(t.routes))
+	for uid := range t.routes {
+		uids = append(uids, uid)
+	}
+
+	return uids
+}
+
+// applyConfig brings the routing and port forwarding configuration for a webspace in line with its current state,
+// only making changes if they're needed (unless force is true)
+func (m *Manager) applyConfig(ctx context.Context, w *Webspace, addr string, force bool) error {
+	s := newRouteState(w, addr)
+	if force || m.routes.changed(w.UserID, s) {
+		m.routes.forget(w.UserID)
+		if err := m.routing.GenerateConfig(ctx, w, addr); err != nil {
+			m.routes.fail(w.UserID, err)
+			return fmt.Errorf("failed to update routing config: %w", err)
+		}
+		m.routes.set(w.UserID, s)
+	}
+
+	if force || !m.ports.InSync(w, addr) {
+		if err := m.ports.AddAll(ctx, w, addr); err != nil {
+			return fmt.Errorf("failed to set up port forwards: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// reconcileWebspace compares a webspace's routing and port forwarding configuration against its current state
+func (m *Manager) reconcileWebspace(ctx context.Context, uid int) error {
+	m.Lock(uid)
+	defer m.Unlock(uid)
+
+	w, err := m.Get(uid, nil)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve webspace: %w", err)
+	}
+
+	state, _, err := m.lxd.GetInstanceState(w.InstanceName())
+	if err != nil {
+		return fmt.Errorf("failed to retrieve LXD instance state: %w", convertLXDError(err))
+	}
+
+	var addr string
+	if state.StatusCode == lxdApi.Running {
+		if addr, err = w.GetIP(state); err != nil {
+			// Probably still booting, the LXD event (or next resync) will take care of it
+			log.WithField("uid", uid).WithError(err).Debug("Skipping reconciliation of webspace without IP address")
+			return nil
+		}
+	}
+
+	return m.applyConfig(ctx, w, addr, false)
+}
+
+// reconcile computes the desired routing and port forwarding configuration for all webspaces and applies any
+// differences
+func (m *Manager) reconcile(ctx context.Context) error {
+	webspaces, err := m.GetAll()
+	if err != nil {
+		return fmt.Errorf("failed to retrieve all webspaces: %w", err)
+	}
+	if err := m.ports.Trim(ctx, webspaces); err != nil {
+		return fmt.Errorf("failed to trim port forwards: %w", err)
+	}
+
+	full := m.routes.fullDue(m.config.Webspaces.FullResyncInterval)
+	if full {
+		log.Debug("Regenerating all routing configs")
+	}
+
+	existing := make(map[int]struct{}, len(webspaces))
+	for _, w := range webspaces {
+		existing[w.UserID] = struct{}{}
+
+		if full {
+			m.routes.invalidate(w.UserID)
+		}
+		if err := m.reconcileWebspace(ctx, w.UserID); err != nil {
+			log.WithField("uid", w.UserID).WithError(err).Error("Failed to reconcile webspace config")
+		}
+	}
+
+	// Clean up after webspaces which have been deleted
+	for _, uid := range m.routes.uids() {
+		if _, ok := existing[uid]; ok {
+			continue
+		}
+
+		log.WithField("uid", uid).Debug("Removing routing config for deleted webspace")
+		if err := m.routing.ClearConfig(ctx, m.lxdInstanceName(uid)); err != nil {
+			log.WithField("uid", uid).WithError(err).Error("Failed to clear routing config")
+			continue
+		}
+		m.routes.forget(uid)
+	}
+
+	return nil
+}
+
+func (m *Manager) reconcileLoop() {
+	t := time.NewTicker(m.config.Webspaces.ResyncInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			ctx, cancel := context.WithTimeout(context.Background(), m.config.Webspaces.ResyncInterval)
+			if err := m.reconcile(ctx); err != nil {
+				log.WithError(err).Error("Failed to reconcile routing / port forwarding configs")
+			}
+			cancel()
+		case <-m.stop:
+			return
+		}
+	}
+}
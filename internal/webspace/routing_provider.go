@@ -0,0 +1,39 @@
+package webspace
+
+import (
+	"context"
+	"sort"
+)
+
+// RoutingProvider represents a method of programming reverse proxy (e.g. Traefik or Caddy) routing configuration for
+// webspaces
+type RoutingProvider interface {
+	// ClearAll cleans all configuration for all instances
+	ClearAll(ctx context.Context) error
+	// Instances returns the names of all instances which have configuration
+	Instances(ctx context.Context) ([]string, error)
+	// ClearConfig cleans out any configuration for an instance
+	ClearConfig(ctx context.Context, n string) error
+	// GenerateConfig brings the configuration for an instance in line with the given state (creating or updating it
+	// as needed, without first removing the existing configuration)
+	GenerateConfig(ctx context.Context, ws *Webspace, addr string) error
+}
+
+// routingServer is implemented by routing providers which run their own servers
+type routingServer interface {
+	// Start begins serving
+	Start() error
+	// Shutdown stops serving
+	Shutdown(ctx context.Context) error
+}
+
+// sortedInstances returns the instance names in a set (sorted)
+func sortedInstances(set map[string]struct{}) []string {
+	names := make([]string, 0, len(set))
+	for n := range set {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	return names
+}
@@ -0,0 +1,128 @@
+package webspace
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	lxdApi "github.com/lxc/lxd/shared/api"
+	"github.com/netsoc/webspaced/pkg/util"
+)
+
+var snapshotNameRegex = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,62}$`)
+
+// Snapshot describes a snapshot of a webspace
+type Snapshot struct {
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Snapshots returns all of the webspace's snapshots
+func (w *Webspace) Snapshots() ([]Snapshot, error) {
+	lxdSnapshots, err := w.manager.lxd.GetInstanceSnapshots(w.InstanceName())
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve LXD instance snapshots: %w", convertLXDError(err))
+	}
+
+	snapshots := make([]Snapshot, len(lxdSnapshots))
+	for i, s := range lxdSnapshots {
+		snapshots[i] = Snapshot{
+			Name:      s.Name,
+			CreatedAt: s.CreatedAt,
+		}
+	}
+
+	return snapshots, nil
+}
+
+func (w *Webspace) createSnapshot(name string) error {
+	op, err := w.manager.lxd.CreateInstanceSnapshot(w.InstanceName(), lxdApi.InstanceSnapshotsPost{
+		Name: name,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create LXD instance snapshot: %w", convertLXDError(err))
+	}
+
+	if err := op.Wait(); err != nil {
+		return fmt.Errorf("failed to create LXD instance snapshot: %w", convertLXDError(err))
+	}
+	return nil
+}
+
+// CreateSnapshot creates a new snapshot of the webspace
+func (w *Webspace) CreateSnapshot(name string) error {
+	if !snapshotNameRegex.MatchString(name) || strings.HasPrefix(name, autoSnapshotPrefix) {
+		return util.ErrSnapshotName
+	}
+
+	w.manager.Lock(w.UserID)
+	defer w.manager.Unlock(w.UserID)
+
+	snapshots, err := w.Snapshots()
+	if err != nil {
+		return err
+	}
+
+	// Automatic snapshots don't count towards the limit
+	count := 0
+	for _, s := range snapshots {
+		if !strings.HasPrefix(s.Name, autoSnapshotPrefix) {
+			count++
+		}
+	}
+	if count >= int(w.manager.config.Webspaces.Snapshots.Max) {
+		return util.ErrTooManySnapshots
+	}
+
+	return w.createSnapshot(name)
+}
+
+// RestoreSnapshot restores the webspace from a snapshot
+func (w *Webspace) RestoreSnapshot(name string) error {
+	w.manager.Lock(w.UserID)
+	defer w.manager.Unlock(w.UserID)
+	n := w.InstanceName()
+
+	// Make sure the domains, ports etc. we keep are the latest
+	if err := w.refresh(); err != nil {
+		return err
+	}
+	if _, _, err := w.manager.lxd.GetInstanceSnapshot(n, name); err != nil {
+		return fmt.Errorf("failed to get LXD instance snapshot: %w", convertLXDError(err))
+	}
+
+	op, err := w.manager.lxd.UpdateInstance(n, lxdApi.InstancePut{
+		Restore: name,
+	}, w.etag)
+	if err != nil {
+		return fmt.Errorf("failed to restore LXD instance snapshot: %w", convertLXDError(err))
+	}
+
+	if err := op.Wait(); err != nil {
+		return fmt.Errorf("failed to restore LXD instance snapshot: %w", convertLXDError(err))
+	}
+
+	// Restoring a snapshot also restores the instance config, we want to keep the current domains, ports etc.
+	return w.Save()
+}
+
+func (w *Webspace) deleteSnapshot(name string) error {
+	op, err := w.manager.lxd.DeleteInstanceSnapshot(w.InstanceName(), name)
+	if err != nil {
+		return fmt.Errorf("failed to delete LXD instance snapshot: %w", convertLXDError(err))
+	}
+
+	if err := op.Wait(); err != nil {
+		return fmt.Errorf("failed to delete LXD instance snapshot: %w", convertLXDError(err))
+	}
+	return nil
+}
+
+// DeleteSnapshot deletes one of the webspace's snapshots
+func (w *Webspace) DeleteSnapshot(name string) error {
+	w.manager.Lock(w.UserID)
+	defer w.manager.Unlock(w.UserID)
+
+	return w.deleteSnapshot(name)
+}
@@ -0,0 +1,357 @@
+package webspace
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+
+	traefikConf "github.com/traefik/traefik/v2/pkg/config/dynamic"
+	traefikTLS "github.com/traefik/traefik/v2/pkg/tls"
+	traefikTypes "github.com/traefik/traefik/v2/pkg/types"
+
+	"github.com/netsoc/webspaced/internal/config"
+	"github.com/netsoc/webspaced/pkg/util"
+)
+
+// TraefikFile manages webspace configuration for Traefik via files in a directory watched by Traefik's file provider
+type TraefikFile struct {
+	config *config.Config
+	certs  *certStore
+
+	ext string
+	// ownedFile matches the names of files which webspaced generates
+	ownedFile *regexp.Regexp
+}
+
+// NewTraefikFile creates a new Traefik config manager using dynamic configuration files
+func NewTraefikFile(cfg *config.Config) (RoutingProvider, error) {
+	var ext string
+	switch cfg.Routing.File.Format {
+	case "yaml", "":
+		ext = ".yml"
+	case "toml":
+		ext = ".toml"
+	default:
+		return nil, fmt.Errorf("%w (unknown file format %v)", util.ErrBadValue, cfg.Routing.File.Format)
+	}
+
+	if err := os.MkdirAll(cfg.Routing.File.Directory, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create config directory: %w", err)
+	}
+
+	return &TraefikFile{
+		config: cfg,
+
+		ext: ext,
+		ownedFile: regexp.MustCompile(
+			`^` + regexp.QuoteMeta(cfg.Webspaces.InstancePrefix) + `u\d+` + regexp.QuoteMeta(ext) + `$`),
+	}, nil
+}
+
+func (t *TraefikFile) useCertificates(s *certStore) {
+	t.certs = s
+}
+
+func (t *TraefikFile) path(n string) string {
+	return filepath.Join(t.config.Routing.File.Directory, n+t.ext)
+}
+
+func (t *TraefikFile) remove(p string) error {
+	if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove config file: %w", err)
+	}
+
+	return nil
+}
+
+// write atomically replaces a config file (unless it's already up to date)
+func (t *TraefikFile) write(p string, data []byte) error {
+	if existing, err := ioutil.ReadFile(p); err == nil && bytes.Equal(existing, data) {
+		return nil
+	}
+
+	// Traefik ignores files without a config extension, so it won't pick up the partially written file
+	f, err := ioutil.TempFile(filepath.Dir(p), "."+filepath.Base(p)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary config file: %w", err)
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write temporary config file: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to sync temporary config file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close temporary config file: %w", err)
+	}
+	if err := os.Chmod(f.Name(), 0o644); err != nil {
+		return fmt.Errorf("failed to set config file permissions: %w", err)
+	}
+
+	if err := os.Rename(f.Name(), p); err != nil {
+		return fmt.Errorf("failed to move config file into place: %w", err)
+	}
+
+	return nil
+}
+
+func (t *TraefikFile) marshal(c *traefikConf.Configuration) ([]byte, error) {
+	if t.ext == ".toml" {
+		var buf bytes.Buffer
+		if err := toml.NewEncoder(&buf).Encode(c); err != nil {
+			return nil, err
+		}
+
+		return buf.Bytes(), nil
+	}
+
+	return yaml.Marshal(c)
+}
+
+// ClearAll cleans all configuration for all instances
+func (t *TraefikFile) ClearAll(ctx context.Context) error {
+	files, err := ioutil.ReadDir(t.config.Routing.File.Directory)
+	if err != nil {
+		return fmt.Errorf("failed to list config directory: %w", err)
+	}
+
+	for _, f := range files {
+		if f.IsDir() || !t.ownedFile.MatchString(f.Name()) {
+			continue
+		}
+
+		if err := t.remove(filepath.Join(t.config.Routing.File.Directory, f.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Instances returns the names of all instances which have configuration
+func (t *TraefikFile) Instances(ctx context.Context) ([]string, error) {
+	files, err := ioutil.ReadDir(t.config.Routing.File.Directory)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list config directory: %w", err)
+	}
+
+	instances := map[string]struct{}{}
+	for _, f := range files {
+		if !f.IsDir() && t.ownedFile.MatchString(f.Name()) {
+			instances[strings.TrimSuffix(f.Name(), t.ext)] = struct{}{}
+		}
+	}
+
+	return sortedInstances(instances), nil
+}
+
+// ClearConfig cleans out any configuration for an instance
+func (t *TraefikFile) ClearConfig(ctx context.Context, n string) error {
+	return t.remove(t.path(n))
+}
+
+// GenerateConfig writes the Traefik configuration for a webspace (leaving the file untouched if nothing changed)
+func (t *TraefikFile) GenerateConfig(ctx context.Context, ws *Webspace, addr string) error {
+	n := ws.InstanceName()
+
+	if addr == "" && t.config.Routing.WebspacedURL == "" {
+		// Traefik hooks (only used when webspaces aren't running) are disabled
+		return t.ClearConfig(ctx, n)
+	}
+
+	user, err := ws.GetUser(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get user: %w", err)
+	}
+
+	domains, err := ws.GetDomains(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get webspace domains: %w", err)
+	}
+
+	// We need a dummy server to satisfy Traefik when the webspace isn't running
+	backend := "1.1.1.1"
+	if addr != "" {
+		backend = addr
+	}
+
+	wsb := traefikConf.WebspaceBoot{
+		URL:      t.config.Routing.WebspacedURL,
+		IAMToken: t.config.Routing.IAMToken,
+		UserID:   ws.UserID,
+	}
+
+	var c traefikConf.Configuration
+	if !ws.Config.SNIPassthrough {
+		// SSL termination
+		rules := make([]string, len(domains))
+		for i, d := range domains {
+			rules[i] = fmt.Sprintf("Host(`%v`)", d)
+		}
+
+		tls := traefikConf.RouterTLSConfig{
+			CertResolver: t.config.Routing.File.CertResolver,
+			Domains: []traefikTypes.Domain{
+				{
+					Main: "*." + t.config.Webspaces.Domain,
+					SANs: t.config.Routing.DefaultSANs,
+				},
+			},
+		}
+		// ws.Domains only contains custom domains
+		if len(ws.Domains) > 0 {
+			if t.certs != nil {
+				// Traefik picks the certificate to use by SNI
+				if cert := t.certs.get(n); cert != nil {
+					c.TLS = &traefikConf.TLSConfiguration{
+						Certificates: []*traefikTLS.CertAndStores{
+							{
+								Certificate: traefikTLS.Certificate{
+									CertFile: traefikTLS.FileOrContent(cert.certFile),
+									KeyFile:  traefikTLS.FileOrContent(cert.keyFile),
+								},
+							},
+						},
+					}
+				}
+			} else if t.config.Routing.File.CertResolver == "" {
+				log.WithField("user", user.Username).Warn("No cert resolver is configured, ignoring custom domains")
+			} else {
+				tls.Domains = append(tls.Domains, traefikTypes.Domain{
+					Main: user.Username + "." + t.config.Webspaces.Domain,
+					SANs: ws.Domains,
+				})
+			}
+		}
+
+		passHostHeader := true
+		router := traefikConf.Router{
+			EntryPoints: []string{t.config.Routing.HTTPSEntryPoint},
+			Service:     n,
+			Rule:        strings.Join(rules, " || "),
+			TLS:         &tls,
+		}
+		c.HTTP = &traefikConf.HTTPConfiguration{
+			Routers: map[string]*traefikConf.Router{n: &router},
+			Services: map[string]*traefikConf.Service{
+				n: {
+					LoadBalancer: &traefikConf.ServersLoadBalancer{
+						Servers: []traefikConf.Server{
+							{URL: fmt.Sprintf("http://%v:%v", backend, ws.Config.HTTPPort)},
+						},
+						PassHostHeader: &passHostHeader,
+					},
+				},
+			},
+		}
+
+		if addr == "" {
+			c.HTTP.Middlewares = map[string]*traefikConf.Middleware{
+				n + "-boot": {WebspaceBoot: &wsb},
+			}
+			router.Middlewares = []string{n + "-boot"}
+		}
+
+		if t.certs != nil && len(ws.Domains) > 0 {
+			if err := t.acmeChallengeRoute(&c, n, ws.Domains); err != nil {
+				return err
+			}
+		}
+	} else {
+		// SNI passthrough
+		rules := make([]string, len(domains))
+		for i, d := range domains {
+			rules[i] = fmt.Sprintf("HostSNI(`%v`)", d)
+		}
+
+		router := traefikConf.TCPRouter{
+			EntryPoints: []string{t.config.Routing.HTTPSEntryPoint},
+			Service:     n,
+			Rule:        strings.Join(rules, " || "),
+			TLS: &traefikConf.RouterTCPTLSConfig{
+				Passthrough: true,
+			},
+		}
+		c.TCP = &traefikConf.TCPConfiguration{
+			Routers: map[string]*traefikConf.TCPRouter{n: &router},
+			Services: map[string]*traefikConf.TCPService{
+				n: {
+					LoadBalancer: &traefikConf.TCPServersLoadBalancer{
+						Servers: []traefikConf.TCPServer{
+							{Address: fmt.Sprintf("%v:%v", backend, ws.Config.HTTPPort)},
+						},
+					},
+				},
+			},
+		}
+
+		if addr == "" {
+			c.TCP.Middlewares = map[string]*traefikConf.TCPMiddleware{
+				n + "-boot": {WebspaceBoot: &wsb},
+			}
+			router.Middlewares = []string{n + "-boot"}
+		}
+	}
+
+	data, err := t.marshal(&c)
+	if err != nil {
+		return fmt.Errorf("failed to encode Traefik config: %w", err)
+	}
+
+	if err := t.write(t.path(n), data); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// acmeChallengeRoute adds a router which sends HTTP-01 challenge requests for a webspace's custom domains to
+// webspaced
+func (t *TraefikFile) acmeChallengeRoute(c *traefikConf.Configuration, n string, domains []string) error {
+	if t.config.Routing.WebspacedURL == "" {
+		log.WithField("instance", n).Warn("No webspaced URL is configured, ACME challenges won't be routed")
+		return nil
+	}
+
+	u, err := url.Parse(t.config.Routing.WebspacedURL)
+	if err != nil {
+		return fmt.Errorf("failed to parse webspaced URL: %w", err)
+	}
+
+	rules := make([]string, len(domains))
+	for i, d := range domains {
+		rules[i] = fmt.Sprintf("Host(`%v`)", d)
+	}
+
+	c.HTTP.Routers[n+"-acme"] = &traefikConf.Router{
+		EntryPoints: []string{t.config.Routing.HTTPEntryPoint},
+		Service:     n + "-acme",
+		Rule:        fmt.Sprintf("(%v) && PathPrefix(`/.well-known/acme-challenge/`)", strings.Join(rules, " || ")),
+		// Take priority over any HTTPS redirect on the same entrypoint
+		Priority: 1000,
+	}
+	c.HTTP.Services[n+"-acme"] = &traefikConf.Service{
+		LoadBalancer: &traefikConf.ServersLoadBalancer{
+			Servers: []traefikConf.Server{
+				{URL: u.Scheme + "://" + u.Host},
+			},
+		},
+	}
+
+	return nil
+}
@@ -4,11 +4,13 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"regexp"
 	"strings"
 
 	log "github.com/sirupsen/logrus"
 
 	k8sCore "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	k8sErrors "k8s.io/apimachinery/pkg/api/errors"
 	k8sMeta "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/intstr"
@@ -50,7 +52,7 @@ type TraefikKubernetes struct {
 }
 
 // NewTraefikKubernetes manages webspace configuration for Traefik via Kubernetes resources
-func NewTraefikKubernetes(cfg *config.Config) (Traefik, error) {
+func NewTraefikKubernetes(cfg *config.Config) (RoutingProvider, error) {
 	k8sConf, err := clientcmd.BuildConfigFromFlags("", os.Getenv(clientcmd.RecommendedConfigPathEnvVar))
 	if err != nil {
 		return nil, fmt.Errorf("failed to load Kubernetes config: %w", err)
@@ -74,15 +76,15 @@ func NewTraefikKubernetes(cfg *config.Config) (Traefik, error) {
 	return &TraefikKubernetes{
 		config: cfg,
 
-		epAPI:  k8s.CoreV1().Endpoints(cfg.Traefik.Kubernetes.Namespace),
-		svcAPI: k8s.CoreV1().Services(cfg.Traefik.Kubernetes.Namespace),
+		epAPI:  k8s.CoreV1().Endpoints(cfg.Routing.Kubernetes.Namespace),
+		svcAPI: k8s.CoreV1().Services(cfg.Routing.Kubernetes.Namespace),
 
-		mwAPI:    traefikK8s.TraefikV1alpha1().Middlewares(cfg.Traefik.Kubernetes.Namespace),
-		tcpMWAPI: traefikK8s.TraefikV1alpha1().MiddlewareTCPs(cfg.Traefik.Kubernetes.Namespace),
-		irAPI:    traefikK8s.TraefikV1alpha1().IngressRoutes(cfg.Traefik.Kubernetes.Namespace),
-		irTCPAPI: traefikK8s.TraefikV1alpha1().IngressRouteTCPs(cfg.Traefik.Kubernetes.Namespace),
+		mwAPI:    traefikK8s.TraefikV1alpha1().Middlewares(cfg.Routing.Kubernetes.Namespace),
+		tcpMWAPI: traefikK8s.TraefikV1alpha1().MiddlewareTCPs(cfg.Routing.Kubernetes.Namespace),
+		irAPI:    traefikK8s.TraefikV1alpha1().IngressRoutes(cfg.Routing.Kubernetes.Namespace),
+		irTCPAPI: traefikK8s.TraefikV1alpha1().IngressRouteTCPs(cfg.Routing.Kubernetes.Namespace),
 
-		certManagerAPI: cmK8s.CertmanagerV1().Certificates(cfg.Traefik.Kubernetes.Namespace),
+		certManagerAPI: cmK8s.CertmanagerV1().Certificates(cfg.Routing.Kubernetes.Namespace),
 	}, nil
 }
 
@@ -142,8 +144,103 @@ func (t *TraefikKubernetes) ClearAll(ctx context.Context) error {
 	return nil
 }
 
+// Instances returns the names of all instances which have configuration (any of the resources generated for them)
+func (t *TraefikKubernetes) Instances(ctx context.Context) ([]string, error) {
+	listOpts := k8sMeta.ListOptions{
+		LabelSelector: k8sMeta.FormatLabelSelector(&k8sMeta.LabelSelector{MatchLabels: k8sLabels}),
+	}
+
+	var names []string
+	irTCPs, err := t.irTCPAPI.List(ctx, listOpts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list Traefik IngressRouteTCP CRDs: %w", err)
+	}
+	for _, o := range irTCPs.Items {
+		names = append(names, o.Name)
+	}
+	irs, err := t.irAPI.List(ctx, listOpts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list Traefik IngressRoute CRDs: %w", err)
+	}
+	for _, o := range irs.Items {
+		names = append(names, o.Name)
+	}
+	tcpMWs, err := t.tcpMWAPI.List(ctx, listOpts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list Traefik TCP Middleware CRDs: %w", err)
+	}
+	for _, o := range tcpMWs.Items {
+		names = append(names, o.Name)
+	}
+	mws, err := t.mwAPI.List(ctx, listOpts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list Traefik Middleware CRDs: %w", err)
+	}
+	for _, o := range mws.Items {
+		names = append(names, o.Name)
+	}
+	certs, err := t.certManagerAPI.List(ctx, listOpts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list cert-manager Certificates: %w", err)
+	}
+	for _, o := range certs.Items {
+		names = append(names, o.Name)
+	}
+	svcs, err := t.svcAPI.List(ctx, listOpts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list Services: %w", err)
+	}
+	for _, o := range svcs.Items {
+		names = append(names, o.Name)
+	}
+	eps, err := t.epAPI.List(ctx, listOpts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list Endpoints: %w", err)
+	}
+	for _, o := range eps.Items {
+		names = append(names, o.Name)
+	}
+
+	// Resources are named <n>, <n>-boot (middlewares) and tls-<n> (certificates)
+	owned := regexp.MustCompile(`^` + regexp.QuoteMeta(t.config.Webspaces.InstancePrefix) + `u\d+$`)
+	instances := map[string]struct{}{}
+	for _, n := range names {
+		if n = strings.TrimSuffix(strings.TrimPrefix(n, "tls-"), "-boot"); owned.MatchString(n) {
+			instances[n] = struct{}{}
+		}
+	}
+
+	return sortedInstances(instances), nil
+}
+
 // ClearConfig cleans out any configuration for an instance
 func (t *TraefikKubernetes) ClearConfig(ctx context.Context, n string) error {
+	if err := t.deleteIngressRouteTCP(ctx, n); err != nil {
+		return err
+	}
+	if err := t.deleteIngressRoute(ctx, n); err != nil {
+		return err
+	}
+	if err := t.deleteMiddlewareTCP(ctx, n+"-boot"); err != nil {
+		return err
+	}
+	if err := t.deleteMiddleware(ctx, n+"-boot"); err != nil {
+		return err
+	}
+	if err := t.deleteCertificate(ctx, "tls-"+n); err != nil {
+		return err
+	}
+	if err := t.deleteService(ctx, n); err != nil {
+		return err
+	}
+	if err := t.deleteEndpoints(ctx, n); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (t *TraefikKubernetes) deleteIngressRouteTCP(ctx context.Context, n string) error {
 	if _, err := t.irTCPAPI.Get(ctx, n, k8sMeta.GetOptions{}); err != nil {
 		if !k8sErrors.IsNotFound(err) {
 			return fmt.Errorf("failed to get Traefik IngressRouteTCP CRD: %w", err)
@@ -151,6 +248,11 @@ func (t *TraefikKubernetes) ClearConfig(ctx context.Context, n string) error {
 	} else if err := t.irTCPAPI.Delete(ctx, n, k8sMeta.DeleteOptions{}); err != nil {
 		return fmt.Errorf("failed to delete Traefik IngressRouteTCP CRD: %w", err)
 	}
+
+	return nil
+}
+
+func (t *TraefikKubernetes) deleteIngressRoute(ctx context.Context, n string) error {
 	if _, err := t.irAPI.Get(ctx, n, k8sMeta.GetOptions{}); err != nil {
 		if !k8sErrors.IsNotFound(err) {
 			return fmt.Errorf("failed to get Traefik IngressRoute CRD: %w", err)
@@ -159,29 +261,46 @@ func (t *TraefikKubernetes) ClearConfig(ctx context.Context, n string) error {
 		return fmt.Errorf("failed to delete Traefik IngressRoute CRD: %w", err)
 	}
 
-	if _, err := t.tcpMWAPI.Get(ctx, n+"-boot", k8sMeta.GetOptions{}); err != nil {
+	return nil
+}
+
+func (t *TraefikKubernetes) deleteMiddlewareTCP(ctx context.Context, n string) error {
+	if _, err := t.tcpMWAPI.Get(ctx, n, k8sMeta.GetOptions{}); err != nil {
 		if !k8sErrors.IsNotFound(err) {
 			return fmt.Errorf("failed to get Traefik TCP Middleware CRD: %w", err)
 		}
-	} else if err := t.tcpMWAPI.Delete(ctx, n+"-boot", k8sMeta.DeleteOptions{}); err != nil {
+	} else if err := t.tcpMWAPI.Delete(ctx, n, k8sMeta.DeleteOptions{}); err != nil {
 		return fmt.Errorf("failed to delete Traefik TCP Middleware CRD: %w", err)
 	}
-	if _, err := t.mwAPI.Get(ctx, n+"-boot", k8sMeta.GetOptions{}); err != nil {
+
+	return nil
+}
+
+func (t *TraefikKubernetes) deleteMiddleware(ctx context.Context, n string) error {
+	if _, err := t.mwAPI.Get(ctx, n, k8sMeta.GetOptions{}); err != nil {
 		if !k8sErrors.IsNotFound(err) {
 			return fmt.Errorf("failed to get Traefik Middleware CRD: %w", err)
 		}
-	} else if err := t.mwAPI.Delete(ctx, n+"-boot", k8sMeta.DeleteOptions{}); err != nil {
+	} else if err := t.mwAPI.Delete(ctx, n, k8sMeta.DeleteOptions{}); err != nil {
 		return fmt.Errorf("failed to delete Traefik Middleware CRD: %w", err)
 	}
 
-	if _, err := t.certManagerAPI.Get(ctx, "tls-"+n, k8sMeta.GetOptions{}); err != nil {
+	return nil
+}
+
+func (t *TraefikKubernetes) deleteCertificate(ctx context.Context, n string) error {
+	if _, err := t.certManagerAPI.Get(ctx, n, k8sMeta.GetOptions{}); err != nil {
 		if !k8sErrors.IsNotFound(err) {
 			return fmt.Errorf("failed to get cert-manager Certificate: %w", err)
 		}
-	} else if err := t.certManagerAPI.Delete(ctx, "tls-"+n, k8sMeta.DeleteOptions{}); err != nil {
+	} else if err := t.certManagerAPI.Delete(ctx, n, k8sMeta.DeleteOptions{}); err != nil {
 		return fmt.Errorf("failed to delete cert-manager Certificate: %w", err)
 	}
 
+	return nil
+}
+
+func (t *TraefikKubernetes) deleteService(ctx context.Context, n string) error {
 	if _, err := t.svcAPI.Get(ctx, n, k8sMeta.GetOptions{}); err != nil {
 		if !k8sErrors.IsNotFound(err) {
 			return fmt.Errorf("failed to get Service: %w", err)
@@ -190,6 +309,10 @@ func (t *TraefikKubernetes) ClearConfig(ctx context.Context, n string) error {
 		return fmt.Errorf("failed to delete Service: %w", err)
 	}
 
+	return nil
+}
+
+func (t *TraefikKubernetes) deleteEndpoints(ctx context.Context, n string) error {
 	if _, err := t.epAPI.Get(ctx, n, k8sMeta.GetOptions{}); err != nil {
 		if !k8sErrors.IsNotFound(err) {
 			return fmt.Errorf("failed to get Endpoints: %w", err)
@@ -201,15 +324,207 @@ func (t *TraefikKubernetes) ClearConfig(ctx context.Context, n string) error {
 	return nil
 }
 
-// GenerateConfig generates new Traefik configuration for a webspace
-func (t *TraefikKubernetes) GenerateConfig(ctx context.Context, ws *Webspace, addr string) error {
-	if addr == "" && t.config.Traefik.WebspacedURL == "" {
-		// Traefik hooks (only used when webspaces aren't running) are disabled
+func (t *TraefikKubernetes) applyEndpoints(ctx context.Context, ep *k8sCore.Endpoints) error {
+	existing, err := t.epAPI.Get(ctx, ep.Name, k8sMeta.GetOptions{})
+	if err != nil {
+		if !k8sErrors.IsNotFound(err) {
+			return fmt.Errorf("failed to get Kubernetes Endpoints: %w", err)
+		}
+
+		if _, err := t.epAPI.Create(ctx, ep, k8sMeta.CreateOptions{}); err != nil {
+			return fmt.Errorf("failed to create Kubernetes Endpoints: %w", err)
+		}
+		return nil
+	}
+
+	if equality.Semantic.DeepEqual(existing.Labels, ep.Labels) &&
+		equality.Semantic.DeepEqual(existing.Subsets, ep.Subsets) {
+		return nil
+	}
+
+	existing.Labels = ep.Labels
+	existing.Subsets = ep.Subsets
+	if _, err := t.epAPI.Update(ctx, existing, k8sMeta.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to update Kubernetes Endpoints: %w", err)
+	}
+
+	return nil
+}
+
+func (t *TraefikKubernetes) applyService(ctx context.Context, svc *k8sCore.Service) error {
+	existing, err := t.svcAPI.Get(ctx, svc.Name, k8sMeta.GetOptions{})
+	if err != nil {
+		if !k8sErrors.IsNotFound(err) {
+			return fmt.Errorf("failed to get Kubernetes Service: %w", err)
+		}
+
+		if _, err := t.svcAPI.Create(ctx, svc, k8sMeta.CreateOptions{}); err != nil {
+			return fmt.Errorf("failed to create Kubernetes Service: %w", err)
+		}
+		return nil
+	}
+
+	// Kubernetes fills in a bunch of defaults in the spec, only compare the bits we care about (the cluster IP is
+	// immutable anyway)
+	if equality.Semantic.DeepEqual(existing.Labels, svc.Labels) &&
+		equality.Semantic.DeepEqual(existing.Spec.Ports, svc.Spec.Ports) {
+		return nil
+	}
+
+	existing.Labels = svc.Labels
+	existing.Spec.Ports = svc.Spec.Ports
+	if _, err := t.svcAPI.Update(ctx, existing, k8sMeta.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to update Kubernetes Service: %w", err)
+	}
+
+	return nil
+}
+
+func (t *TraefikKubernetes) applyCertificate(ctx context.Context, crt *cmCRD.Certificate) error {
+	existing, err := t.certManagerAPI.Get(ctx, crt.Name, k8sMeta.GetOptions{})
+	if err != nil {
+		if !k8sErrors.IsNotFound(err) {
+			return fmt.Errorf("failed to get cert-manager Certificate: %w", err)
+		}
+
+		if _, err := t.certManagerAPI.Create(ctx, crt, k8sMeta.CreateOptions{}); err != nil {
+			return fmt.Errorf("failed to create cert-manager Certificate: %w", err)
+		}
+		return nil
+	}
+
+	if equality.Semantic.DeepEqual(existing.Labels, crt.Labels) &&
+		equality.Semantic.DeepEqual(existing.Spec, crt.Spec) {
+		return nil
+	}
+
+	existing.Labels = crt.Labels
+	existing.Spec = crt.Spec
+	if _, err := t.certManagerAPI.Update(ctx, existing, k8sMeta.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to update cert-manager Certificate: %w", err)
+	}
+
+	return nil
+}
+
+func (t *TraefikKubernetes) applyMiddleware(ctx context.Context, m *traefikCRD.Middleware) error {
+	existing, err := t.mwAPI.Get(ctx, m.Name, k8sMeta.GetOptions{})
+	if err != nil {
+		if !k8sErrors.IsNotFound(err) {
+			return fmt.Errorf("failed to get Traefik Middleware CRD: %w", err)
+		}
+
+		if _, err := t.mwAPI.Create(ctx, m, k8sMeta.CreateOptions{}); err != nil {
+			return fmt.Errorf("failed to create Traefik Middleware CRD: %w", err)
+		}
+		return nil
+	}
+
+	if equality.Semantic.DeepEqual(existing.Labels, m.Labels) &&
+		equality.Semantic.DeepEqual(existing.Spec, m.Spec) {
+		return nil
+	}
+
+	existing.Labels = m.Labels
+	existing.Spec = m.Spec
+	if _, err := t.mwAPI.Update(ctx, existing, k8sMeta.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to update Traefik Middleware CRD: %w", err)
+	}
+
+	return nil
+}
+
+func (t *TraefikKubernetes) applyMiddlewareTCP(ctx context.Context, m *traefikCRD.MiddlewareTCP) error {
+	existing, err := t.tcpMWAPI.Get(ctx, m.Name, k8sMeta.GetOptions{})
+	if err != nil {
+		if !k8sErrors.IsNotFound(err) {
+			return fmt.Errorf("failed to get Traefik TCP Middleware CRD: %w", err)
+		}
+
+		if _, err := t.tcpMWAPI.Create(ctx, m, k8sMeta.CreateOptions{}); err != nil {
+			return fmt.Errorf("failed to create Traefik TCP Middleware CRD: %w", err)
+		}
+		return nil
+	}
+
+	if equality.Semantic.DeepEqual(existing.Labels, m.Labels) &&
+		equality.Semantic.DeepEqual(existing.Spec, m.Spec) {
+		return nil
+	}
+
+	existing.Labels = m.Labels
+	existing.Spec = m.Spec
+	if _, err := t.tcpMWAPI.Update(ctx, existing, k8sMeta.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to update Traefik TCP Middleware CRD: %w", err)
+	}
+
+	return nil
+}
+
+func (t *TraefikKubernetes) applyIngressRoute(ctx context.Context, ir *traefikCRD.IngressRoute) error {
+	existing, err := t.irAPI.Get(ctx, ir.Name, k8sMeta.GetOptions{})
+	if err != nil {
+		if !k8sErrors.IsNotFound(err) {
+			return fmt.Errorf("failed to get Traefik IngressRoute CRD: %w", err)
+		}
+
+		if _, err := t.irAPI.Create(ctx, ir, k8sMeta.CreateOptions{}); err != nil {
+			return fmt.Errorf("failed to create Traefik IngressRoute CRD: %w", err)
+		}
+		return nil
+	}
+
+	if equality.Semantic.DeepEqual(existing.Labels, ir.Labels) &&
+		equality.Semantic.DeepEqual(existing.Spec, ir.Spec) {
 		return nil
 	}
 
+	existing.Labels = ir.Labels
+	existing.Spec = ir.Spec
+	if _, err := t.irAPI.Update(ctx, existing, k8sMeta.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to update Traefik IngressRoute CRD: %w", err)
+	}
+
+	return nil
+}
+
+func (t *TraefikKubernetes) applyIngressRouteTCP(ctx context.Context, ir *traefikCRD.IngressRouteTCP) error {
+	existing, err := t.irTCPAPI.Get(ctx, ir.Name, k8sMeta.GetOptions{})
+	if err != nil {
+		if !k8sErrors.IsNotFound(err) {
+			return fmt.Errorf("failed to get Traefik IngressRouteTCP CRD: %w", err)
+		}
+
+		if _, err := t.irTCPAPI.Create(ctx, ir, k8sMeta.CreateOptions{}); err != nil {
+			return fmt.Errorf("failed to create Traefik IngressRouteTCP CRD: %w", err)
+		}
+		return nil
+	}
+
+	if equality.Semantic.DeepEqual(existing.Labels, ir.Labels) &&
+		equality.Semantic.DeepEqual(existing.Spec, ir.Spec) {
+		return nil
+	}
+
+	existing.Labels = ir.Labels
+	existing.Spec = ir.Spec
+	if _, err := t.irTCPAPI.Update(ctx, existing, k8sMeta.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to update Traefik IngressRouteTCP CRD: %w", err)
+	}
+
+	return nil
+}
+
+// GenerateConfig creates or updates the Traefik configuration for a webspace, removing any resources which are no
+// longer needed. Resources which are already up to date are left untouched.
+func (t *TraefikKubernetes) GenerateConfig(ctx context.Context, ws *Webspace, addr string) error {
 	n := ws.InstanceName()
 
+	if addr == "" && t.config.Routing.WebspacedURL == "" {
+		// Traefik hooks (only used when webspaces aren't running) are disabled
+		return t.ClearConfig(ctx, n)
+	}
+
 	user, err := ws.GetUser(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to get user: %w", err)
@@ -221,8 +536,8 @@ func (t *TraefikKubernetes) GenerateConfig(ctx context.Context, ws *Webspace, ad
 	}
 
 	wsb := traefikConf.WebspaceBoot{
-		URL:      t.config.Traefik.WebspacedURL,
-		IAMToken: t.config.Traefik.IAMToken,
+		URL:      t.config.Routing.WebspacedURL,
+		IAMToken: t.config.Routing.IAMToken,
 		UserID:   ws.UserID,
 	}
 
@@ -252,8 +567,8 @@ func (t *TraefikKubernetes) GenerateConfig(ctx context.Context, ws *Webspace, ad
 	if addr != "" {
 		ep.Subsets[0].Addresses[0].IP = addr
 	}
-	if _, err := t.epAPI.Create(ctx, &ep, k8sMeta.CreateOptions{}); err != nil {
-		return fmt.Errorf("failed to create Kubernetes Endpoints: %w", err)
+	if err := t.applyEndpoints(ctx, &ep); err != nil {
+		return err
 	}
 
 	svc := k8sCore.Service{
@@ -268,28 +583,31 @@ func (t *TraefikKubernetes) GenerateConfig(ctx context.Context, ws *Webspace, ad
 					Name:     "http",
 					Port:     int32(ws.Config.HTTPPort),
 					Protocol: k8sCore.ProtocolTCP,
+					// Set explicitly (rather than letting Kubernetes default it) so we can compare against it
+					TargetPort: intstr.FromInt(int(ws.Config.HTTPPort)),
 				},
 			},
 		},
 	}
-	if _, err := t.svcAPI.Create(ctx, &svc, k8sMeta.CreateOptions{}); err != nil {
-		return fmt.Errorf("failed to create Kubernetes Service: %w", err)
+	if err := t.applyService(ctx, &svc); err != nil {
+		return err
 	}
 
 	if !ws.Config.SNIPassthrough {
 		var tls traefikCRD.TLS
+		useCert := false
 		// ws.Domains only contains custom domains
-		if len(ws.Domains) == 0 || t.config.Traefik.Kubernetes.ClusterIssuer == "" {
-			if t.config.Traefik.Kubernetes.ClusterIssuer == "" {
+		if len(ws.Domains) == 0 || t.config.Routing.Kubernetes.ClusterIssuer == "" {
+			if t.config.Routing.Kubernetes.ClusterIssuer == "" {
 				log.WithField("user", user.Username).Warn("No ClusterIssuer is configured, ignoring custom domains")
 			}
 
 			tls = traefikCRD.TLS{
-				SecretName: t.config.Traefik.Kubernetes.DefaultSecret,
+				SecretName: t.config.Routing.Kubernetes.DefaultSecret,
 				Domains: []traefikTypes.Domain{
 					{
 						Main: "*." + t.config.Webspaces.Domain,
-						SANs: t.config.Traefik.DefaultSANs,
+						SANs: t.config.Routing.DefaultSANs,
 					},
 				},
 			}
@@ -308,13 +626,14 @@ func (t *TraefikKubernetes) GenerateConfig(ctx context.Context, ws *Webspace, ad
 					DNSNames: ws.Domains,
 					IssuerRef: cmMeta.ObjectReference{
 						Kind: "ClusterIssuer",
-						Name: t.config.Traefik.Kubernetes.ClusterIssuer,
+						Name: t.config.Routing.Kubernetes.ClusterIssuer,
 					},
 				},
 			}
-			if _, err := t.certManagerAPI.Create(ctx, &crt, k8sMeta.CreateOptions{}); err != nil {
-				return fmt.Errorf("failed to create cert-manager Certificate: %w", err)
+			if err := t.applyCertificate(ctx, &crt); err != nil {
+				return err
 			}
+			useCert = true
 
 			tls = traefikCRD.TLS{
 				SecretName: s,
@@ -339,7 +658,7 @@ func (t *TraefikKubernetes) GenerateConfig(ctx context.Context, ws *Webspace, ad
 				Labels: k8sLabels,
 			},
 			Spec: traefikCRD.IngressRouteSpec{
-				EntryPoints: []string{t.config.Traefik.HTTPSEntryPoint},
+				EntryPoints: []string{t.config.Routing.HTTPSEntryPoint},
 				Routes: []traefikCRD.Route{
 					{
 						Kind:  "Rule",
@@ -371,8 +690,8 @@ func (t *TraefikKubernetes) GenerateConfig(ctx context.Context, ws *Webspace, ad
 				},
 			}
 
-			if _, err := t.mwAPI.Create(ctx, &m, k8sMeta.CreateOptions{}); err != nil {
-				return fmt.Errorf("failed to create WebspaceBoot middleware: %w", err)
+			if err := t.applyMiddleware(ctx, &m); err != nil {
+				return err
 			}
 
 			ir.Spec.Routes[0].Middlewares = []traefikCRD.MiddlewareRef{
@@ -382,8 +701,26 @@ func (t *TraefikKubernetes) GenerateConfig(ctx context.Context, ws *Webspace, ad
 			}
 		}
 
-		if _, err := t.irAPI.Create(ctx, &ir, k8sMeta.CreateOptions{}); err != nil {
-			return fmt.Errorf("failed to create IngressRoute CRD: %w", err)
+		if err := t.applyIngressRoute(ctx, &ir); err != nil {
+			return err
+		}
+
+		// Clean up anything left over from a previous configuration (only once the new route is in place)
+		if err := t.deleteIngressRouteTCP(ctx, n); err != nil {
+			return err
+		}
+		if err := t.deleteMiddlewareTCP(ctx, n+"-boot"); err != nil {
+			return err
+		}
+		if addr != "" {
+			if err := t.deleteMiddleware(ctx, n+"-boot"); err != nil {
+				return err
+			}
+		}
+		if !useCert {
+			if err := t.deleteCertificate(ctx, "tls-"+n); err != nil {
+				return err
+			}
 		}
 	} else {
 		rules := make([]string, len(domains))
@@ -398,7 +735,7 @@ func (t *TraefikKubernetes) GenerateConfig(ctx context.Context, ws *Webspace, ad
 				Labels: k8sLabels,
 			},
 			Spec: traefikCRD.IngressRouteTCPSpec{
-				EntryPoints: []string{t.config.Traefik.HTTPSEntryPoint},
+				EntryPoints: []string{t.config.Routing.HTTPSEntryPoint},
 				Routes: []traefikCRD.RouteTCP{
 					{
 						Match: rule,
@@ -427,8 +764,8 @@ func (t *TraefikKubernetes) GenerateConfig(ctx context.Context, ws *Webspace, ad
 				},
 			}
 
-			if _, err := t.tcpMWAPI.Create(ctx, &m, k8sMeta.CreateOptions{}); err != nil {
-				return fmt.Errorf("failed to create WebspaceBoot TCP middleware: %w", err)
+			if err := t.applyMiddlewareTCP(ctx, &m); err != nil {
+				return err
 			}
 
 			ir.Spec.Routes[0].Middlewares = []traefikCRD.ObjectReference{
@@ -438,10 +775,82 @@ func (t *TraefikKubernetes) GenerateConfig(ctx context.Context, ws *Webspace, ad
 			}
 		}
 
-		if _, err := t.irTCPAPI.Create(ctx, &ir, k8sMeta.CreateOptions{}); err != nil {
-			return fmt.Errorf("failed to create IngressRoute CRD: %w", err)
+		if err := t.applyIngressRouteTCP(ctx, &ir); err != nil {
+			return err
+		}
+
+		if err := t.deleteIngressRoute(ctx, n); err != nil {
+			return err
+		}
+		if err := t.deleteMiddleware(ctx, n+"-boot"); err != nil {
+			return err
+		}
+		if addr != "" {
+			if err := t.deleteMiddlewareTCP(ctx, n+"-boot"); err != nil {
+				return err
+			}
+		}
+		if err := t.deleteCertificate(ctx, "tls-"+n); err != nil {
+			return err
 		}
 	}
 
 	return nil
 }
+
+// certificateStatus reports on the cert-manager Certificate for a webspace's custom domain
+func (t *TraefikKubernetes) certificateStatus(ctx context.Context, ws *Webspace, domain string) (CertificateStatus, error) {
+	s := CertificateStatus{Source: "cert-manager", Status: CertificatePending}
+	if t.config.Routing.Kubernetes.ClusterIssuer == "" {
+		s.Source = "none"
+		s.Status = CertificateFailed
+		s.Error = "no ClusterIssuer is configured"
+		return s, nil
+	}
+
+	crt, err := t.certManagerAPI.Get(ctx, "tls-"+ws.InstanceName(), k8sMeta.GetOptions{})
+	if err != nil {
+		if k8sErrors.IsNotFound(err) {
+			return s, nil
+		}
+
+		return s, fmt.Errorf("failed to get cert-manager Certificate: %w", err)
+	}
+
+	if crt.Status.NotAfter != nil {
+		s.NotAfter = &crt.Status.NotAfter.Time
+	}
+
+	covered := false
+	for _, d := range crt.Spec.DNSNames {
+		if d == domain {
+			covered = true
+			break
+		}
+	}
+
+	var ready, issuing *cmCRD.CertificateCondition
+	for i, c := range crt.Status.Conditions {
+		switch c.Type {
+		case cmCRD.CertificateConditionReady:
+			ready = &crt.Status.Conditions[i]
+		case cmCRD.CertificateConditionIssuing:
+			issuing = &crt.Status.Conditions[i]
+		}
+	}
+
+	if crt.Status.LastFailureTime != nil {
+		// cert-manager will retry with backoff, but issuance (or renewal) is currently failing
+		s.Status = CertificateFailed
+		if issuing != nil && issuing.Message != "" {
+			s.Error = issuing.Message
+		} else if ready != nil {
+			s.Error = ready.Message
+		}
+	}
+	if covered && ready != nil && ready.Status == cmMeta.ConditionTrue {
+		s.Status = CertificateReady
+	}
+
+	return s, nil
+}
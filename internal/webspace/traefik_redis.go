@@ -3,6 +3,7 @@ package webspace
 import (
 	"context"
 	"fmt"
+	"regexp"
 	"strconv"
 	"strings"
 
@@ -11,99 +12,145 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-// TODO: Get this working with new Traefik fork!
+// redisRootKey is the root key Traefik's Redis provider reads configuration from
+const redisRootKey = "traefik"
+
+// redisScanCount is a hint for how many keys Redis should return per SCAN iteration
+const redisScanCount = 100
 
 // TraefikRedis manages webspace configuration for Traefik via Redis
 type TraefikRedis struct {
 	config *config.Config
 	redis  *redis.Client
+
+	// ownedName matches the names of routers, services and middlewares which webspaced generates (including the
+	// `<name>-https` routers generated by older versions)
+	ownedName *regexp.Regexp
 }
 
 // NewTraefikRedis creates a new Traefik config manager using Redis
-func NewTraefikRedis(cfg *config.Config) Traefik {
+func NewTraefikRedis(cfg *config.Config) RoutingProvider {
 	client := redis.NewClient(&redis.Options{
-		Addr: cfg.Traefik.Redis.Addr,
-		DB:   cfg.Traefik.Redis.DB,
+		Addr: cfg.Routing.Redis.Addr,
+		DB:   cfg.Routing.Redis.DB,
 	})
 
 	return &TraefikRedis{
-		cfg,
-		client,
+		config: cfg,
+		redis:  client,
+
+		ownedName: regexp.MustCompile(`^` + regexp.QuoteMeta(cfg.Webspaces.InstancePrefix) + `u\d+(-boot|-https)?$`),
+	}
+}
+
+// escapeGlob escapes characters which have special meaning in a Redis MATCH pattern
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
+
+// scanKeys returns all keys matching a pattern for which keep returns true
+func (t *TraefikRedis) scanKeys(ctx context.Context, pattern string, keep func(string) bool) ([]string, error) {
+	var keys []string
+	iter := t.redis.WithContext(ctx).Scan(0, pattern, redisScanCount).Iterator()
+	for iter.Next() {
+		if k := iter.Val(); keep(k) {
+			keys = append(keys, k)
+		}
 	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("failed to scan redis keys: %w", err)
+	}
+
+	return keys, nil
 }
 
+// ownedKey returns true if a key is part of the configuration for a webspace router, service or middleware (i.e.
+// traefik/<http|tcp>/<routers|services|middlewares>/<name>/...)
+func (t *TraefikRedis) ownedKey(k string) bool {
+	parts := strings.SplitN(k, "/", 5)
+	return len(parts) == 5 && parts[0] == redisRootKey && t.ownedName.MatchString(parts[3])
+}
+
+// instanceKeys returns all existing keys which make up the configuration for an instance. Keys for the separate
+// `<n>-https` routers which older versions generated are included so they get cleaned up.
+func (t *TraefikRedis) instanceKeys(ctx context.Context, n string) ([]string, error) {
+	return t.scanKeys(ctx, fmt.Sprintf("%v/*/*/%v*", redisRootKey, escapeGlob(n)), func(k string) bool {
+		parts := strings.SplitN(k, "/", 5)
+		return len(parts) == 5 && (parts[3] == n || parts[3] == n+"-boot" || parts[3] == n+"-https")
+	})
+}
+
+// ClearAll cleans all configuration for all instances
 func (t *TraefikRedis) ClearAll(ctx context.Context) error {
-	// TODO: Implement!
+	pattern := fmt.Sprintf("%v/*/*/%vu*", redisRootKey, escapeGlob(t.config.Webspaces.InstancePrefix))
+	keys, err := t.scanKeys(ctx, pattern, t.ownedKey)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	if err := t.redis.WithContext(ctx).Del(keys...).Err(); err != nil {
+		return fmt.Errorf("failed to delete redis keys: %w", err)
+	}
+
 	return nil
 }
 
+// Instances returns the names of all instances which have configuration
+func (t *TraefikRedis) Instances(ctx context.Context) ([]string, error) {
+	pattern := fmt.Sprintf("%v/*/*/%vu*", redisRootKey, escapeGlob(t.config.Webspaces.InstancePrefix))
+	keys, err := t.scanKeys(ctx, pattern, t.ownedKey)
+	if err != nil {
+		return nil, err
+	}
+
+	instances := map[string]struct{}{}
+	for _, k := range keys {
+		name := strings.SplitN(k, "/", 5)[3]
+		instances[strings.TrimSuffix(strings.TrimSuffix(name, "-boot"), "-https")] = struct{}{}
+	}
+
+	return sortedInstances(instances), nil
+}
+
 // ClearConfig cleans out any configuration for an instance
 func (t *TraefikRedis) ClearConfig(ctx context.Context, n string) error {
-	if _, err := t.redis.TxPipelined(func(pipe redis.Pipeliner) error {
-		pipe.Del(
-			fmt.Sprintf("traefik/http/services/%v/loadbalancer/servers/0/url", n),
-			fmt.Sprintf("traefik/http/services/%v/loadbalancer/passhostheader", n),
-
-			fmt.Sprintf("traefik/http/middlewares/%v-boot/webspaceBoot/url", n),
-			fmt.Sprintf("traefik/http/middlewares/%v-boot/webspaceBoot/iamToken", n),
-			fmt.Sprintf("traefik/http/middlewares/%v-boot/webspaceBoot/userID", n),
-			fmt.Sprintf("traefik/http/routers/%v/middlewares/0", n),
-
-			fmt.Sprintf("traefik/http/routers/%v/service", n),
-			fmt.Sprintf("traefik/http/routers/%v/rule", n),
-			fmt.Sprintf("traefik/http/routers/%v/entrypoints/0", n),
-
-			fmt.Sprintf("traefik/http/routers/%v-https/service", n),
-			fmt.Sprintf("traefik/http/routers/%v-https/rule", n),
-			fmt.Sprintf("traefik/http/routers/%v-https/entrypoints/0", n),
-			fmt.Sprintf("traefik/http/routers/%v-https/middlewares/0", n),
-
-			fmt.Sprintf("traefik/http/routers/%v-https/tls", n),
-			fmt.Sprintf("traefik/http/routers/%v-https/tls/domains/0/main", n),
-			fmt.Sprintf("traefik/http/routers/%v-https/tls/certresolver", n),
-
-			fmt.Sprintf("traefik/tcp/services/%v/loadbalancer/servers/0/address", n),
-
-			fmt.Sprintf("traefik/tcp/routers/%v-https/service", n),
-			fmt.Sprintf("traefik/tcp/routers/%v-https/rule", n),
-			fmt.Sprintf("traefik/tcp/routers/%v-https/entrypoints/0", n),
-
-			fmt.Sprintf("traefik/tcp/routers/%v-https/tls", n),
-			fmt.Sprintf("traefik/tcp/routers/%v-https/tls/domains/0/main", n),
-			fmt.Sprintf("traefik/tcp/routers/%v-https/tls/certresolver", n),
-			fmt.Sprintf("traefik/tcp/routers/%v-https/tls/passthrough", n),
-
-			fmt.Sprintf("traefik/tcp/routers/%v-https/webspaceboot/url", n),
-			fmt.Sprintf("traefik/tcp/routers/%v-https/webspaceboot/iamToken", n),
-			fmt.Sprintf("traefik/tcp/routers/%v-https/webspaceboot/userID", n),
-		)
-
-		if len(t.config.Traefik.DefaultSANs) > 0 {
-			keys := make([]string, 2*len(t.config.Traefik.DefaultSANs))
-			for i := 0; i < len(t.config.Traefik.DefaultSANs); i++ {
-				keys[i*2] = fmt.Sprintf("traefik/http/routers/%v-https/tls/domains/0/sans/%v", n, i)
-				keys[i*2+1] = fmt.Sprintf("traefik/tcp/routers/%v-https/tls/domains/0/sans/%v", n, i)
-			}
-			pipe.Del(keys...)
-		}
-
+	keys, err := t.instanceKeys(ctx, n)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
 		return nil
-	}); err != nil {
+	}
+
+	if err := t.redis.WithContext(ctx).Del(keys...).Err(); err != nil {
 		return fmt.Errorf("failed to delete redis keys: %w", err)
 	}
 
 	return nil
 }
 
-// GenerateConfig generates new Traefik configuration for a webspace
+// GenerateConfig replaces the Traefik configuration for a webspace. Old keys are removed in the same transaction
+// so Traefik never sees a partial configuration.
 func (t *TraefikRedis) GenerateConfig(ctx context.Context, ws *Webspace, addr string) error {
-	if addr == "" && t.config.Traefik.WebspacedURL == "" {
+	n := ws.InstanceName()
+
+	if addr == "" && t.config.Routing.WebspacedURL == "" {
 		// Traefik hooks (only used when webspaces aren't running) are disabled
-		return nil
+		return t.ClearConfig(ctx, n)
 	}
 
-	n := ws.InstanceName()
-
 	user, err := ws.GetUser(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to get user: %w", err)
@@ -114,115 +161,97 @@ func (t *TraefikRedis) GenerateConfig(ctx context.Context, ws *Webspace, addr st
 		return fmt.Errorf("failed to get webspace domains: %w", err)
 	}
 
-	rules := make([]string, len(domains))
-	for i, d := range domains {
-		rules[i] = fmt.Sprintf("Host(`%v`)", d)
-	}
-	rule := strings.Join(rules, " || ")
-
-	if _, err := t.redis.TxPipelined(func(pipe redis.Pipeliner) error {
-		if addr != "" {
-			pipe.Set(
-				fmt.Sprintf("traefik/http/services/%v/loadbalancer/servers/0/url", n),
-				fmt.Sprintf("http://%v:%v", addr, ws.Config.HTTPPort),
-				0,
-			)
-		} else {
-			// Needed so that load balancer mode is engaged
-			pipe.Set(fmt.Sprintf("traefik/http/services/%v/loadbalancer/passhostheader", n), true, 0)
-
-			pipe.Set(
-				fmt.Sprintf("traefik/http/middlewares/%v-boot/webspaceBoot/url", n),
-				t.config.Traefik.WebspacedURL,
-				0,
-			)
-			pipe.Set(
-				fmt.Sprintf("traefik/http/middlewares/%v-boot/webspaceBoot/iamToken", n),
-				t.config.Traefik.IAMToken,
-				0,
-			)
-			pipe.Set(fmt.Sprintf("traefik/http/middlewares/%v-boot/webspaceBoot/userID", n), strconv.Itoa(ws.UserID), 0)
-			pipe.Set(fmt.Sprintf("traefik/http/routers/%v/middlewares/0", n), n+"-boot", 0)
-		}
+	old, err := t.instanceKeys(ctx, n)
+	if err != nil {
+		return err
+	}
+
+	// We need a dummy server to satisfy Traefik when the webspace isn't running
+	backend := "1.1.1.1"
+	if addr != "" {
+		backend = addr
+	}
 
-		pipe.Set(fmt.Sprintf("traefik/http/routers/%v/service", n), n, 0)
-		pipe.Set(fmt.Sprintf("traefik/http/routers/%v/rule", n), rule, 0)
-		pipe.Set(fmt.Sprintf("traefik/http/routers/%v/entrypoints/0", n), t.config.Traefik.HTTPSEntryPoint, 0)
+	values := map[string]interface{}{}
+	set := func(v interface{}, format string, a ...interface{}) {
+		values[fmt.Sprintf("%v/"+format, append([]interface{}{redisRootKey}, a...)...)] = v
+	}
 
-		var rt string
-		if !ws.Config.SNIPassthrough {
-			// SSL termination
-			rt = "http"
+	var rt string
+	if !ws.Config.SNIPassthrough {
+		// SSL termination
+		rt = "http"
 
-			if len(domains) > 1 {
-				log.WithField("user", user.Username).Warn("Using SSL termination with custom domains - these will be ignored")
-			}
+		set(fmt.Sprintf("http://%v:%v", backend, ws.Config.HTTPPort), "http/services/%v/loadbalancer/servers/0/url", n)
 
-			pipe.Set(fmt.Sprintf("traefik/http/routers/%v-https/service", n), n, 0)
-			pipe.Set(
-				fmt.Sprintf("traefik/http/routers/%v-https/rule", n),
-				fmt.Sprintf("Host(`%v.%v`)", user.Username, t.config.Webspaces.Domain),
-				0,
-			)
+		rules := make([]string, len(domains))
+		for i, d := range domains {
+			rules[i] = fmt.Sprintf("Host(`%v`)", d)
+		}
+		set(strings.Join(rules, " || "), "http/routers/%v/rule", n)
 
-			if addr == "" {
-				pipe.Set(fmt.Sprintf("traefik/http/routers/%v-https/middlewares/0", n), n+"-boot", 0)
-			}
-		} else {
-			// SNI passthrough
-			rt = "tcp"
-
-			if addr != "" {
-				pipe.Set(
-					fmt.Sprintf("traefik/tcp/services/%v/loadbalancer/servers/0/address", n),
-					fmt.Sprintf("%v:%v", addr, ws.Config.HTTPPort),
-					0,
-				)
-				pipe.Set(fmt.Sprintf("traefik/tcp/routers/%v-https/service", n), n, 0)
+		set("true", "http/routers/%v/tls", n)
+		set("*."+t.config.Webspaces.Domain, "http/routers/%v/tls/domains/0/main", n)
+		for i, san := range t.config.Routing.DefaultSANs {
+			set(san, "http/routers/%v/tls/domains/0/sans/%v", n, i)
+		}
+
+		// ws.Domains only contains custom domains
+		if len(ws.Domains) > 0 {
+			if t.config.Routing.Redis.CertResolver == "" {
+				log.WithField("user", user.Username).Warn("No cert resolver is configured, ignoring custom domains")
 			} else {
-				pipe.Set(fmt.Sprintf("traefik/tcp/routers/%v-https/webspaceboot/url", n), t.config.Traefik.WebspacedURL, 0)
-				pipe.Set(fmt.Sprintf("traefik/tcp/routers/%v-https/webspaceboot/iamToken", n), t.config.Traefik.IAMToken, 0)
-				pipe.Set(fmt.Sprintf("traefik/tcp/routers/%v-https/webspaceboot/userID", n), ws.UserID, 0)
+				set(user.Username+"."+t.config.Webspaces.Domain, "http/routers/%v/tls/domains/1/main", n)
+				for i, d := range ws.Domains {
+					set(d, "http/routers/%v/tls/domains/1/sans/%v", n, i)
+				}
 			}
+		}
+		if t.config.Routing.Redis.CertResolver != "" {
+			set(t.config.Routing.Redis.CertResolver, "http/routers/%v/tls/certresolver", n)
+		}
+	} else {
+		// SNI passthrough
+		rt = "tcp"
 
-			sniRules := make([]string, len(domains))
-			for i, d := range domains {
-				sniRules[i] = fmt.Sprintf("HostSNI(`%v`)", d)
-			}
-			sniRule := strings.Join(sniRules, " || ")
+		set(fmt.Sprintf("%v:%v", backend, ws.Config.HTTPPort), "tcp/services/%v/loadbalancer/servers/0/address", n)
 
-			pipe.Set(fmt.Sprintf("traefik/tcp/routers/%v-https/rule", n), sniRule, 0)
+		rules := make([]string, len(domains))
+		for i, d := range domains {
+			rules[i] = fmt.Sprintf("HostSNI(`%v`)", d)
+		}
+		set(strings.Join(rules, " || "), "tcp/routers/%v/rule", n)
+
+		set("true", "tcp/routers/%v/tls", n)
+		set("true", "tcp/routers/%v/tls/passthrough", n)
+	}
+
+	set(n, "%v/routers/%v/service", rt, n)
+	set(t.config.Routing.HTTPSEntryPoint, "%v/routers/%v/entrypoints/0", rt, n)
 
-			pipe.Set(fmt.Sprintf("traefik/tcp/routers/%v-https/tls/passthrough", n), "true", 0)
+	if addr == "" {
+		// The Netsoc Traefik fork provides the webspaceBoot middleware for both HTTP and TCP routers
+		set(t.config.Routing.WebspacedURL, "%v/middlewares/%v-boot/webspaceBoot/url", rt, n)
+		set(t.config.Routing.IAMToken, "%v/middlewares/%v-boot/webspaceBoot/iamToken", rt, n)
+		set(strconv.Itoa(ws.UserID), "%v/middlewares/%v-boot/webspaceBoot/userID", rt, n)
+		set(n+"-boot", "%v/routers/%v/middlewares/0", rt, n)
+	}
+
+	var stale []string
+	for _, k := range old {
+		if _, ok := values[k]; !ok {
+			stale = append(stale, k)
 		}
+	}
 
-		pipe.Set(
-			fmt.Sprintf("traefik/%v/routers/%v-https/entrypoints/0", rt, n),
-			t.config.Traefik.HTTPSEntryPoint,
-			0,
-		)
-
-		// TLS-specific configuration
-		pipe.Set(fmt.Sprintf("traefik/%v/routers/%v-https/tls", rt, n), "true", 0)
-		pipe.Set(
-			fmt.Sprintf("traefik/%v/routers/%v-https/tls/domains/0/main", rt, n),
-			"*."+t.config.Webspaces.Domain,
-			0,
-		)
-		if t.config.Traefik.Redis.CertResolver != "" {
-			pipe.Set(
-				fmt.Sprintf("traefik/%v/routers/%v-https/tls/certresolver", rt, n),
-				t.config.Traefik.Redis.CertResolver,
-				0,
-			)
+	if _, err := t.redis.WithContext(ctx).TxPipelined(func(pipe redis.Pipeliner) error {
+		if len(stale) > 0 {
+			pipe.Del(stale...)
 		}
-		for i, san := range t.config.Traefik.DefaultSANs {
-			pipe.Set(
-				fmt.Sprintf("traefik/%v/routers/%v-https/tls/domains/0/sans/%v", rt, n, i),
-				san,
-				0,
-			)
+		for k, v := range values {
+			pipe.Set(k, v, 0)
 		}
+
 		return nil
 	}); err != nil {
 		return fmt.Errorf("failed to set redis values: %w", err)
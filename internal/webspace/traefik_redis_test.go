@@ -0,0 +1,228 @@
+package webspace
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/go-redis/redis/v7"
+	iam "github.com/netsoc/iam/client"
+
+	"github.com/netsoc/webspaced/internal/config"
+)
+
+// testTraefikRedis creates a Redis config provider using the server at REDIS_ADDR, skipping the test if it's not set.
+// Any keys for the test instances are removed before and after the test.
+func testTraefikRedis(t *testing.T) (*TraefikRedis, *Manager) {
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		t.Skip("REDIS_ADDR not set")
+	}
+
+	cfg := &config.Config{}
+	cfg.Webspaces.InstancePrefix = "wstest-"
+	cfg.Webspaces.Domain = "ng.localhost"
+	cfg.Routing.Redis.Addr = addr
+	cfg.Routing.HTTPSEntryPoint = "https"
+	cfg.Routing.WebspacedURL = "http://webspaced"
+	cfg.Routing.IAMToken = "token"
+
+	r := NewTraefikRedis(cfg).(*TraefikRedis)
+	clean := func() {
+		keys, err := r.redis.Keys(redisRootKey + "/*/*/wstest-*").Result()
+		if err != nil {
+			t.Fatalf("failed to list keys: %v", err)
+		}
+		if len(keys) > 0 {
+			if err := r.redis.Del(keys...).Err(); err != nil {
+				t.Fatalf("failed to delete keys: %v", err)
+			}
+		}
+	}
+	clean()
+	t.Cleanup(func() {
+		clean()
+		r.redis.Close()
+	})
+
+	return r, &Manager{config: cfg}
+}
+
+func testRedisWebspace(m *Manager, uid int, username string) *Webspace {
+	return &Webspace{
+		manager: m,
+		user:    &iam.User{Username: username},
+		UserID:  uid,
+		Config:  config.WebspaceConfig{HTTPPort: 80},
+	}
+}
+
+// redisKeys returns the sorted keys matching a pattern
+func redisKeys(t *testing.T, r *TraefikRedis, pattern string) []string {
+	t.Helper()
+
+	keys, err := r.redis.Keys(pattern).Result()
+	if err != nil {
+		t.Fatalf("failed to list keys: %v", err)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+func expectRedisValue(t *testing.T, r *TraefikRedis, k, expected string) {
+	t.Helper()
+
+	v, err := r.redis.Get(k).Result()
+	if err == redis.Nil {
+		t.Errorf("key %v missing", k)
+		return
+	} else if err != nil {
+		t.Fatalf("failed to get %v: %v", k, err)
+	}
+
+	if v != expected {
+		t.Errorf("key %v is %q, expected %q", k, v, expected)
+	}
+}
+
+func expectRedisMissing(t *testing.T, r *TraefikRedis, keys ...string) {
+	t.Helper()
+
+	n, err := r.redis.Exists(keys...).Result()
+	if err != nil {
+		t.Fatalf("failed to check keys: %v", err)
+	}
+	if n != 0 {
+		t.Errorf("expected keys %v to have been deleted", keys)
+	}
+}
+
+func setRedisKeys(t *testing.T, r *TraefikRedis, keys ...string) {
+	t.Helper()
+
+	for _, k := range keys {
+		if err := r.redis.Set(k, "x", 0).Err(); err != nil {
+			t.Fatalf("failed to set %v: %v", k, err)
+		}
+	}
+}
+
+func TestTraefikRedisGenerateConfig(t *testing.T) {
+	r, m := testTraefikRedis(t)
+	ctx := context.Background()
+	w := testRedisWebspace(m, 1, "alice")
+
+	if err := r.GenerateConfig(ctx, w, "10.0.0.2"); err != nil {
+		t.Fatalf("failed to generate config: %v", err)
+	}
+	expectRedisValue(t, r, "traefik/http/services/wstest-u1/loadbalancer/servers/0/url", "http://10.0.0.2:80")
+	expectRedisValue(t, r, "traefik/http/routers/wstest-u1/rule", "Host(`alice.ng.localhost`)")
+	expectRedisValue(t, r, "traefik/http/routers/wstest-u1/entrypoints/0", "https")
+
+	// Keys left over from older versions (or a previous configuration) and keys belonging to others
+	stale := []string{
+		"traefik/http/routers/wstest-u1-https/rule",
+		"traefik/tcp/routers/wstest-u1-https/tls/passthrough",
+		"traefik/http/routers/wstest-u1/tls/domains/1/sans/3",
+	}
+	others := []string{
+		"traefik/http/routers/wstest-u10/rule",
+		"traefik/http/routers/wstest-other/rule",
+	}
+	setRedisKeys(t, r, append(stale, others...)...)
+
+	// Stopped webspace
+	if err := r.GenerateConfig(ctx, w, ""); err != nil {
+		t.Fatalf("failed to generate config: %v", err)
+	}
+	expectRedisMissing(t, r, stale...)
+	expectRedisValue(t, r, "traefik/http/services/wstest-u1/loadbalancer/servers/0/url", "http://1.1.1.1:80")
+	expectRedisValue(t, r, "traefik/http/routers/wstest-u1/middlewares/0", "wstest-u1-boot")
+	expectRedisValue(t, r, "traefik/http/middlewares/wstest-u1-boot/webspaceBoot/url", "http://webspaced")
+	expectRedisValue(t, r, "traefik/http/middlewares/wstest-u1-boot/webspaceBoot/userID", "1")
+
+	// Switching to SNI passthrough should remove the HTTP router and service entirely
+	w.Config.SNIPassthrough = true
+	w.Domains = []string{"example.com"}
+	if err := r.GenerateConfig(ctx, w, "10.0.0.2"); err != nil {
+		t.Fatalf("failed to generate config: %v", err)
+	}
+	for _, pattern := range []string{"traefik/http/*/wstest-u1/*", "traefik/http/*/wstest-u1-*"} {
+		if keys := redisKeys(t, r, pattern); len(keys) != 0 {
+			t.Errorf("HTTP keys left after switching to SNI passthrough: %v", keys)
+		}
+	}
+	expectRedisValue(t, r, "traefik/tcp/services/wstest-u1/loadbalancer/servers/0/address", "10.0.0.2:80")
+	expectRedisValue(t, r, "traefik/tcp/routers/wstest-u1/rule", "HostSNI(`alice.ng.localhost`) || HostSNI(`example.com`)")
+	expectRedisValue(t, r, "traefik/tcp/routers/wstest-u1/tls/passthrough", "true")
+
+	for _, k := range others {
+		expectRedisValue(t, r, k, "x")
+	}
+}
+
+func TestTraefikRedisClearConfig(t *testing.T) {
+	r, m := testTraefikRedis(t)
+	ctx := context.Background()
+
+	for _, w := range []*Webspace{testRedisWebspace(m, 1, "alice"), testRedisWebspace(m, 10, "bob")} {
+		if err := r.GenerateConfig(ctx, w, ""); err != nil {
+			t.Fatalf("failed to generate config: %v", err)
+		}
+	}
+	setRedisKeys(t, r, "traefik/http/routers/wstest-u1-https/rule")
+
+	if err := r.ClearConfig(ctx, "wstest-u1"); err != nil {
+		t.Fatalf("failed to clear config: %v", err)
+	}
+	for _, pattern := range []string{"traefik/*/*/wstest-u1/*", "traefik/*/*/wstest-u1-*"} {
+		if keys := redisKeys(t, r, pattern); len(keys) != 0 {
+			t.Errorf("keys left after clearing config: %v", keys)
+		}
+	}
+	expectRedisValue(t, r, "traefik/http/routers/wstest-u10/rule", "Host(`bob.ng.localhost`)")
+}
+
+func TestTraefikRedisClearAll(t *testing.T) {
+	r, m := testTraefikRedis(t)
+	ctx := context.Background()
+
+	for _, w := range []*Webspace{testRedisWebspace(m, 1, "alice"), testRedisWebspace(m, 2, "bob")} {
+		if err := r.GenerateConfig(ctx, w, ""); err != nil {
+			t.Fatalf("failed to generate config: %v", err)
+		}
+	}
+	others := []string{
+		"traefik/http/routers/wstest-other/rule",
+		"traefik/http/routers/wstest-u2-custom/rule",
+	}
+	setRedisKeys(t, r, append(others,
+		"traefik/http/routers/wstest-u2-https/rule", "traefik/http/routers/wstest-u3-https/rule")...)
+
+	instances, err := r.Instances(ctx)
+	if err != nil {
+		t.Fatalf("failed to list instances: %v", err)
+	}
+	if expected := []string{"wstest-u1", "wstest-u2", "wstest-u3"}; !reflect.DeepEqual(instances, expected) {
+		t.Errorf("expected instances %v, got %v", expected, instances)
+	}
+
+	if err := r.ClearAll(ctx); err != nil {
+		t.Fatalf("failed to clear all config: %v", err)
+	}
+
+	keys := redisKeys(t, r, "traefik/*/*/wstest-*")
+	sort.Strings(others)
+	if len(keys) != len(others) {
+		t.Fatalf("expected only %v to be left, got %v", others, keys)
+	}
+	for i := range keys {
+		if keys[i] != others[i] {
+			t.Errorf("expected only %v to be left, got %v", others, keys)
+			break
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package webspace
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/netsoc/webspaced/pkg/util"
+	log "github.com/sirupsen/logrus"
+)
+
+// lxdTrafficKey is the LXD config key where port forwarding traffic counters are persisted (kept separate from the
+// main webspace config so they can be flushed without touching it)
+const lxdTrafficKey = lxdConfigKey + ".traffic"
+
+// PortTraffic describes the traffic forwarded through an external port
+type PortTraffic struct {
+	Connections uint64 `json:"connections"`
+	// BytesIn is the number of bytes forwarded to the webspace
+	BytesIn uint64 `json:"bytesIn"`
+	// BytesOut is the number of bytes forwarded from the webspace
+	BytesOut uint64 `json:"bytesOut"`
+}
+
+func (t *PortTraffic) add(o PortTraffic) {
+	t.Connections += o.Connections
+	t.BytesIn += o.BytesIn
+	t.BytesOut += o.BytesOut
+}
+
+// Traffic describes a webspace's port forwarding traffic for a month
+type Traffic struct {
+	// Month is the month the counters apply to (in `YYYY-MM` format, UTC)
+	Month string `json:"month"`
+	// Quota is the total number of bytes which can be forwarded in a month (0 means no limit)
+	Quota int64                  `json:"quota"`
+	Total PortTraffic            `json:"total"`
+	Ports map[uint16]PortTraffic `json:"ports"`
+}
+
+type trafficRecord struct {
+	Month string                  `json:"month"`
+	Ports map[uint16]*PortTraffic `json:"ports"`
+}
+
+func currentMonth() string {
+	return time.Now().UTC().Format("2006-01")
+}
+
+// rollover resets the counters if a new month has started
+func (r *trafficRecord) rollover() {
+	if m := currentMonth(); r.Month != m {
+		r.Month = m
+		r.Ports = map[uint16]*PortTraffic{}
+	}
+}
+
+func (r *trafficRecord) total() PortTraffic {
+	var t PortTraffic
+	for _, p := range r.Ports {
+		t.add(*p)
+	}
+
+	return t
+}
+
+// trafficTracker keeps track of the traffic forwarded to each webspace
+type trafficTracker struct {
+	sync.Mutex
+	records map[int]*trafficRecord
+	dirty   map[int]bool
+	// saves counts in-progress saves of each webspace's counters, whose LXD update events should be ignored
+	saves map[int]int
+}
+
+func newTrafficTracker() *trafficTracker {
+	return &trafficTracker{
+		records: map[int]*trafficRecord{},
+		dirty:   map[int]bool{},
+		saves:   map[int]int{},
+	}
+}
+
+// load seeds a webspace's counters from the value persisted in LXD (if they're not already being tracked)
+func (t *trafficTracker) load(uid int, persisted string) {
+	t.Lock()
+	defer t.Unlock()
+
+	if _, ok := t.records[uid]; ok {
+		return
+	}
+
+	r := &trafficRecord{}
+	if persisted != "" {
+		if err := json.Unmarshal([]byte(persisted), r); err != nil {
+			log.WithError(err).WithField("uid", uid).Warn("Failed to parse persisted port forward traffic, resetting")
+			r = &trafficRecord{}
+		}
+	}
+	if r.Ports == nil {
+		r.Ports = map[uint16]*PortTraffic{}
+	}
+
+	t.records[uid] = r
+}
+
+func (t *trafficTracker) record(uid int) *trafficRecord {
+	r, ok := t.records[uid]
+	if !ok {
+		r = &trafficRecord{Ports: map[uint16]*PortTraffic{}}
+		t.records[uid] = r
+	}
+	r.rollover()
+
+	return r
+}
+
+// add records traffic through an external port
+func (t *trafficTracker) add(uid int, e uint16, traffic PortTraffic) {
+	t.Lock()
+	defer t.Unlock()
+
+	r := t.record(uid)
+	p, ok := r.Ports[e]
+	if !ok {
+		p = &PortTraffic{}
+		r.Ports[e] = p
+	}
+	p.add(traffic)
+
+	t.dirty[uid] = true
+}
+
+// get returns a copy of a webspace's counters for the current month
+func (t *trafficTracker) get(uid int) (string, PortTraffic, map[uint16]PortTraffic) {
+	t.Lock()
+	defer t.Unlock()
+
+	r := t.record(uid)
+	ports := make(map[uint16]PortTraffic, len(r.Ports))
+	for e, p := range r.Ports {
+		ports[e] = *p
+	}
+
+	return r.Month, r.total(), ports
+}
+
+// takeDirty returns the serialized counters for each webspace which has changed since the last call
+func (t *trafficTracker) takeDirty() map[int]string {
+	t.Lock()
+	defer t.Unlock()
+
+	dirty := make(map[int]string, len(t.dirty))
+	for uid := range t.dirty {
+		data, err := json.Marshal(t.record(uid))
+		if err != nil {
+			log.WithError(err).WithField("uid", uid).Error("Failed to serialize port forward traffic")
+			continue
+		}
+
+		dirty[uid] = string(data)
+	}
+	t.dirty = map[int]bool{}
+
+	return dirty
+}
+
+func (t *trafficTracker) markDirty(uid int) {
+	t.Lock()
+	defer t.Unlock()
+
+	if _, ok := t.records[uid]; ok {
+		t.dirty[uid] = true
+	}
+}
+
+// startSave notes that the counters are about to be written to a webspace's LXD instance
+func (t *trafficTracker) startSave(uid int) {
+	t.Lock()
+	defer t.Unlock()
+
+	t.saves[uid]++
+}
+
+// takeSave returns true (once per save) if an LXD update event for a webspace was caused by saving its counters
+func (t *trafficTracker) takeSave(uid int) bool {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.saves[uid] == 0 {
+		return false
+	}
+
+	t.saves[uid]--
+	if t.saves[uid] == 0 {
+		delete(t.saves, uid)
+	}
+	return true
+}
+
+func (t *trafficTracker) forget(uid int) {
+	t.Lock()
+	defer t.Unlock()
+
+	delete(t.records, uid)
+	delete(t.dirty, uid)
+}
+
+// Traffic returns the webspace's port forwarding traffic for the current month
+func (w *Webspace) Traffic() Traffic {
+	month, total, ports := w.manager.traffic.get(w.UserID)
+	return Traffic{
+		Month: month,
+		Quota: int64(w.EffectiveLimits().Traffic),
+		Total: total,
+		Ports: ports,
+	}
+}
+
+// checkTrafficQuota returns an error if the webspace has used up its monthly traffic quota
+func (w *Webspace) checkTrafficQuota() error {
+	quota := int64(w.EffectiveLimits().Traffic)
+	if quota == 0 {
+		return nil
+	}
+
+	_, total, _ := w.manager.traffic.get(w.UserID)
+	if total.BytesIn+total.BytesOut >= uint64(quota) {
+		return util.ErrTrafficQuota
+	}
+
+	return nil
+}
+
+func (m *Manager) saveTraffic(uid int, data string) error {
+	m.Lock(uid)
+	defer m.Unlock(uid)
+
+	n := m.lxdInstanceName(uid)
+	i, etag, err := m.lxd.GetInstance(n)
+	if err != nil {
+		return fmt.Errorf("failed to get instance from LXD: %w", convertLXDError(err))
+	}
+
+	i.InstancePut.Config[lxdTrafficKey] = data
+
+	// Only the counters are changing, so there's no need to re-sync the webspace when LXD tells us it's been updated
+	m.traffic.startSave(uid)
+	op, err := m.lxd.UpdateInstance(n, i.InstancePut, etag)
+	if err != nil {
+		m.traffic.takeSave(uid)
+		return fmt.Errorf("failed to update LXD instance: %w", convertLXDError(err))
+	}
+
+	if err := op.Wait(); err != nil {
+		return fmt.Errorf("failed to update LXD instance: %w", convertLXDError(err))
+	}
+	return nil
+}
+
+// flushTraffic persists changed port forwarding traffic counters to LXD
+func (m *Manager) flushTraffic() {
+	for uid, data := range m.traffic.takeDirty() {
+		if err := m.saveTraffic(uid, data); err != nil {
+			if errors.Is(err, util.ErrGenericNotFound) {
+				// Webspace has been deleted
+				m.traffic.forget(uid)
+				continue
+			}
+
+			log.WithError(err).WithField("uid", uid).Error("Failed to save port forward traffic")
+			m.traffic.markDirty(uid)
+		}
+	}
+}
+
+func (m *Manager) trafficLoop() {
+	t := time.NewTicker(m.config.Webspaces.Ports.TrafficFlushInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			m.flushTraffic()
+		case <-m.stop:
+			return
+		}
+	}
+}
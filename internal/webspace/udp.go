@@ -0,0 +1,197 @@
+package webspace
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/netsoc/webspaced/internal/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultUDPSessionTimeout = 3 * time.Minute
+
+	udpBufferSize = 65535
+	// udpQueueSize is the number of datagrams to buffer per session (e.g. while the webspace is booting)
+	udpQueueSize = 128
+)
+
+// udpSession represents a single client's datagram flow through a UDP port forward
+type udpSession struct {
+	client  *net.UDPAddr
+	packets chan []byte
+
+	last int64
+}
+
+func (s *udpSession) touch() {
+	atomic.StoreInt64(&s.last, time.Now().UnixNano())
+}
+
+func (s *udpSession) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&s.last)))
+}
+
+func (f *PortForward) runUDP() {
+	buf := make([]byte, udpBufferSize)
+	for {
+		n, client, err := f.udpConn.ReadFromUDP(buf)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"ePort":   f.ePort,
+				"backend": f.backend(),
+			}).WithError(err).Info("Ending port forward")
+			return
+		}
+
+		key := client.String()
+		f.udpMu.Lock()
+		s, ok := f.udpSessions[key]
+		if !ok {
+			if !f.admit(client.IP) {
+				f.udpMu.Unlock()
+				continue
+			}
+
+			s = &udpSession{
+				client:  client,
+				packets: make(chan []byte, udpQueueSize),
+			}
+			s.touch()
+
+			f.udpSessions[key] = s
+			f.wg.Add(1)
+			go f.handleUDPSession(s)
+		}
+		f.udpMu.Unlock()
+
+		p := make([]byte, n)
+		copy(p, buf[:n])
+		select {
+		case s.packets <- p:
+		default:
+			// Queue is full, drop the datagram
+		}
+	}
+}
+
+// awaitUDPIdle discards datagrams for a session until it has been idle for the session timeout (or the port forward
+// is stopped)
+func (f *PortForward) awaitUDPIdle(s *udpSession) {
+	timeout := f.udpTimeout()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-s.packets:
+			s.touch()
+		case <-timer.C:
+			idle := s.idle()
+			if idle >= timeout {
+				return
+			}
+			timer.Reset(timeout - idle)
+		case <-f.done:
+			return
+		}
+	}
+}
+
+func (f *PortForward) handleUDPSession(s *udpSession) {
+	defer f.wg.Done()
+	atomic.AddInt32(&f.active, 1)
+	defer atomic.AddInt32(&f.active, -1)
+	defer func() {
+		f.udpMu.Lock()
+		delete(f.udpSessions, s.client.String())
+		f.udpMu.Unlock()
+
+		f.limits.release(s.client.IP.String())
+	}()
+
+	logger := log.WithFields(log.Fields{
+		"ePort":  f.ePort,
+		"client": s.client,
+	})
+
+	if err := f.runHook(); err != nil {
+		logger.WithField("backend", f.backend()).WithError(err).Warn("Port forward hook execution failed")
+
+		// Keep the session around (dropping datagrams) so we don't run the hook for every datagram
+		f.awaitUDPIdle(s)
+		return
+	}
+
+	backendAddr := f.backend()
+	logger = logger.WithField("backend", backendAddr)
+	logger.Trace("Forwarding UDP session...")
+
+	conn, err := net.Dial("udp", backendAddr)
+	if err != nil {
+		logger.WithError(err).Warn("Port forward backend connection failed")
+		f.awaitUDPIdle(s)
+		return
+	}
+	backend := conn.(*net.UDPConn)
+
+	metrics.PortForwardConnections.WithLabelValues(strconv.Itoa(int(f.ePort)), f.protocol).Inc()
+	f.runAccount(PortTraffic{Connections: 1})
+
+	replies := make(chan struct{})
+	go func() {
+		defer close(replies)
+
+		buf := make([]byte, udpBufferSize)
+		for {
+			n, err := backend.Read(buf)
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+
+				// Most likely an ICMP error from a previous datagram (e.g. nothing listening yet)
+				continue
+			}
+			s.touch()
+
+			if _, err := f.udpConn.WriteToUDP(buf[:n], s.client); err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				continue
+			}
+			f.forwarded("out", n)
+		}
+	}()
+
+	timeout := f.udpTimeout()
+	timer := time.NewTimer(timeout)
+loop:
+	for {
+		select {
+		case p := <-s.packets:
+			s.touch()
+			if n, err := backend.Write(p); err == nil {
+				f.forwarded("in", n)
+			}
+		case <-timer.C:
+			idle := s.idle()
+			if idle >= timeout {
+				break loop
+			}
+			timer.Reset(timeout - idle)
+		case <-f.done:
+			break loop
+		}
+	}
+	timer.Stop()
+
+	backend.Close()
+	<-replies
+
+	logger.Trace("Forwarded UDP session timed out")
+}
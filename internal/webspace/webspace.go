@@ -17,6 +17,7 @@ import (
 	lxdApi "github.com/lxc/lxd/shared/api"
 	iam "github.com/netsoc/iam/client"
 	"github.com/netsoc/webspaced/internal/config"
+	"github.com/netsoc/webspaced/internal/metrics"
 	"github.com/netsoc/webspaced/pkg/util"
 	log "github.com/sirupsen/logrus"
 )
@@ -36,6 +37,8 @@ func convertLXDError(err error) error {
 		return util.ErrNotRunning
 	case strings.Contains(m, "already running"):
 		return util.ErrRunning
+	case strings.Contains(m, "ETag doesn't match"):
+		return util.ErrChanged
 
 	default:
 		return err
@@ -50,11 +53,124 @@ var lxdLogFilenameRegex = regexp.MustCompile(`/1.0/instances/\S+/logs/(\S+)`)
 type Webspace struct {
 	manager *Manager
 	user    *iam.User
+	// etag is LXD's ETag for the instance at the time the webspace was retrieved (only set by Manager.Get)
+	etag string
 
-	UserID  int                   `json:"user"`
-	Config  config.WebspaceConfig `json:"config"`
-	Domains []string              `json:"domains"`
-	Ports   map[uint16]uint16     `json:"ports"`
+	UserID  int                    `json:"user"`
+	Config  config.WebspaceConfig  `json:"config"`
+	Limits  config.ResourceLimits  `json:"limits"`
+	Domains []string               `json:"domains"`
+	Ports   map[uint16]PortMapping `json:"ports"`
+
+	// PendingDomains holds custom domains which are waiting for their TXT record to appear
+	PendingDomains map[string]*PendingDomain `json:"pendingDomains,omitempty"`
+}
+
+// plainWebspace has the same fields as Webspace, without its JSON methods
+type plainWebspace Webspace
+
+// webspaceJSON is the serialized form of a Webspace. Ports is kept as a plain mapping of external to internal ports
+// (as it was before port forwards had other settings), with the full settings in PortMappings.
+type webspaceJSON struct {
+	*plainWebspace
+
+	Ports        map[uint16]uint16      `json:"ports"`
+	PortMappings map[uint16]PortMapping `json:"portMappings"`
+}
+
+func (w *Webspace) toJSON() webspaceJSON {
+	ports := make(map[uint16]uint16, len(w.Ports))
+	for e, m := range w.Ports {
+		ports[e] = m.Port
+	}
+
+	return webspaceJSON{
+		plainWebspace: (*plainWebspace)(w),
+		Ports:         ports,
+		PortMappings:  w.Ports,
+	}
+}
+
+// MarshalJSON serializes the webspace
+func (w Webspace) MarshalJSON() ([]byte, error) {
+	return json.Marshal(w.toJSON())
+}
+
+// UnmarshalJSON parses a webspace, taking port forwards from `portMappings` if present (or from `ports` otherwise)
+func (w *Webspace) UnmarshalJSON(data []byte) error {
+	v := struct {
+		*plainWebspace
+		PortMappings map[uint16]PortMapping `json:"portMappings"`
+	}{plainWebspace: (*plainWebspace)(w)}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	if v.PortMappings != nil {
+		w.Ports = v.PortMappings
+	}
+	return nil
+}
+
+// PortMapping describes the webspace side of a port forward
+type PortMapping struct {
+	Port     uint16 `json:"port"`
+	Protocol string `json:"protocol"`
+	// ProxyProtocol is the PROXY protocol version (1 or 2) to use when connecting to the webspace (0 to disable)
+	ProxyProtocol uint8 `json:"proxyProtocol"`
+
+	// Allow is a list of CIDRs (or IP addresses) which can connect (if empty, any address not denied can connect)
+	Allow []string `json:"allow,omitempty"`
+	// Deny is a list of CIDRs (or IP addresses) which cannot connect
+	Deny []string `json:"deny,omitempty"`
+
+	// Limits overrides the server's connection limits for the port forward
+	Limits PortLimits `json:"limits"`
+}
+
+func (p PortMapping) validate() error {
+	if p.Port == 0 {
+		return fmt.Errorf("%w (internal port cannot be 0)", util.ErrBadPort)
+	}
+	if p.Protocol != ProtocolTCP && p.Protocol != ProtocolUDP {
+		return fmt.Errorf("%w (unsupported protocol %v)", util.ErrBadPort, p.Protocol)
+	}
+	if p.ProxyProtocol > 2 {
+		return fmt.Errorf("%w (unsupported PROXY protocol version %v)", util.ErrBadPort, p.ProxyProtocol)
+	}
+	if p.ProxyProtocol != 0 && p.Protocol != ProtocolTCP {
+		return fmt.Errorf("%w (PROXY protocol is only supported for TCP)", util.ErrBadPort)
+	}
+	if len(p.Allow) > maxPortACLEntries || len(p.Deny) > maxPortACLEntries {
+		return fmt.Errorf("%w (allow / deny lists cannot have more than %v entries)", util.ErrBadPort, maxPortACLEntries)
+	}
+	if _, err := parsePortACL(p.Allow, p.Deny); err != nil {
+		return fmt.Errorf("%w (%v)", util.ErrBadPort, err)
+	}
+
+	return nil
+}
+
+// UnmarshalJSON parses a port mapping, accepting a bare port number (as stored by older versions) as TCP
+func (p *PortMapping) UnmarshalJSON(data []byte) error {
+	var port uint16
+	if err := json.Unmarshal(data, &port); err == nil {
+		*p = PortMapping{Port: port, Protocol: ProtocolTCP}
+		return nil
+	}
+
+	// Start from the existing values so partial updates work
+	type plain PortMapping
+	v := plain(*p)
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	*p = PortMapping(v)
+	if p.Protocol == "" {
+		p.Protocol = ProtocolTCP
+	}
+	return nil
 }
 
 // GetUser gets the IAM user associated with this webspace
@@ -74,9 +190,15 @@ func (w *Webspace) GetUser(ctx context.Context) (*iam.User, error) {
 }
 
 func (w *Webspace) lxdConfig() (string, error) {
-	if w.Config.StartupDelay < 0 {
+	if w.Config.StartupDelay < 0 || w.Config.IdleTimeout < 0 {
 		return "", util.ErrBadValue
 	}
+	if max := w.manager.config.Webspaces.MaxIdleTimeout; max != 0 && w.IdleTimeout() > max {
+		return "", fmt.Errorf("%w (idle timeout cannot be more than %v)", util.ErrBadValue, max)
+	}
+	if err := w.checkLimits(); err != nil {
+		return "", err
+	}
 
 	confJSON, err := json.Marshal(w)
 	if err != nil {
@@ -190,6 +312,7 @@ func (w *Webspace) Delete() error {
 	if err := op.Wait(); err != nil {
 		return fmt.Errorf("failed to delete LXD instance: %w", convertLXDError(err))
 	}
+	w.manager.traffic.forget(w.UserID)
 
 	return nil
 }
@@ -199,6 +322,7 @@ func (w *Webspace) Boot() error {
 	if err := w.manager.lxdState(w.InstanceName(), "start"); err != nil {
 		return err
 	}
+	w.manager.idle.touch(w.UserID)
 
 	return nil
 }
@@ -221,12 +345,25 @@ func (w *Webspace) Shutdown() error {
 
 // Save updates the stored LXD configuration
 func (w *Webspace) Save() error {
+	return w.save("")
+}
+
+// saveUnchanged is like Save, but fails with util.ErrChanged if the instance has been updated since the webspace was
+// retrieved
+func (w *Webspace) saveUnchanged() error {
+	return w.save(w.etag)
+}
+
+func (w *Webspace) save(etag string) error {
 	n := w.InstanceName()
 
-	i, _, err := w.manager.lxd.GetInstance(n)
+	i, current, err := w.manager.lxd.GetInstance(n)
 	if err != nil {
 		return fmt.Errorf("failed to get instance from LXD: %w", convertLXDError(err))
 	}
+	if etag != "" && current != etag {
+		return util.ErrChanged
+	}
 
 	lxdConf, err := w.lxdConfig()
 	if err != nil {
@@ -234,7 +371,9 @@ func (w *Webspace) Save() error {
 	}
 
 	i.InstancePut.Config[lxdConfigKey] = lxdConf
-	op, err := w.manager.lxd.UpdateInstance(n, i.InstancePut, "")
+	w.applyLimits(i)
+
+	op, err := w.manager.lxd.UpdateInstance(n, i.InstancePut, etag)
 	if err != nil {
 		return fmt.Errorf("failed to update LXD instance: %w", convertLXDError(err))
 	}
@@ -245,6 +384,49 @@ func (w *Webspace) Save() error {
 	return nil
 }
 
+// refresh reloads the webspace's stored configuration from LXD (the webspace should be locked)
+func (w *Webspace) refresh() error {
+	fresh, err := w.manager.Get(w.UserID, nil)
+	if err != nil {
+		return err
+	}
+
+	fresh.user = w.user
+	*w = *fresh
+	return nil
+}
+
+// update makes changes to the webspace with fn and saves them. The webspace is locked and refreshed first so changes
+// made in the background (e.g. to pending domains) aren't lost.
+func (w *Webspace) update(fn func() error) error {
+	w.manager.Lock(w.UserID)
+	defer w.manager.Unlock(w.UserID)
+	if err := w.refresh(); err != nil {
+		return err
+	}
+
+	if err := fn(); err != nil {
+		return err
+	}
+	return w.saveUnchanged()
+}
+
+// SetConfig replaces the webspace's configuration
+func (w *Webspace) SetConfig(c config.WebspaceConfig) error {
+	return w.update(func() error {
+		w.Config = c
+		return nil
+	})
+}
+
+// SetLimits replaces the webspace's resource limits
+func (w *Webspace) SetLimits(l config.ResourceLimits) error {
+	return w.update(func() error {
+		w.Limits = l
+		return nil
+	})
+}
+
 // DefaultDomain returns the default domain for the webspace
 func (w *Webspace) DefaultDomain(ctx context.Context) (string, error) {
 	user, err := w.GetUser(ctx)
@@ -271,42 +453,74 @@ func (w *Webspace) GetDomains(ctx context.Context) ([]string, error) {
 	return domains, nil
 }
 
-// AddDomain verifies and adds a new domain
-func (w *Webspace) AddDomain(domain string) error {
+// verifyDomain checks that the domain has a TXT record pointing at the webspace
+func (w *Webspace) verifyDomain(domain string) error {
 	records, err := net.LookupTXT(domain)
 	if err != nil {
 		return fmt.Errorf("failed to lookup TXT records: %w", err)
 	}
 
 	correct := fmt.Sprintf("webspace:id:%v", w.UserID)
-	verified := false
 	for _, r := range records {
 		if r == correct {
-			verified = true
+			return nil
 		}
 	}
-	if !verified {
-		return util.ErrDomainUnverified
+
+	return util.ErrDomainUnverified
+}
+
+// AddDomain verifies and adds a new domain. If the domain can't be verified yet (and pending domains are enabled),
+// it's added as pending for the manager to re-check in the background and true is returned.
+func (w *Webspace) AddDomain(domain string) (bool, error) {
+	// Pending domains are updated in the background, so make sure we're working with the latest state
+	w.manager.Lock(w.UserID)
+	defer w.manager.Unlock(w.UserID)
+	if err := w.refresh(); err != nil {
+		return false, err
 	}
 
-	webspaces, err := w.manager.GetAll()
-	if err != nil {
-		return err
+	if _, ok := w.PendingDomains[domain]; ok {
+		return false, util.ErrUsed
+	}
+	if err := w.manager.checkDomainUnused(domain); err != nil {
+		return false, err
 	}
 
-	for _, w := range webspaces {
-		for _, d := range w.Domains {
-			if d == domain {
-				return util.ErrUsed
-			}
+	verifyErr := w.verifyDomain(domain)
+	if verifyErr == nil {
+		w.Domains = append(w.Domains, domain)
+		if err := w.saveUnchanged(); err != nil {
+			return false, err
 		}
+
+		w.manager.requestCertificates()
+		return false, nil
 	}
 
-	w.Domains = append(w.Domains, domain)
-	if err := w.Save(); err != nil {
-		return err
+	timeout := w.manager.config.Webspaces.DomainVerification.Timeout
+	if timeout == 0 {
+		return false, verifyErr
 	}
-	return nil
+	if len(w.PendingDomains) >= int(w.manager.config.Webspaces.DomainVerification.MaxPending) {
+		return false, fmt.Errorf("%w (%v)", util.ErrTooManyPendingDomains, verifyErr)
+	}
+
+	now := time.Now()
+	if w.PendingDomains == nil {
+		w.PendingDomains = map[string]*PendingDomain{}
+	}
+	w.PendingDomains[domain] = &PendingDomain{
+		Added:     now,
+		Deadline:  now.Add(timeout),
+		NextCheck: now.Add(w.manager.config.Webspaces.DomainVerification.CheckInterval),
+		LastError: verifyErr.Error(),
+	}
+	if err := w.saveUnchanged(); err != nil {
+		return false, err
+	}
+
+	return true, nil
 }
 
 // RemoveDomain removes an existing domain
@@ -320,13 +534,29 @@ func (w *Webspace) RemoveDomain(ctx context.Context, domain string) error {
 		return util.ErrDefaultDomain
 	}
 
+	w.manager.Lock(w.UserID)
+	defer w.manager.Unlock(w.UserID)
+	if err := w.refresh(); err != nil {
+		return err
+	}
+
+	if _, ok := w.PendingDomains[domain]; ok {
+		delete(w.PendingDomains, domain)
+		return w.saveUnchanged()
+	}
+
 	for i, d := range w.Domains {
 		if d == domain {
 			e := len(w.Domains) - 1
 			w.Domains[e], w.Domains[i] = w.Domains[i], w.Domains[e]
 			w.Domains = w.Domains[:e]
 
-			return w.Save()
+			if err := w.saveUnchanged(); err != nil {
+				return err
+			}
+
+			w.manager.requestCertificates()
+			return nil
 		}
 	}
 
@@ -334,12 +564,29 @@ func (w *Webspace) RemoveDomain(ctx context.Context, domain string) error {
 }
 
 // AddPort creates a port forwarding
-func (w *Webspace) AddPort(external uint16, internal uint16) (uint16, error) {
+func (w *Webspace) AddPort(external uint16, internal PortMapping) (uint16, error) {
+	err := w.update(func() error {
+		var err error
+		external, err = w.addPort(external, internal)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return external, nil
+}
+
+// addPort adds a port forwarding without saving it, returning the external port
+func (w *Webspace) addPort(external uint16, internal PortMapping) (uint16, error) {
 	if len(w.Ports) == int(w.manager.config.Webspaces.Ports.Max) {
 		return 0, util.ErrTooManyPorts
 	}
-	if internal == 0 {
-		return 0, fmt.Errorf("%w (internal port cannot be 0)", util.ErrBadPort)
+	if err := internal.validate(); err != nil {
+		return 0, err
+	}
+	if err := internal.Limits.validate(w.manager.config); err != nil {
+		return 0, err
 	}
 	if external != 0 &&
 		(external < w.manager.config.Webspaces.Ports.Start || external > w.manager.config.Webspaces.Ports.End) {
@@ -379,20 +626,38 @@ func (w *Webspace) AddPort(external uint16, internal uint16) (uint16, error) {
 	}
 
 	w.Ports[external] = internal
-	if err := w.Save(); err != nil {
-		return 0, err
-	}
 	return external, nil
 }
 
+// UpdatePort changes the settings of an existing port forwarding
+func (w *Webspace) UpdatePort(external uint16, internal PortMapping) error {
+	if err := internal.validate(); err != nil {
+		return err
+	}
+	if err := internal.Limits.validate(w.manager.config); err != nil {
+		return err
+	}
+
+	return w.update(func() error {
+		if _, ok := w.Ports[external]; !ok {
+			return util.ErrGenericNotFound
+		}
+
+		w.Ports[external] = internal
+		return nil
+	})
+}
+
 // RemovePort removes a port forwarding
 func (w *Webspace) RemovePort(external uint16) error {
-	if _, ok := w.Ports[external]; !ok {
-		return util.ErrGenericNotFound
-	}
+	return w.update(func() error {
+		if _, ok := w.Ports[external]; !ok {
+			return util.ErrGenericNotFound
+		}
 
-	delete(w.Ports, external)
-	return w.Save()
+		delete(w.Ports, external)
+		return nil
+	})
 }
 
 // GetIP retrieves the webspace's primary IP address
@@ -451,6 +716,8 @@ func (w *Webspace) AwaitIP() (string, error) {
 
 // EnsureStarted starts a webspace if it isn't running (delaying by the startup delay) and returns its IP address after
 func (w *Webspace) EnsureStarted() (string, error) {
+	w.manager.idle.touch(w.UserID)
+
 	state, _, err := w.manager.lxd.GetInstanceState(w.InstanceName())
 	if err != nil {
 		return "", fmt.Errorf("failed to get LXD instance state: %w", convertLXDError(err))
@@ -465,6 +732,7 @@ func (w *Webspace) EnsureStarted() (string, error) {
 		return ip, nil
 	}
 
+	start := time.Now()
 	if err := w.Boot(); err != nil {
 		return "", fmt.Errorf("failed to start webspace: %w", err)
 	}
@@ -475,6 +743,7 @@ func (w *Webspace) EnsureStarted() (string, error) {
 	}
 
 	time.Sleep(time.Duration(w.Config.StartupDelay * float64(time.Second)))
+	metrics.BootDuration.Observe(time.Since(start).Seconds())
 	return ip, nil
 }
 
@@ -518,9 +787,29 @@ type State struct {
 	Running           bool                        `json:"running"`
 	Uptime            float64                     `json:"uptime"`
 	Usage             Usage                       `json:"usage"`
+	Limits            config.ResourceLimits       `json:"limits"`
 	NetworkInterfaces map[string]NetworkInterface `json:"networkInterfaces"`
 }
 
+func usageFromLXD(ls *lxdApi.InstanceState) Usage {
+	u := Usage{
+		CPU:       ls.CPU.Usage,
+		Disks:     map[string]int64{},
+		Memory:    ls.Memory.Usage,
+		Processes: ls.Processes,
+	}
+
+	for name, info := range ls.Disk {
+		if info.Usage == -1 {
+			continue
+		}
+
+		u.Disks[name] = info.Usage
+	}
+
+	return u
+}
+
 // State returns information about the webspace's state
 func (w *Webspace) State() (State, error) {
 	n := w.InstanceName()
@@ -531,13 +820,9 @@ func (w *Webspace) State() (State, error) {
 	}
 
 	s := State{
-		Running: ls.StatusCode == lxdApi.Running,
-		Usage: Usage{
-			CPU:       ls.CPU.Usage,
-			Disks:     map[string]int64{},
-			Memory:    ls.Memory.Usage,
-			Processes: ls.Processes,
-		},
+		Running:           ls.StatusCode == lxdApi.Running,
+		Usage:             usageFromLXD(ls),
+		Limits:            w.EffectiveLimits(),
 		NetworkInterfaces: map[string]NetworkInterface{},
 	}
 	if s.Running {
@@ -549,14 +834,6 @@ func (w *Webspace) State() (State, error) {
 		s.Uptime = time.Since(i.LastUsedAt).Seconds()
 	}
 
-	for name, info := range ls.Disk {
-		if info.Usage == -1 {
-			continue
-		}
-
-		s.Usage.Disks[name] = info.Usage
-	}
-
 	if ls.Network != nil {
 		for name, info := range ls.Network {
 			if name == "lo" {
@@ -617,16 +894,5 @@ func (w *Webspace) Sync(ctx context.Context) error {
 	defer w.manager.Unlock(w.UserID)
 	addr, _ := w.GetIP(nil)
 
-	if err := w.manager.traefik.ClearConfig(ctx, w.InstanceName()); err != nil {
-		return fmt.Errorf("failed to clear traefik config: %w", err)
-	}
-	if err := w.manager.traefik.GenerateConfig(ctx, w, addr); err != nil {
-		return fmt.Errorf("failed to update traefik config: %w", err)
-	}
-
-	if err := w.manager.ports.AddAll(ctx, w, addr); err != nil {
-		return fmt.Errorf("failed to set up port forwards: %w", err)
-	}
-
-	return nil
+	return w.manager.applyConfig(ctx, w, addr, true)
 }
@@ -31,8 +31,18 @@ var (
 	ErrDefaultDomain = errors.New("cannot remove the default domain")
 	// ErrTooManyPorts indicates that too many port forwards are configured
 	ErrTooManyPorts = errors.New("port forward limit reached")
+	// ErrTooManyPendingDomains indicates that too many domains are waiting to be verified
+	ErrTooManyPendingDomains = errors.New("pending domain limit reached")
+	// ErrChanged indicates that a webspace was modified by something else while it was being updated
+	ErrChanged = errors.New("webspace was modified concurrently")
 	// ErrBadPort indicates that the provided port is invalid
 	ErrBadPort = errors.New("invalid port")
+	// ErrTrafficQuota indicates that a webspace has used up its monthly port forwarding traffic quota
+	ErrTrafficQuota = errors.New("monthly traffic quota exceeded")
+	// ErrTooManySnapshots indicates that too many snapshots exist
+	ErrTooManySnapshots = errors.New("snapshot limit reached")
+	// ErrSnapshotName indicates that the provided snapshot name is invalid
+	ErrSnapshotName = errors.New("invalid snapshot name")
 	// ErrInterface indicates the default interface is missing
 	ErrInterface = errors.New("default network interface not present")
 	// ErrAddress indicates the interface didn't have an IPv4 address
@@ -41,10 +51,12 @@ var (
 	ErrBadValue = errors.New("invalid value for configuration option")
 	// ErrUIDMismatch indicates the user ID didn't match that of the User object
 	ErrUIDMismatch = errors.New("user id doesn't match provided value")
-	// ErrTraefikProvider indicates an invalid Traefik config provider name was given
-	ErrTraefikProvider = errors.New("invalid Traefik provider")
+	// ErrRoutingProvider indicates an invalid routing provider name was given
+	ErrRoutingProvider = errors.New("invalid routing provider")
 	// ErrWebsocket indicates the endpoint supports websocket communication only
 	ErrWebsocket = errors.New("this endpoint supports websocket communication only")
+	// ErrBadQuery indicates an invalid query parameter was provided
+	ErrBadQuery = errors.New("invalid query parameter")
 	// ErrSSHKey indicates the user requested SSH be set up, but their account does not provide a key
 	ErrSSHKey = errors.New("user has no SSH public key")
 )
@@ -54,13 +66,16 @@ func ErrToStatus(err error) int {
 	switch {
 	case errors.Is(err, ErrTokenRequired), errors.Is(err, ErrAdminRequired):
 		return http.StatusUnauthorized
+	case errors.Is(err, ErrTrafficQuota):
+		return http.StatusForbidden
 	case errors.Is(err, ErrNotFound), errors.Is(err, ErrGenericNotFound), errors.Is(err, ErrNotRunning):
 		return http.StatusNotFound
-	case errors.Is(err, ErrExists), errors.Is(err, ErrRunning), errors.Is(err, ErrUsed):
+	case errors.Is(err, ErrExists), errors.Is(err, ErrRunning), errors.Is(err, ErrUsed), errors.Is(err, ErrChanged):
 		return http.StatusConflict
 	case errors.Is(err, ErrDomainUnverified), errors.Is(err, ErrBadPort), errors.Is(err, ErrTooManyPorts),
 		errors.Is(err, ErrDefaultDomain), errors.Is(err, ErrBadValue), errors.Is(err, ErrWebsocket),
-		errors.Is(err, ErrSSHKey):
+		errors.Is(err, ErrSSHKey), errors.Is(err, ErrTooManySnapshots), errors.Is(err, ErrSnapshotName),
+		errors.Is(err, ErrBadQuery), errors.Is(err, ErrTooManyPendingDomains):
 		return http.StatusBadRequest
 	default:
 		return http.StatusInternalServerError
@@ -4,15 +4,32 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"net/http"
 	"regexp"
+	"strconv"
+	"strings"
 
 	iam "github.com/netsoc/iam/client"
 	log "github.com/sirupsen/logrus"
 )
 
 var (
-	sha256Regex = regexp.MustCompile(`^[A-Fa-f0-9]{64}$`)
+	sha256Regex   = regexp.MustCompile(`^[A-Fa-f0-9]{64}$`)
+	byteSizeRegex = regexp.MustCompile(`^(\d+)\s*([A-Za-z]*)$`)
+
+	byteSizeUnits = map[string]int64{
+		"":    1,
+		"b":   1,
+		"kb":  1000,
+		"mb":  1000 * 1000,
+		"gb":  1000 * 1000 * 1000,
+		"tb":  1000 * 1000 * 1000 * 1000,
+		"kib": 1 << 10,
+		"mib": 1 << 20,
+		"gib": 1 << 30,
+		"tib": 1 << 40,
+	}
 )
 
 // JSONResponse Sends a JSON payload in response to a HTTP request
@@ -68,3 +85,27 @@ func ParseJSONBody(v interface{}, w http.ResponseWriter, r *http.Request) error
 func IsSHA256(s string) bool {
 	return sha256Regex.MatchString(s)
 }
+
+// ParseByteSize parses a size in bytes with an optional unit suffix (e.g. `512MiB` or `10GB`)
+func ParseByteSize(s string) (int64, error) {
+	match := byteSizeRegex.FindStringSubmatch(strings.TrimSpace(s))
+	if match == nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+
+	mult, ok := byteSizeUnits[strings.ToLower(match[2])]
+	if !ok {
+		return 0, fmt.Errorf("invalid size unit %q", match[2])
+	}
+
+	n, err := strconv.ParseInt(match[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q: %w", s, err)
+	}
+
+	if n > math.MaxInt64/mult {
+		return 0, fmt.Errorf("%w (size %q is too large)", ErrBadValue, s)
+	}
+
+	return n * mult, nil
+}